@@ -0,0 +1,14 @@
+// Package api holds the OpenAPI description of the HTTP API and a page to browse it
+package api
+
+import _ "embed"
+
+// OpenAPI 3 document of every route, kept in step with the handlers by the contract tests
+//
+//go:embed openapi.json
+var Spec []byte
+
+// Self-contained page rendering Spec from /openapi.json, with a form to try each operation
+//
+//go:embed docs.html
+var DocsPage []byte
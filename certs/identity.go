@@ -0,0 +1,82 @@
+package certs
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"httpserver/models"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Prefixes of the identities a client certificate carries
+const (
+	IdentityURI     = "uri:"
+	IdentityDNS     = "dns:"
+	IdentityEmail   = "email:"
+	IdentitySubject = "subject:"
+)
+
+// Service a client certificate identity stands for
+type ClientIdentity struct {
+	// Principal ID the service acts as, the identity without its prefix when empty
+	Principal string `json:"principal"`
+
+	// One of models.Roles
+	Role string `json:"role"`
+}
+
+// Services by client certificate identity, such as "uri:spiffe://internal/payroll" or "subject:CN=recon,O=Internal"
+type ClientMap map[string]ClientIdentity
+
+// Read a ClientMap from a JSON file, refusing unknown prefixes and roles
+func LoadClientMap(path string) (ClientMap, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m ClientMap
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("invalid client map %s: %w", path, err)
+	}
+	for identity, client := range m {
+		prefix, value, _ := strings.Cut(identity, ":")
+		if !slices.Contains([]string{IdentityURI, IdentityDNS, IdentityEmail, IdentitySubject}, prefix+":") || value == "" {
+			return nil, fmt.Errorf("invalid client map %s: %q must start with uri:, dns:, email: or subject:", path, identity)
+		}
+		if !slices.Contains(models.Roles, client.Role) {
+			return nil, fmt.Errorf("invalid client map %s: role of %q must be one of %s", path, identity, strings.Join(models.Roles, ", "))
+		}
+		if client.Principal == "" {
+			client.Principal = value
+			m[identity] = client
+		}
+	}
+	return m, nil
+}
+
+// Identities of a certificate, SANs first as they are what modern CAs issue
+func Identities(cert *x509.Certificate) []string {
+	var ids []string
+	for _, uri := range cert.URIs {
+		ids = append(ids, IdentityURI+uri.String())
+	}
+	for _, name := range cert.DNSNames {
+		ids = append(ids, IdentityDNS+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		ids = append(ids, IdentityEmail+email)
+	}
+	return append(ids, IdentitySubject+cert.Subject.String())
+}
+
+// The service of the first identity of cert that is mapped
+func (m ClientMap) Lookup(cert *x509.Certificate) (ClientIdentity, bool) {
+	for _, id := range Identities(cert) {
+		if client, ok := m[id]; ok {
+			return client, true
+		}
+	}
+	return ClientIdentity{}, false
+}
@@ -0,0 +1,209 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TLS versions selectable as the minimum
+var versions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLS 1.2 suites of each cipher policy, TLS 1.3 suites are fixed by Go and all AEAD.
+// modern only allows forward secret AEAD suites, compatible is Go's default list
+var cipherPolicies = map[string][]uint16{
+	"modern": {
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	},
+	"compatible": nil,
+}
+
+// How client certificates are asked for
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+// Settings of the TLS listener, file paths are read by NewReloader and again whenever they change
+type Options struct {
+	CertFile string
+	KeyFile  string
+
+	// "1.2" or "1.3"
+	MinVersion string
+
+	// "modern" or "compatible"
+	CipherPolicy string
+
+	// CA bundle client certificates are verified against, empty to not ask for them
+	ClientCAFile string
+
+	// "optional" or "require", used with ClientCAFile
+	ClientAuth string
+}
+
+// Server TLS configuration whose certificate and client CAs are replaced when their files change.
+// A failed reload keeps the previous ones, so a half-written renewal does not take the listener down
+type Reloader struct {
+	options Options
+	base    *tls.Config
+
+	// Configuration handed to each new connection, swapped whole on reload
+	current atomic.Pointer[tls.Config]
+
+	// Modification times and sizes of the files as last loaded, held while loading
+	mu     sync.Mutex
+	loaded []fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Check the options and load the files once, failing if that load fails
+func NewReloader(options Options) (*Reloader, error) {
+	minVersion, ok := versions[options.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS version %q", options.MinVersion)
+	}
+	suites, ok := cipherPolicies[options.CipherPolicy]
+	if !ok {
+		return nil, fmt.Errorf("unknown cipher policy %q", options.CipherPolicy)
+	}
+	r := &Reloader{options: options, base: &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: suites,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}}
+	if options.ClientCAFile != "" {
+		if r.base.ClientAuth, ok = clientAuthModes[options.ClientAuth]; !ok {
+			return nil, fmt.Errorf("unknown client auth mode %q", options.ClientAuth)
+		}
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Configuration for http.Server, every handshake uses the files as last loaded
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.base.MinVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load(), nil
+		},
+	}
+}
+
+// Read the certificate, key and client CAs and use them for new connections
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reload()
+}
+
+func (r *Reloader) reload() error {
+	stamps, err := r.stamp()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.options.CertFile, r.options.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := r.base.Clone()
+	config.Certificates = []tls.Certificate{cert}
+
+	if r.options.ClientCAFile != "" {
+		raw, err := os.ReadFile(r.options.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CAs: %w", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(raw) {
+			return errors.New("no certificates in " + r.options.ClientCAFile)
+		}
+	}
+
+	r.current.Store(config)
+	r.loaded = stamps
+	return nil
+}
+
+// Check the files every interval and reload when one changed, until ctx is done
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := r.reloadIfChanged()
+		if err != nil {
+			log.Printf("Keeping the previous TLS certificate: %v", err)
+		} else if reloaded {
+			log.Printf("Reloaded TLS certificate from %s", r.options.CertFile)
+		}
+	}
+}
+
+// Reload unless every file is as last loaded. A failed load is tried again on the next call
+func (r *Reloader) reloadIfChanged() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stamps, err := r.stamp()
+	if err != nil {
+		return false, err
+	}
+	if !r.changed(stamps) {
+		return false, nil
+	}
+	return true, r.reload()
+}
+
+// Stat every file, following symlinks so swapped mounts count as changes
+func (r *Reloader) stamp() ([]fileStamp, error) {
+	paths := []string{r.options.CertFile, r.options.KeyFile}
+	if r.options.ClientCAFile != "" {
+		paths = append(paths, r.options.ClientCAFile)
+	}
+	stamps := make([]fileStamp, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{info.ModTime(), info.Size()})
+	}
+	return stamps, nil
+}
+
+func (r *Reloader) changed(stamps []fileStamp) bool {
+	for i, s := range stamps {
+		if !s.modTime.Equal(r.loaded[i].modTime) || s.size != r.loaded[i].size {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package fx
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/shopspring/decimal"
+)
+
+var ErrRateUnavailable = errors.New("exchange rate unavailable")
+
+// Decimal places kept when a rate is derived from its inverse
+const inverseRatePrecision = 16
+
+// Source of exchange rates, a rate is how many units of to one unit of from buys
+type RateProvider interface {
+	Rate(from string, to string) (decimal.Decimal, error)
+}
+
+// Rates held in memory, mainly for tests
+type MemoryProvider struct {
+	mu    sync.RWMutex
+	rates map[string]decimal.Decimal
+}
+
+func NewMemoryProvider() *MemoryProvider {
+	return &MemoryProvider{rates: map[string]decimal.Decimal{}}
+}
+
+func pairKey(from string, to string) string {
+	return strings.ToUpper(from) + "/" + strings.ToUpper(to)
+}
+
+// Set the rate for a currency pair
+func (p *MemoryProvider) Set(from string, to string, rate decimal.Decimal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rates[pairKey(from, to)] = rate
+}
+
+// Replace every rate at once
+func (p *MemoryProvider) replace(rates map[string]decimal.Decimal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rates = rates
+}
+
+// Look up a rate, falling back to the inverse of the opposite pair
+func (p *MemoryProvider) Rate(from string, to string) (decimal.Decimal, error) {
+	if strings.EqualFold(from, to) {
+		return decimal.NewFromInt(1), nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if rate, ok := p.rates[pairKey(from, to)]; ok {
+		return rate, nil
+	}
+	if inverse, ok := p.rates[pairKey(to, from)]; ok && inverse.IsPositive() {
+		return decimal.NewFromInt(1).DivRound(inverse, inverseRatePrecision), nil
+	}
+	return decimal.Decimal{}, fmt.Errorf("%w for %s", ErrRateUnavailable, pairKey(from, to))
+}
+
+// Rates read from a JSON file of "FROM/TO": "rate" pairs
+type StaticFileProvider struct {
+	MemoryProvider
+	path string
+}
+
+func NewStaticFileProvider(path string) (*StaticFileProvider, error) {
+	p := &StaticFileProvider{MemoryProvider: *NewMemoryProvider(), path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Read the file again, keeping the old rates if it is invalid
+func (p *StaticFileProvider) Reload() error {
+	raw, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+
+	var file struct {
+		Rates map[string]decimal.Decimal `json:"rates"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return fmt.Errorf("invalid rates file %s: %w", p.path, err)
+	}
+
+	rates := make(map[string]decimal.Decimal, len(file.Rates))
+	for pair, rate := range file.Rates {
+		from, to, ok := strings.Cut(pair, "/")
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("invalid currency pair %q in %s", pair, p.path)
+		}
+		if !rate.IsPositive() {
+			return fmt.Errorf("rate for %s in %s must be positive", pair, p.path)
+		}
+		rates[pairKey(from, to)] = rate
+	}
+
+	p.replace(rates)
+	return nil
+}
@@ -0,0 +1,379 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"httpserver/jwt"
+	"httpserver/models"
+	"httpserver/store"
+	"httpserver/utils"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a signed request, the signature covers method, path and query, timestamp and body
+const (
+	APIKeyIDHeader           = "X-API-Key-ID"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureHeader          = "X-Signature"
+)
+
+// How the caller of a request authenticated
+const (
+	AuthMethodAPIKey     = "api_key"
+	AuthMethodSignature  = "signature"
+	AuthMethodJWT        = "jwt"
+	AuthMethodClientCert = "client_cert"
+)
+
+// Sent with every 401 so clients know which scheme to use
+const authChallenge = `Bearer realm="transfers"`
+
+// Why a request was refused, reported as a 401 with code
+type authError struct {
+	code    string
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+// WWW-Authenticate for the failure, bearer token errors are named as RFC 6750 asks
+func (e *authError) challenge() string {
+	if e.code == CodeInvalidToken || e.code == CodeTokenExpired {
+		return authChallenge + `, error="invalid_token"`
+	}
+	return authChallenge
+}
+
+var (
+	errUnauthenticated   = &authError{CodeUnauthenticated, "Authentication required, send a bearer token or sign the request"}
+	errClientCertificate = &authError{CodeUnauthenticated, "Authentication required, connect with a client certificate this server knows"}
+	errInvalidAPIKey     = &authError{CodeInvalidAPIKey, "Invalid or revoked API key"}
+	errSignatureRequired = &authError{CodeSignatureRequired, "This API key may only be used to sign requests"}
+	errSignatureHeaders  = &authError{CodeInvalidSignature, "Signed requests need " + APIKeyIDHeader + ", " + SignatureTimestampHeader + " and " + SignatureHeader}
+	errInvalidSignature  = &authError{CodeInvalidSignature, "Signature does not match the request"}
+	errSignatureExpired  = &authError{CodeSignatureExpired, "Signature timestamp is outside the accepted window"}
+	errSignatureReplayed = &authError{CodeSignatureReplayed, "Signature was already used"}
+	errSigningKeyMissing = &authError{CodeInvalidSignature, "This API key cannot sign requests, create a new one to sign with"}
+)
+
+// Returned when a key that must sign is created without the cipher its signing key is stored with
+var ErrSigningDisabled = errors.New("signed API keys need an api-key-signing-secret-file")
+
+// Shortest secret NewSigningKeyCipher accepts
+const minSigningSecretLength = 32
+
+// Create a key for role with a random ID and secret. The token is only returned here,
+// the store keeps a hash of the secret and, when signingKeys is set, the signing key encrypted with it
+func NewAPIKey(name string, requireSignature bool, role string, signingKeys cipher.AEAD) (*models.APIKey, string, error) {
+	if requireSignature && signingKeys == nil {
+		return nil, "", ErrSigningDisabled
+	}
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	key := &models.APIKey{
+		KeyID:            hex.EncodeToString(id),
+		Name:             name,
+		RequireSignature: requireSignature,
+		Role:             role,
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	key.SecretHash = HashAPISecret(encoded)
+	if signingKeys != nil {
+		nonce := make([]byte, signingKeys.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, "", err
+		}
+		key.SigningKey = signingKeys.Seal(nonce, nonce, SigningKey(encoded), []byte(key.KeyID))
+	}
+	return key, key.KeyID + "." + encoded, nil
+}
+
+// Hash of an API key secret as stored, it only verifies bearer tokens
+func HashAPISecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// HMAC key a client signs requests with, derived from its secret so the stored hash cannot sign
+func SigningKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("request-signing"))
+	return mac.Sum(nil)
+}
+
+// AES-GCM cipher the signing keys of API keys are stored with, keyed by a secret kept out of the store
+func NewSigningKeyCipher(secret []byte) (cipher.AEAD, error) {
+	if len(secret) < minSigningSecretLength {
+		return nil, fmt.Errorf("signing secret must be at least %d bytes, got %d", minSigningSecretLength, len(secret))
+	}
+	sum := sha256.Sum256(secret)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Decrypt the signing key of key, false when it has none or it was stored under another secret.
+// The key ID is authenticated with it, so a signing key copied to another row does not open
+func (s *Server) signingKey(key *models.APIKey) ([]byte, bool) {
+	size := 0
+	if s.SigningKeys != nil {
+		size = s.SigningKeys.NonceSize()
+	}
+	if size == 0 || len(key.SigningKey) < size {
+		return nil, false
+	}
+	signingKey, err := s.SigningKeys.Open(nil, key.SigningKey[:size], key.SigningKey[size:], []byte(key.KeyID))
+	return signingKey, err == nil
+}
+
+// Hex HMAC-SHA256 of a request under signingKey, over the lines
+// method, path with query, Unix timestamp and hex SHA-256 of the body
+func SignRequest(signingKey []byte, method string, requestURI string, timestamp int64, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + strconv.FormatInt(timestamp, 10) + "\n" + hex.EncodeToString(bodyHash[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type principalKey struct{}
+
+// Attach the authenticated caller to a context
+func WithPrincipal(ctx context.Context, principal *models.Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// The authenticated caller of a request, false when authentication is off
+func PrincipalFrom(ctx context.Context) (*models.Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*models.Principal)
+	return principal, ok
+}
+
+// Refuse requests without valid credentials when APIKeyAuth, JWT or ClientCerts is on, the caller is put in the request context.
+// Failures are logged by code only, credentials never reach the log
+func (s *Server) Authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.APIKeyAuth && s.JWT == nil && s.ClientCerts == nil {
+			next(w, r)
+			return
+		}
+
+		if s.authThrottled(w, r) {
+			return
+		}
+		principal, err := s.authenticate(r)
+		var authErr *authError
+		if errors.As(err, &authErr) {
+			s.chargeFailedAuth(w, r)
+			log.Printf("%s %s request %s: authentication failed: %s", r.Method, r.URL.Path, w.Header().Get(utils.RequestIDHeader), authErr.code)
+			w.Header().Set("WWW-Authenticate", authErr.challenge())
+			utils.WriteError(w, http.StatusUnauthorized, authErr.code, authErr.message)
+			return
+		}
+		if err != nil {
+			writeError(w, r, err, "Failed to authenticate")
+			return
+		}
+		next(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	}
+}
+
+// Check the client certificate, then the bearer token, or the signature when the request carries one.
+// JWTs have three dot-separated parts, API keys two
+func (s *Server) authenticate(r *http.Request) (*models.Principal, error) {
+	if principal, ok := s.authenticateClientCert(r); ok {
+		return principal, nil
+	}
+	if !s.APIKeyAuth && s.JWT == nil {
+		return nil, errClientCertificate
+	}
+
+	if s.APIKeyAuth && (r.Header.Get(APIKeyIDHeader) != "" || r.Header.Get(SignatureHeader) != "") {
+		return s.authenticateSignature(r)
+	}
+
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errUnauthenticated
+	}
+	if s.JWT != nil && strings.Count(token, ".") == 2 {
+		return s.authenticateJWT(r, token)
+	}
+	if !s.APIKeyAuth {
+		return nil, &authError{CodeInvalidToken, "Invalid token: " + jwt.ErrMalformed.Error()}
+	}
+	keyID, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+	key, err := s.activeAPIKey(r.Context(), keyID)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(HashAPISecret(secret), key.SecretHash) != 1 {
+		return nil, errInvalidAPIKey
+	}
+	if key.RequireSignature {
+		return nil, errSignatureRequired
+	}
+	return &models.Principal{ID: key.KeyID, Method: AuthMethodAPIKey, Role: key.Role}, nil
+}
+
+// Check a request signed with SignRequest, each signature is accepted once within SignatureWindow
+func (s *Server) authenticateSignature(r *http.Request) (*models.Principal, error) {
+	keyID := r.Header.Get(APIKeyIDHeader)
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	timestamp, tsErr := strconv.ParseInt(r.Header.Get(SignatureTimestampHeader), 10, 64)
+	if keyID == "" || len(signature) == 0 || err != nil || tsErr != nil {
+		return nil, errSignatureHeaders
+	}
+
+	// Old or future timestamps are refused before any lookup
+	now := time.Now()
+	signedAt := time.Unix(timestamp, 0)
+	if signedAt.Before(now.Add(-s.SignatureWindow)) || signedAt.After(now.Add(s.SignatureWindow)) {
+		return nil, errSignatureExpired
+	}
+
+	key, err := s.activeAPIKey(r.Context(), keyID)
+	if err != nil {
+		return nil, err
+	}
+	signingKey, ok := s.signingKey(key)
+	if !ok {
+		return nil, errSigningKeyMissing
+	}
+
+	// Read the body for the signature and hand a copy to the handler, before any handler limits it
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, MaxRequestBodyBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, ErrBodyTooLarge
+	}
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected, _ := hex.DecodeString(SignRequest(signingKey, r.Method, r.URL.RequestURI(), timestamp, body))
+	if !hmac.Equal(signature, expected) {
+		return nil, errInvalidSignature
+	}
+
+	// Past the window the timestamp check refuses it, so it only needs remembering until then
+	if !s.signatures.add(string(signature), signedAt.Add(s.SignatureWindow), now) {
+		return nil, errSignatureReplayed
+	}
+	return &models.Principal{ID: key.KeyID, Method: AuthMethodSignature, Role: key.Role}, nil
+}
+
+// Check a JWT issued by the identity provider, its subject is the caller and JWTRoleClaim its role
+func (s *Server) authenticateJWT(r *http.Request, token string) (*models.Principal, error) {
+	claims, err := s.JWT.Verify(r.Context(), token)
+	switch {
+	case errors.Is(err, jwt.ErrExpired):
+		return nil, &authError{CodeTokenExpired, "Token expired"}
+	case errors.Is(err, jwt.ErrKeysUnavailable):
+		return nil, err
+	case err != nil:
+		return nil, &authError{CodeInvalidToken, "Invalid token: " + err.Error()}
+	}
+
+	// A token without a known role is still authenticated, the policy then refuses everything
+	var role string
+	json.Unmarshal(claims.Extra[s.JWTRoleClaim], &role)
+	if !slices.Contains(models.Roles, role) {
+		role = ""
+	}
+	return &models.Principal{ID: claims.Subject, Method: AuthMethodJWT, Role: role}, nil
+}
+
+// The service a verified client certificate is mapped to. Certificates the TLS layer did not
+// verify against the client CAs, or that map to nothing, leave the request to the other methods
+func (s *Server) authenticateClientCert(r *http.Request) (*models.Principal, bool) {
+	if s.ClientCerts == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, false
+	}
+	client, ok := s.ClientCerts.Lookup(r.TLS.VerifiedChains[0][0])
+	if !ok {
+		return nil, false
+	}
+	return &models.Principal{ID: client.Principal, Method: AuthMethodClientCert, Role: client.Role}, true
+}
+
+// Look up a key that has not been revoked, anything else is an invalid key
+func (s *Server) activeAPIKey(ctx context.Context, keyID string) (*models.APIKey, error) {
+	key, err := s.Store.GetAPIKey(ctx, keyID)
+	if errors.Is(err, store.ErrAPIKeyNotFound) {
+		return nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil {
+		return nil, errInvalidAPIKey
+	}
+	return key, nil
+}
+
+// Size the replay cache may reach before expired signatures are dropped
+const minReplaySweep = 1024
+
+// Signatures seen within the replay window. Held in process, so each replica keeps its own
+type replayCache struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	sweep int
+}
+
+// Remember a signature until expiresAt, false if it is already remembered
+func (c *replayCache) add(signature string, expiresAt time.Time, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seen == nil {
+		c.seen = map[string]time.Time{}
+	}
+	if until, ok := c.seen[signature]; ok && until.After(now) {
+		return false
+	}
+
+	// Drop expired signatures whenever the cache doubles, so it stays near the number signed per window
+	if len(c.seen) >= max(c.sweep, minReplaySweep) {
+		for sig, until := range c.seen {
+			if !until.After(now) {
+				delete(c.seen, sig)
+			}
+		}
+		c.sweep = 2 * len(c.seen)
+	}
+	c.seen[signature] = expiresAt
+	return true
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Non-standard status for a client that went away before the response, as used by nginx
+const StatusClientClosedRequest = 499
+
+// Largest request body read, the JSON the API takes is far smaller
+const MaxRequestBodyBytes = 1 << 20
+
+// Returned when a request body is over MaxRequestBodyBytes
+var ErrBodyTooLarge = errors.New("request body is too large")
+
+// Refuse to read more than MaxRequestBodyBytes of any request body, whoever reads it
+func withBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxRequestBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Give every request at most RequestTimeout, store calls made with its context are abandoned after that
+func (s *Server) WithRequestTimeout(next http.Handler) http.Handler {
+	if s.RequestTimeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), s.RequestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Status for an error caused by the request's context ending, ok is false for any other error.
+// Drivers do not always wrap the context error, so the context itself is checked too
+func contextErrorStatus(r *http.Request, err error) (status int, code string, message string, ok bool) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(r.Context().Err(), context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, CodeTimeout, "request timed out", true
+	case errors.Is(err, context.Canceled), errors.Is(r.Context().Err(), context.Canceled):
+		return StatusClientClosedRequest, CodeClientClosedRequest, "request canceled", true
+	}
+	return 0, "", "", false
+}
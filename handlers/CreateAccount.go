@@ -1,48 +1,133 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"httpserver/models"
+	"httpserver/store"
 	"httpserver/utils"
 	"net/http"
 	"strconv"
+
+	"github.com/shopspring/decimal"
 )
 
-// Handler to create account
-func CreateAccountHandler(w http.ResponseWriter, r *http.Request) {
+// Returned when an account with the same ID exists
+var ErrDuplicateAccount = store.ErrDuplicateAccount
+
+// Longest owner the accounts table holds
+const maxOwnerLength = 255
+
+// Helper function to create an account owned by owner in tier, standard when empty. The initial balance is posted against equity
+func (s *Server) CreateAccount(ctx context.Context, accountID int, currency string, initialBalance decimal.Decimal, owner string, tier string) error {
+	if tier == "" {
+		tier = models.TierStandard
+	}
+	return s.Store.WithTx(ctx, func(tx store.Tx) error {
+
+		// Create new account with input details
+		err := tx.CreateAccount(models.Account{AccountID: accountID, CurrentBalance: initialBalance, Currency: currency, Owner: owner, Tier: tier})
+		if err != nil {
+			return err
+		}
+
+		// Opening balance entry so the balance is backed by postings
+		if !initialBalance.IsZero() {
+			_, err = PostJournalEntry(tx, models.JournalOpeningBalance, nil, []models.Posting{
+				{AccountID: models.EquityAccountID, Currency: currency, Amount: initialBalance.Neg()},
+				{AccountID: accountID, Currency: currency, Amount: initialBalance},
+			})
+		}
+		return err
+	})
+}
+
+// Handler to create account, responds with an empty 204
+func (s *Server) CreateAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.createAccountFromRequest(w, r); ok {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
 
-	// Ensure usage of POST method
-	if r.Method != http.MethodPost {
-		utils.WriteError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+// Handler to create account under /v1, responds with the new account and where to find it
+func (s *Server) CreateAccountV1Handler(w http.ResponseWriter, r *http.Request) {
+	account, ok := s.createAccountFromRequest(w, r)
+	if !ok {
 		return
 	}
+	w.Header().Set("Location", "/v1/accounts/"+strconv.Itoa(account.AccountID))
+	utils.WriteJSON(w, http.StatusCreated, account)
+}
+
+// Validate the request body and create the account, writing the error response if that fails
+func (s *Server) createAccountFromRequest(w http.ResponseWriter, r *http.Request) (*models.Account, bool) {
+
+	// Opening balances come out of equity, so only staff may create accounts
+	if err := s.authorize(r.Context(), ActionCreateAccount); err != nil {
+		writeError(w, r, err, "")
+		return nil, false
+	}
 
 	// Input structure
 	var input struct {
 		AccountID      int    `json:"account_id"`
 		InitialBalance string `json:"initial_balance"`
+		Currency       string `json:"currency"`
+		Owner          string `json:"owner"`
+		Tier           string `json:"tier"`
 	}
 
 	// Verify JSON is valid
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
-		return
+		utils.WriteError(w, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON")
+		return nil, false
+	}
+
+	// Verify account_id is positive, other IDs are reserved for system accounts
+	if input.AccountID <= 0 {
+		writeError(w, r, invalid("account_id", "account_id must be a positive integer"), "")
+		return nil, false
 	}
 
-	// Verify initial_balance is a number
-	initialBalance, err := strconv.ParseFloat(input.InitialBalance, 64)
+	// Verify currency is given and supported
+	currency, err := models.ParseCurrency(input.Currency)
 	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, "initial_balance must be a number")
-		return
+		writeError(w, r, invalid("currency", "currency must be one of the supported currency codes"), "")
+		return nil, false
 	}
 
-	// Create new account with input details
-	_, err = models.DB.Exec("INSERT INTO accounts (account_id, balance) VALUES ($1, $2)", input.AccountID, initialBalance)
+	// Verify initial_balance is a non-negative number within the currency's scale
+	scale := models.Currencies[currency]
+	initialBalance, err := models.ParseMoney(input.InitialBalance, scale)
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, "Failed to create account")
-		return
+		writeError(w, r, invalid("initial_balance", "initial_balance must be a number with at most "+strconv.Itoa(int(scale))+" decimal places for "+currency), "")
+		return nil, false
+	}
+	if initialBalance.IsNegative() {
+		writeError(w, r, invalid("initial_balance", "initial_balance must not be negative"), "")
+		return nil, false
+	}
+
+	// Verify owner fits the column, it is the principal ID of the customer the account is for
+	if len(input.Owner) > maxOwnerLength {
+		writeError(w, r, invalid("owner", "owner must be at most "+strconv.Itoa(maxOwnerLength)+" characters"), "")
+		return nil, false
+	}
+
+	// Verify tier is one velocity limits are configured for, or standard
+	if input.Tier == "" {
+		input.Tier = models.TierStandard
+	}
+	if !s.knownTier(input.Tier) {
+		writeError(w, r, invalid("tier", "tier must be standard or a tier with velocity limits"), "")
+		return nil, false
+	}
+
+	// Create the account and its opening balance entry together
+	if err := s.CreateAccount(r.Context(), input.AccountID, currency, initialBalance, input.Owner, input.Tier); err != nil {
+		writeError(w, r, err, "Failed to create account")
+		return nil, false
 	}
 
-	// Empty response if successful
-	w.WriteHeader(http.StatusNoContent)
+	return &models.Account{AccountID: input.AccountID, CurrentBalance: initialBalance, Currency: currency, Owner: input.Owner, Tier: input.Tier}, true
 }
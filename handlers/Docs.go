@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"httpserver/api"
+	"net/http"
+)
+
+// Handler serving the OpenAPI document
+func (s *Server) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(api.Spec)
+}
+
+// Handler serving a page to browse and try the API
+func (s *Server) DocsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(api.DocsPage)
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"httpserver/fx"
+	"httpserver/jwt"
+	"httpserver/models"
+	"httpserver/store"
+	"httpserver/utils"
+	"log"
+	"net/http"
+)
+
+// Machine-readable error codes, part of the API and never changed once released
+const (
+	CodeNotFound                 = "not_found"
+	CodeMethodNotAllowed         = "method_not_allowed"
+	CodeVersionRetired           = "api_version_retired"
+	CodeUnauthenticated          = "unauthenticated"
+	CodeInvalidAPIKey            = "invalid_api_key"
+	CodeSignatureRequired        = "signature_required"
+	CodeInvalidSignature         = "invalid_signature"
+	CodeSignatureExpired         = "signature_expired"
+	CodeSignatureReplayed        = "signature_replayed"
+	CodeInvalidToken             = "invalid_token"
+	CodeTokenExpired             = "token_expired"
+	CodeForbidden                = "forbidden"
+	CodeRateLimited              = "rate_limited"
+	CodeInvalidJSON              = "invalid_json"
+	CodeInvalidBody              = "invalid_body"
+	CodeBodyTooLarge             = "body_too_large"
+	CodeValidationFailed         = "validation_failed"
+	CodeAccountNotFound          = "account_not_found"
+	CodeDuplicateAccount         = "duplicate_account"
+	CodeTransactionNotFound      = "transaction_not_found"
+	CodeSameAccount              = "same_account"
+	CodeSourceNotFound           = "source_account_not_found"
+	CodeDestinationNotFound      = "destination_account_not_found"
+	CodeInsufficientFunds        = "insufficient_funds"
+	CodeCurrencyMismatch         = "currency_mismatch"
+	CodeAmountTooPrecise         = "amount_too_precise"
+	CodeConversionTooSmall       = "conversion_too_small"
+	CodeVelocityLimitExceeded    = "velocity_limit_exceeded"
+	CodeQuoteNotFound            = "quote_not_found"
+	CodeQuoteExpired             = "quote_expired"
+	CodeQuoteMismatch            = "quote_mismatch"
+	CodeRateUnavailable          = "rate_unavailable"
+	CodeIdempotencyKeyReused     = "idempotency_key_reused"
+	CodeIdempotencyKeyInProgress = "idempotency_key_in_progress"
+	CodeConflict                 = "conflict"
+	CodeConstraintViolation      = "constraint_violation"
+	CodeTransactionConflict      = "transaction_conflict"
+	CodeServiceUnavailable       = "service_unavailable"
+	CodeTimeout                  = "timeout"
+	CodeClientClosedRequest      = "client_closed_request"
+	CodeInternal                 = "internal_error"
+)
+
+// Seconds a client is asked to wait before retrying a 503
+const retryAfterSeconds = "1"
+
+// Status and code of every sentinel error a handler can return, retry ones carry Retry-After
+var errorResponses = []struct {
+	err    error
+	status int
+	code   string
+	retry  bool
+}{
+	{ErrForbidden, http.StatusForbidden, CodeForbidden, false},
+	{ErrBodyTooLarge, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, false},
+	{ErrAccountNotFound, http.StatusNotFound, CodeAccountNotFound, false},
+	{ErrDuplicateAccount, http.StatusConflict, CodeDuplicateAccount, false},
+	{ErrTransactionNotFound, http.StatusNotFound, CodeTransactionNotFound, false},
+	{ErrSameAccount, http.StatusBadRequest, CodeSameAccount, false},
+	{ErrSourceNotFound, http.StatusBadRequest, CodeSourceNotFound, false},
+	{ErrDestinationNotFound, http.StatusBadRequest, CodeDestinationNotFound, false},
+	{ErrInsufficientFunds, http.StatusBadRequest, CodeInsufficientFunds, false},
+	{ErrCurrencyMismatch, http.StatusBadRequest, CodeCurrencyMismatch, false},
+	{models.ErrTooPrecise, http.StatusBadRequest, CodeAmountTooPrecise, false},
+	{models.ErrTooLarge, http.StatusBadRequest, CodeValidationFailed, false},
+	{ErrConversionTooThin, http.StatusBadRequest, CodeConversionTooSmall, false},
+	{ErrVelocityLimit, http.StatusUnprocessableEntity, CodeVelocityLimitExceeded, false},
+	{ErrQuoteNotFound, http.StatusUnprocessableEntity, CodeQuoteNotFound, false},
+	{ErrQuoteExpired, http.StatusUnprocessableEntity, CodeQuoteExpired, false},
+	{ErrQuoteMismatch, http.StatusUnprocessableEntity, CodeQuoteMismatch, false},
+	{fx.ErrRateUnavailable, http.StatusUnprocessableEntity, CodeRateUnavailable, false},
+	{store.ErrConflict, http.StatusConflict, CodeConflict, false},
+	{store.ErrConstraint, http.StatusUnprocessableEntity, CodeConstraintViolation, false},
+	{ErrTooManyConflicts, http.StatusServiceUnavailable, CodeTransactionConflict, true},
+	{store.ErrSerialization, http.StatusServiceUnavailable, CodeTransactionConflict, true},
+	{store.ErrUnavailable, http.StatusServiceUnavailable, CodeServiceUnavailable, true},
+	{store.ErrClosed, http.StatusServiceUnavailable, CodeServiceUnavailable, true},
+	{jwt.ErrKeysUnavailable, http.StatusServiceUnavailable, CodeServiceUnavailable, true},
+}
+
+// Invalid input, reported as 400 validation_failed naming the offending field
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func invalid(field string, message string) error {
+	return &ValidationError{Field: field, Message: message}
+}
+
+// Write the response for err. Known errors have a fixed status and code,
+// anything else is logged and reported as a 500 with message so internals are not leaked
+func writeError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		utils.WriteErrorDetails(w, http.StatusBadRequest, CodeValidationFailed, validation.Message, map[string]any{"field": validation.Field})
+		return
+	}
+	for _, e := range errorResponses {
+		if errors.Is(err, e.err) {
+			if e.status >= http.StatusInternalServerError {
+				logError(r, w, err)
+			}
+			if e.retry {
+				w.Header().Set("Retry-After", retryAfterSeconds)
+			}
+			utils.WriteError(w, e.status, e.code, err.Error())
+			return
+		}
+	}
+	if status, code, contextMessage, ok := contextErrorStatus(r, err); ok {
+		utils.WriteError(w, status, code, contextMessage)
+		return
+	}
+
+	logError(r, w, err)
+	utils.WriteError(w, http.StatusInternalServerError, CodeInternal, message)
+}
+
+// Log the full error, driver details included, against the request ID
+func logError(r *http.Request, w http.ResponseWriter, err error) {
+	if cause := store.DriverError(err); cause != err {
+		err = fmt.Errorf("%w: %v", err, cause)
+	}
+	log.Printf("%s %s request %s: %v", r.Method, r.URL.Path, w.Header().Get(utils.RequestIDHeader), err)
+}
+
+// Answer requests no route matches with a problem instead of the mux's plain text.
+// The mux still decides between 404 and 405 and which methods go in Allow
+func withRouteErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		// Only the 405 handler sets Allow, its body is discarded
+		rec := discardResponse{header: http.Header{}}
+		h.ServeHTTP(rec, r)
+		if allow := rec.header.Get("Allow"); allow != "" {
+			w.Header().Set("Allow", allow)
+			utils.WriteError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method Not Allowed")
+			return
+		}
+		utils.WriteError(w, http.StatusNotFound, CodeNotFound, "Not Found")
+	})
+}
+
+// Keeps the headers a handler sets and nothing else
+type discardResponse struct {
+	header http.Header
+}
+
+func (d discardResponse) Header() http.Header {
+	return d.header
+}
+
+func (discardResponse) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (discardResponse) WriteHeader(int) {}
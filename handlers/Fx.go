@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"httpserver/models"
+	"httpserver/store"
+	"httpserver/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrQuoteNotFound     = store.ErrQuoteNotFound
+	ErrQuoteExpired      = errors.New("quote has expired")
+	ErrQuoteMismatch     = errors.New("quote does not match the transfer currencies and amount")
+	ErrConversionTooThin = errors.New("converted amount rounds down to zero")
+)
+
+// Generate an unguessable quote ID
+func newQuoteID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "q_" + hex.EncodeToString(b), nil
+}
+
+// Helper function to quote a conversion at the current rate and lock it for FxQuoteTTL
+func (s *Server) CreateFxQuote(ctx context.Context, sourceCurrency string, destCurrency string, amount decimal.Decimal) (*models.FxQuote, error) {
+	rate, err := s.FxRates.Rate(sourceCurrency, destCurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	converted, remainder := models.Convert(amount, rate, destCurrency)
+	if !converted.IsPositive() {
+		return nil, ErrConversionTooThin
+	}
+
+	quoteID, err := newQuoteID()
+	if err != nil {
+		return nil, err
+	}
+
+	quote := &models.FxQuote{
+		QuoteID:             quoteID,
+		SourceCurrency:      sourceCurrency,
+		DestinationCurrency: destCurrency,
+		Amount:              amount,
+		Rate:                rate,
+		DestinationAmount:   converted,
+		Remainder:           remainder,
+		ExpiresAt:           time.Now().Add(s.FxQuoteTTL).UTC(),
+	}
+
+	if err := s.Store.CreateFxQuote(ctx, quote); err != nil {
+		return nil, err
+	}
+
+	return quote, nil
+}
+
+// Mark a quote used within a transfer's transaction and verify it matches the transfer
+func claimFxQuote(tx store.Tx, quoteID string, sourceCurrency string, destCurrency string, amount decimal.Decimal) (decimal.Decimal, error) {
+	quote, err := tx.ClaimFxQuote(quoteID)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	if time.Now().After(quote.ExpiresAt) {
+		return decimal.Decimal{}, ErrQuoteExpired
+	}
+	if quote.SourceCurrency != sourceCurrency || quote.DestinationCurrency != destCurrency || !quote.Amount.Equal(amount) {
+		return decimal.Decimal{}, ErrQuoteMismatch
+	}
+
+	return quote.Rate, nil
+}
+
+// Handler to quote a conversion
+func (s *Server) CreateFxQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.authorize(r.Context(), ActionQuote); err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+
+	// Input structure
+	var input struct {
+		SourceCurrency      string `json:"source_currency"`
+		DestinationCurrency string `json:"destination_currency"`
+		Amount              string `json:"amount"`
+	}
+
+	// Verify JSON is valid
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON")
+		return
+	}
+
+	// Verify both currencies are supported and differ
+	sourceCurrency, err := models.ParseCurrency(input.SourceCurrency)
+	if err != nil {
+		writeError(w, r, invalid("source_currency", "source_currency must be one of the supported currency codes"), "")
+		return
+	}
+	destCurrency, err := models.ParseCurrency(input.DestinationCurrency)
+	if err != nil {
+		writeError(w, r, invalid("destination_currency", "destination_currency must be one of the supported currency codes"), "")
+		return
+	}
+	if sourceCurrency == destCurrency {
+		writeError(w, r, invalid("destination_currency", "source_currency and destination_currency must differ"), "")
+		return
+	}
+
+	// Verify amount is a positive number within the source currency's scale
+	scale := models.Currencies[sourceCurrency]
+	amount, err := models.ParseMoney(input.Amount, scale)
+	if err != nil || !amount.IsPositive() {
+		writeError(w, r, invalid("amount", "amount must be a positive number with at most "+strconv.Itoa(int(scale))+" decimal places for "+sourceCurrency), "")
+		return
+	}
+
+	quote, err := s.CreateFxQuote(r.Context(), sourceCurrency, destCurrency, amount)
+	if err != nil {
+		writeError(w, r, err, "Failed to create quote")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, quote)
+}
@@ -1,64 +1,55 @@
 package handlers
 
 import (
-	"database/sql"
-	"fmt"
+	"context"
+	"errors"
 	"httpserver/models"
+	"httpserver/store"
 	"httpserver/utils"
 	"net/http"
 	"strconv"
-	"strings"
 )
 
-// Helper function to be used for other handlers as well
-func GetAccountByID(accountID int) (*models.Account, error) {
+// Returned when no account has the requested ID
+var ErrAccountNotFound = store.ErrAccountNotFound
 
-	// Store balance
-	var balance float64
+// Helper function to be used for other handlers as well, only returns accounts the caller may read
+func (s *Server) GetAccountByID(ctx context.Context, accountID int) (*models.Account, error) {
+	if err := s.authorize(ctx, ActionReadAccount); err != nil {
+		return nil, err
+	}
+	acc, err := s.Store.GetAccount(ctx, accountID)
 
-	// Query for account
-	err := models.DB.QueryRow("SELECT balance FROM accounts WHERE account_id = $1", accountID).Scan(&balance)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("account not found")
+	// Callers limited to their own accounts cannot tell a missing account from someone else's
+	if errors.Is(err, store.ErrAccountNotFound) {
+		if authErr := s.authorizeAccount(ctx, ActionReadAccount, &models.Account{AccountID: accountID}); authErr != nil {
+			return nil, authErr
 		}
 		return nil, err
 	}
-
-	// Store account to be returned
-	acc := &models.Account{
-		AccountID:      accountID,
-		CurrentBalance: balance,
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorizeAccount(ctx, ActionReadAccount, acc); err != nil {
+		return nil, err
 	}
-
 	return acc, nil
 }
 
 // Handler to get account
-func GetAccountHandler(w http.ResponseWriter, r *http.Request) {
-
-	// Ensure usage of GET method
-	if r.Method != http.MethodGet {
-		utils.WriteError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
-		return
-	}
+func (s *Server) GetAccountHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Extract account ID and verify it is a number
-	accountIDStr := strings.TrimPrefix(r.URL.Path, "/accounts/")
-	accountID, err := strconv.Atoi(accountIDStr)
+	accountID, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, "Invalid account ID")
+		writeError(w, r, invalid("account_id", "Invalid account ID"), "")
 		return
 	}
 
 	// Query for account using helper function above
-	acc, err := GetAccountByID(accountID)
+	acc, err := s.GetAccountByID(r.Context(), accountID)
 	if err != nil {
-		if err.Error() == "account not found" {
-			http.Error(w, err.Error(), http.StatusNotFound)
-		} else {
-			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
-		}
+		writeError(w, r, err, "Database error")
 		return
 	}
 
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"httpserver/store"
+	"httpserver/utils"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Longest Idempotency-Key accepted, matches the column size
+const maxIdempotencyKeyLength = 255
+
+// Fingerprint of a request made by caller, a reused key must match it to be replayed.
+// Without a caller it is the one stored before keys were scoped to principals
+func IdempotencyFingerprint(caller string, method string, path string, body []byte) string {
+	sum := sha256.New()
+	if caller != "" {
+		sum.Write([]byte("principal " + caller + "\n"))
+	}
+	sum.Write([]byte(method + " " + path + "\n"))
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// Captures the response so it can be stored for replays
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Wrap a handler taking action so requests carrying an Idempotency-Key are executed at most once.
+// A key is only replayed to the caller who used it, and only while they may still take action
+func (s *Server) Idempotent(action Action, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// Only POST requests with the header are deduplicated
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, invalid("Idempotency-Key", "Idempotency-Key is too long"), "")
+			return
+		}
+
+		// Checked here as well, a replay never reaches the handler
+		if err := s.authorize(r.Context(), action); err != nil {
+			writeError(w, r, err, "")
+			return
+		}
+
+		// Read the body for the fingerprint and hand a copy to the handler
+		body, err := io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, ErrBodyTooLarge, "")
+			return
+		}
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, CodeInvalidBody, "Failed to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var caller string
+		if principal, ok := PrincipalFrom(r.Context()); ok {
+			caller = principal.ID
+		}
+		fingerprint := IdempotencyFingerprint(caller, r.Method, r.URL.Path, body)
+
+		// Claim the key, only one request can hold it
+		claimed, err := s.Store.ClaimIdempotencyKey(r.Context(), key, fingerprint, time.Now().Add(s.IdempotencyRetention))
+		if err != nil {
+			writeError(w, r, err, "Database error")
+			return
+		}
+		if !claimed {
+			s.replayIdempotentResponse(w, r, key, fingerprint)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		// The outcome is recorded even if the request was canceled or timed out meanwhile
+		ctx := context.WithoutCancel(r.Context())
+
+		// Server errors and abandoned requests are not stored so the client can retry with the same key
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError || rec.status == StatusClientClosedRequest {
+			if err := s.Store.ReleaseIdempotencyKey(ctx, key); err != nil {
+				log.Printf("Failed to release Idempotency-Key %q: %v", key, err)
+			}
+			return
+		}
+
+		// On failure the key stays in progress until it expires, which is safer than a second execution
+		err = s.Store.CompleteIdempotencyKey(ctx, key, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes())
+		if err != nil {
+			log.Printf("Failed to store response for Idempotency-Key %q: %v", key, err)
+		}
+	}
+}
+
+// Write the stored response for a key that was already used
+func (s *Server) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, key string, fingerprint string) {
+	stored, err := s.Store.GetIdempotencyKey(r.Context(), key)
+	if errors.Is(err, store.ErrIdempotencyKeyNotFound) {
+		// Released by a failed request in the meantime
+		utils.WriteError(w, http.StatusConflict, CodeIdempotencyKeyInProgress, "A request with this Idempotency-Key was just retried, try again")
+		return
+	}
+	if err != nil {
+		writeError(w, r, err, "Database error")
+		return
+	}
+
+	if stored.Fingerprint != fingerprint {
+		utils.WriteError(w, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, "Idempotency-Key was already used with a different request")
+		return
+	}
+	if stored.StatusCode == 0 {
+		utils.WriteError(w, http.StatusConflict, CodeIdempotencyKeyInProgress, "A request with this Idempotency-Key is still in progress")
+		return
+	}
+
+	// Identical response to the original
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.StatusCode)
+	w.Write(stored.Body)
+}
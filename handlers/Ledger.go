@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"errors"
+	"httpserver/models"
+	"httpserver/store"
+	"httpserver/utils"
+	"net/http"
+
+	"github.com/shopspring/decimal"
+)
+
+var ErrUnbalancedEntry = errors.New("journal entry postings must sum to zero")
+
+// Helper function to write a balanced journal entry within an open store transaction
+func PostJournalEntry(tx store.Tx, kind string, transactionID *int64, postings []models.Posting) (int64, error) {
+
+	// Debits and credits must cancel out within each currency
+	totals := map[string]decimal.Decimal{}
+	for _, p := range postings {
+		totals[p.Currency] = totals[p.Currency].Add(p.Amount)
+	}
+	if len(postings) < 2 {
+		return 0, ErrUnbalancedEntry
+	}
+	for _, total := range totals {
+		if !total.IsZero() {
+			return 0, ErrUnbalancedEntry
+		}
+	}
+
+	return tx.InsertJournalEntry(kind, transactionID, postings)
+}
+
+// Handler to run a reconciliation
+func (s *Server) ReconciliationHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.authorize(r.Context(), ActionReconcile); err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+
+	report, err := s.Store.Reconcile(r.Context())
+	if err != nil {
+		writeError(w, r, err, "Database error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, report)
+}
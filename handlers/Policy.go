@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"httpserver/models"
+)
+
+// Returned when the caller's role does not allow the request
+var ErrForbidden = errors.New("not allowed for this caller")
+
+// What a request does, each role is granted a set of them
+type Action string
+
+const (
+	ActionReadAccount   Action = "read_account"
+	ActionDebitAccount  Action = "debit_account"
+	ActionCreateAccount Action = "create_account"
+	ActionQuote         Action = "quote"
+	ActionReconcile     Action = "reconcile"
+)
+
+// Which accounts a grant covers
+type Scope int
+
+const (
+	ScopeNone Scope = iota
+	ScopeOwn
+	ScopeAll
+)
+
+// Grants of every role, anything not granted is refused
+type Policy map[string]map[Action]Scope
+
+// Auditors only read. Operators move money but do not audit the ledger they move it in
+var DefaultPolicy = Policy{
+	models.RoleCustomer: {
+		ActionReadAccount:  ScopeOwn,
+		ActionDebitAccount: ScopeOwn,
+		ActionQuote:        ScopeAll,
+	},
+	models.RoleAuditor: {
+		ActionReadAccount: ScopeAll,
+		ActionReconcile:   ScopeAll,
+	},
+	models.RoleOperator: {
+		ActionReadAccount:   ScopeAll,
+		ActionDebitAccount:  ScopeAll,
+		ActionCreateAccount: ScopeAll,
+		ActionQuote:         ScopeAll,
+	},
+	models.RoleAdmin: {
+		ActionReadAccount:   ScopeAll,
+		ActionDebitAccount:  ScopeAll,
+		ActionCreateAccount: ScopeAll,
+		ActionQuote:         ScopeAll,
+		ActionReconcile:     ScopeAll,
+	},
+}
+
+// Which accounts the caller may take action on. Without a principal
+// authentication is off, and so is authorization
+func (s *Server) scope(ctx context.Context, action Action) (*models.Principal, Scope) {
+	principal, ok := PrincipalFrom(ctx)
+	if !ok {
+		return nil, ScopeAll
+	}
+	return principal, s.Policy[principal.Role][action]
+}
+
+// Check the caller may take action at all, before anything is looked up
+func (s *Server) authorize(ctx context.Context, action Action) error {
+	if _, scope := s.scope(ctx, action); scope == ScopeNone {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Check the caller may take action on account
+func (s *Server) authorizeAccount(ctx context.Context, action Action, account *models.Account) error {
+	principal, scope := s.scope(ctx, action)
+	if scope == ScopeAll || (scope == ScopeOwn && account.Owner == principal.ID) {
+		return nil
+	}
+	return ErrForbidden
+}
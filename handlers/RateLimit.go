@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"httpserver/utils"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers telling clients their limit, from the IETF RateLimit header fields draft
+const (
+	RateLimitLimitHeader     = "RateLimit-Limit"
+	RateLimitRemainingHeader = "RateLimit-Remaining"
+	RateLimitResetHeader     = "RateLimit-Reset"
+	RateLimitPolicyHeader    = "RateLimit-Policy"
+)
+
+// Clients remembered before idle buckets are first dropped
+const minRateLimitSweep = 1024
+
+// Token bucket every client gets: Burst requests at once, refilled at Rate per second
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Seconds for an empty bucket to fill up again
+func (l RateLimit) window() float64 {
+	return float64(l.Burst) / l.Rate
+}
+
+// Buckets by client, kept in memory so each server process limits on its own
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	sweep   int
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Take a token from client's bucket. Returns whether there was one, the whole tokens left
+// and the seconds until the bucket is full, or when refused until the next token
+func (l *rateLimiter) take(client string, limit RateLimit, now time.Time) (bool, int, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+	}
+
+	// Drop buckets that have filled up whenever the map doubles, a new one starts full anyway
+	if len(l.buckets) >= max(l.sweep, minRateLimitSweep) {
+		for key, b := range l.buckets {
+			if b.refill(limit, now) >= float64(limit.Burst) {
+				delete(l.buckets, key)
+			}
+		}
+		l.sweep = 2 * len(l.buckets)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[client] = b
+	}
+	tokens := b.refill(limit, now)
+	if tokens < 1 {
+		return false, 0, (1 - tokens) / limit.Rate
+	}
+	b.tokens, b.updated = tokens-1, now
+	return true, int(b.tokens), (float64(limit.Burst) - b.tokens) / limit.Rate
+}
+
+// Whether client's bucket has a token, without taking it, and when refused the seconds until it does
+func (l *rateLimiter) peek(client string, limit RateLimit, now time.Time) (bool, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		return true, 0
+	}
+	if tokens := b.refill(limit, now); tokens < 1 {
+		return false, (1 - tokens) / limit.Rate
+	}
+	return true, 0
+}
+
+// Tokens in the bucket at now
+func (b *bucket) refill(limit RateLimit, now time.Time) float64 {
+	return min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+}
+
+// Refuse requests over the caller's rate limit with 429, every response says how much is left.
+// Callers are told apart by principal, or by address when authentication is off
+func (s *Server) RateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.RateLimit.Rate <= 0 {
+			next(w, r)
+			return
+		}
+
+		ok, remaining, reset := s.limiter.take(rateLimitClient(r), s.RateLimit, time.Now())
+		s.setRateLimitHeaders(w, remaining, reset)
+		if !ok {
+			writeRateLimited(w, reset)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Refuse requests from an address whose failed authentications used up its bucket, before their
+// credentials are looked up, so keys and tokens cannot be guessed faster than the rate limit
+func (s *Server) authThrottled(w http.ResponseWriter, r *http.Request) bool {
+	if s.RateLimit.Rate <= 0 {
+		return false
+	}
+	ok, reset := s.authFailures.peek(addressClient(r), s.RateLimit, time.Now())
+	if ok {
+		return false
+	}
+	s.setRateLimitHeaders(w, 0, reset)
+	writeRateLimited(w, reset)
+	return true
+}
+
+// Charge a failed authentication to the address it came from
+func (s *Server) chargeFailedAuth(w http.ResponseWriter, r *http.Request) {
+	if s.RateLimit.Rate <= 0 {
+		return
+	}
+	_, remaining, reset := s.authFailures.take(addressClient(r), s.RateLimit, time.Now())
+	s.setRateLimitHeaders(w, remaining, reset)
+}
+
+// Tell the client where it stands, reset is the seconds until its bucket is full
+func (s *Server) setRateLimitHeaders(w http.ResponseWriter, remaining int, reset float64) {
+	w.Header().Set(RateLimitLimitHeader, strconv.Itoa(s.RateLimit.Burst))
+	w.Header().Set(RateLimitRemainingHeader, strconv.Itoa(remaining))
+	w.Header().Set(RateLimitResetHeader, strconv.Itoa(int(math.Ceil(reset))))
+	w.Header().Set(RateLimitPolicyHeader, strconv.Itoa(s.RateLimit.Burst)+";w="+strconv.Itoa(int(math.Ceil(s.RateLimit.window()))))
+}
+
+// 429 asking the client to come back in retry seconds
+func writeRateLimited(w http.ResponseWriter, retry float64) {
+	seconds := strconv.Itoa(int(math.Ceil(retry)))
+	w.Header().Set("Retry-After", seconds)
+	utils.WriteError(w, http.StatusTooManyRequests, CodeRateLimited, "Too many requests, retry in "+seconds+"s")
+}
+
+// Key of the bucket a request draws from. The address is the connection's, forwarding headers
+// are not trusted as any client could set them
+func rateLimitClient(r *http.Request) string {
+	if principal, ok := PrincipalFrom(r.Context()); ok {
+		return "principal:" + principal.ID
+	}
+	return addressClient(r)
+}
+
+// Key of the connection's address
+func addressClient(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
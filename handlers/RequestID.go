@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"httpserver/utils"
+	"net/http"
+)
+
+// Longest X-Request-ID taken from a client, longer ones are replaced
+const maxRequestIDLength = 128
+
+// Give every request an ID, the client's X-Request-ID if it sent a usable one.
+// It is returned in the X-Request-ID header and in every error response
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(utils.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(utils.RequestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Printable ASCII only, so the ID is safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
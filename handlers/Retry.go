@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"httpserver/store"
+	"log"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// Returned once a transaction has lost to concurrent ones on every attempt
+var ErrTooManyConflicts = errors.New("kept conflicting with concurrent transactions, retry later")
+
+// How a transaction that lost a serialization race or deadlock is run again
+type RetryPolicy struct {
+	// Attempts after the first, 0 to never retry
+	MaxRetries int
+
+	// Upper bound of the first backoff, doubled for each retry up to MaxBackoff.
+	// Each wait is random below the bound so contending requests spread out
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+// Counts of retried transactions since the server started
+type RetryStats struct {
+	Retries   atomic.Int64
+	Exhausted atomic.Int64
+}
+
+// The store error after the last attempt, reads as ErrTooManyConflicts
+type retryError struct {
+	err error
+}
+
+func (e *retryError) Error() string {
+	return ErrTooManyConflicts.Error()
+}
+
+func (e *retryError) Unwrap() []error {
+	return []error{ErrTooManyConflicts, e.err}
+}
+
+// Run fn until it succeeds, fails for a reason retrying cannot fix, or the policy runs out
+func (s *Server) retry(ctx context.Context, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !errors.Is(err, store.ErrSerialization) {
+			return err
+		}
+		if attempt >= s.TransferRetry.MaxRetries {
+			s.RetryStats.Exhausted.Add(1)
+			log.Printf("Giving up after %d attempts: %v", attempt+1, store.DriverError(err))
+			return &retryError{err: err}
+		}
+
+		// Stop early rather than sleep past the request deadline
+		timer := time.NewTimer(s.TransferRetry.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		s.RetryStats.Retries.Add(1)
+	}
+}
+
+// Full jitter: a random wait below the exponential bound for this attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	bound := p.BaseBackoff
+	for i := 0; i < attempt && bound < p.MaxBackoff; i++ {
+		bound *= 2
+	}
+	bound = min(bound, p.MaxBackoff)
+	if bound <= 0 {
+		return 0
+	}
+	return rand.N(bound)
+}
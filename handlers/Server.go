@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"crypto/cipher"
+	"httpserver/certs"
+	"httpserver/fx"
+	"httpserver/jwt"
+	"httpserver/models"
+	"httpserver/store"
+	"net/http"
+	"time"
+)
+
+// Owns the handlers and everything they depend on, so several servers can run in one process
+type Server struct {
+	Store store.Store
+
+	// Exchange rates for conversions and how long a quote locks its rate
+	FxRates    fx.RateProvider
+	FxQuoteTTL time.Duration
+
+	// How long a stored response is replayed for
+	IdempotencyRetention time.Duration
+
+	// Deadline of every request including its store calls, 0 for none
+	RequestTimeout time.Duration
+
+	// Transfers that lose to a concurrent one are run again under this policy
+	TransferRetry RetryPolicy
+	RetryStats    RetryStats
+
+	// When the deprecated unversioned routes stop answering, zero for never
+	LegacySunset time.Time
+
+	// Every API request needs an API key when set. Signed requests are accepted
+	// while their timestamp is within SignatureWindow of now
+	APIKeyAuth      bool
+	SignatureWindow time.Duration
+	signatures      replayCache
+
+	// Signing keys of API keys are stored encrypted with it, signed requests are refused without it
+	SigningKeys cipher.AEAD
+
+	// Bearer JWTs from the identity provider are accepted when set, the caller's role is in JWTRoleClaim
+	JWT          *jwt.Verifier
+	JWTRoleClaim string
+
+	// Connections whose verified client certificate is mapped here act as that service
+	ClientCerts certs.ClientMap
+
+	// What each role of an authenticated caller may do
+	Policy Policy
+
+	// Requests each client may make, off when RateLimit.Rate is 0. Failed authentications
+	// draw from a bucket of their address, which when empty refuses it before authenticating
+	RateLimit    RateLimit
+	limiter      rateLimiter
+	authFailures rateLimiter
+
+	// Most each account tier may send, tiers not listed have no limits
+	VelocityLimits models.VelocityLimits
+}
+
+// Create a server with default settings on top of a store
+func NewServer(st store.Store) *Server {
+	return &Server{
+		Store:                st,
+		FxRates:              fx.NewMemoryProvider(),
+		FxQuoteTTL:           30 * time.Second,
+		IdempotencyRetention: 24 * time.Hour,
+		RequestTimeout:       10 * time.Second,
+		TransferRetry:        RetryPolicy{MaxRetries: 3, BaseBackoff: 10 * time.Millisecond, MaxBackoff: 200 * time.Millisecond},
+		SignatureWindow:      5 * time.Minute,
+		JWTRoleClaim:         "role",
+		Policy:               DefaultPolicy,
+	}
+}
+
+// Register every endpoint on a new mux, each request gets an ID and is limited to RequestTimeout.
+// API routes check credentials before anything else, then the caller's rate limit.
+// Methods and path parameters are matched by the mux, so handlers only see requests they serve
+func (s *Server) Routes() http.Handler {
+	mux := http.NewServeMux()
+	api := func(h http.HandlerFunc) http.HandlerFunc {
+		return s.Authenticate(s.RateLimited(h))
+	}
+
+	// Current API
+	mux.HandleFunc("POST /v1/accounts", api(s.Idempotent(ActionCreateAccount, s.CreateAccountV1Handler)))
+	mux.HandleFunc("GET /v1/accounts/{id}", api(s.GetAccountHandler))
+	mux.HandleFunc("GET /v1/accounts/{id}/transactions", api(s.GetAccountTransactionsHandler))
+	mux.HandleFunc("POST /v1/transactions", api(s.Idempotent(ActionDebitAccount, s.TransactionV1Handler)))
+	mux.HandleFunc("GET /v1/transactions/{id}", api(s.GetTransactionHandler))
+	mux.HandleFunc("GET /v1/reconciliation", api(s.ReconciliationHandler))
+	mux.HandleFunc("POST /v1/fx/quotes", api(s.CreateFxQuoteHandler))
+
+	// Unversioned routes keep their original responses until LegacySunset
+	mux.HandleFunc("POST /accounts", api(s.deprecated(s.Idempotent(ActionCreateAccount, s.CreateAccountHandler))))
+	mux.HandleFunc("GET /accounts/{id}", api(s.deprecated(s.GetAccountHandler)))
+	mux.HandleFunc("GET /accounts/{id}/transactions", api(s.deprecated(s.GetAccountTransactionsHandler)))
+	mux.HandleFunc("POST /transactions", api(s.deprecated(s.Idempotent(ActionDebitAccount, s.TransactionHandler))))
+	mux.HandleFunc("GET /transactions/{id}", api(s.deprecated(s.GetTransactionHandler)))
+	mux.HandleFunc("GET /reconciliation", api(s.deprecated(s.ReconciliationHandler)))
+	mux.HandleFunc("POST /fx/quotes", api(s.deprecated(s.CreateFxQuoteHandler)))
+
+	// Description of all of the above, public so clients can find out how to authenticate
+	mux.HandleFunc("GET /openapi.json", s.OpenAPIHandler)
+	mux.HandleFunc("GET /docs", s.DocsHandler)
+
+	return WithRequestID(s.WithRequestTimeout(withBodyLimit(withRouteErrors(mux))))
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"httpserver/models"
+	"httpserver/store"
+	"httpserver/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Page size limits for transaction history
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+var ErrTransactionNotFound = store.ErrTransactionNotFound
+
+// Cursors are opaque to clients but only carry the last transaction ID seen
+func encodeCursor(transactionID int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(transactionID, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errors.New("invalid cursor")
+	}
+	return id, nil
+}
+
+// Parse the from, to, limit and cursor query parameters
+func parseTransactionFilter(r *http.Request) (models.TransactionFilter, error) {
+	query := r.URL.Query()
+	filter := models.TransactionFilter{Limit: defaultPageSize}
+
+	var err error
+	if v := query.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, invalid("from", "from must be an RFC 3339 timestamp")
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, invalid("to", "to must be an RFC 3339 timestamp")
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxPageSize {
+			return filter, invalid("limit", fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		if filter.BeforeID, err = decodeCursor(v); err != nil {
+			return filter, invalid("cursor", "invalid cursor")
+		}
+	}
+	return filter, nil
+}
+
+// Handler to get a single transaction
+func (s *Server) GetTransactionHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Extract transaction ID and verify it is a number
+	transactionID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, r, invalid("transaction_id", "Invalid transaction ID"), "")
+		return
+	}
+
+	if err := s.authorize(r.Context(), ActionReadAccount); err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+	t, err := s.Store.GetTransaction(r.Context(), transactionID)
+
+	// Callers limited to their own accounts cannot tell a missing transfer from someone else's
+	if errors.Is(err, store.ErrTransactionNotFound) {
+		if _, scope := s.scope(r.Context(), ActionReadAccount); scope == ScopeOwn {
+			err = ErrForbidden
+		}
+	}
+	if err != nil {
+		writeError(w, r, err, "Database error")
+		return
+	}
+	if err := s.authorizeTransaction(r.Context(), t); err != nil {
+		writeError(w, r, err, "Database error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, t)
+}
+
+// Check the caller may read a transfer, customers only those into or out of an account they own
+func (s *Server) authorizeTransaction(ctx context.Context, t *models.Transaction) error {
+	if _, scope := s.scope(ctx, ActionReadAccount); scope != ScopeOwn {
+		return s.authorize(ctx, ActionReadAccount)
+	}
+	for _, accountID := range []int{t.SourceAccountID, t.DestinationAccountID} {
+		acc, err := s.Store.GetAccount(ctx, accountID)
+		if errors.Is(err, store.ErrAccountNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if s.authorizeAccount(ctx, ActionReadAccount, acc) == nil {
+			return nil
+		}
+	}
+	return ErrForbidden
+}
+
+// Handler to list an account's transactions
+func (s *Server) GetAccountTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Extract account ID and verify it is a number
+	accountID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, invalid("account_id", "Invalid account ID"), "")
+		return
+	}
+
+	filter, err := parseTransactionFilter(r)
+	if err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+
+	// Verify account exists so an unknown ID is not an empty history
+	if _, err := s.GetAccountByID(r.Context(), accountID); err != nil {
+		writeError(w, r, err, "Database error")
+		return
+	}
+
+	// Fetch one extra row to know whether another page exists
+	pageSize := filter.Limit
+	filter.Limit++
+	transactions, err := s.Store.ListAccountTransactions(r.Context(), accountID, filter)
+	if err != nil {
+		writeError(w, r, err, "Database error")
+		return
+	}
+
+	page := models.TransactionPage{Transactions: transactions}
+	if len(transactions) > pageSize {
+		page.Transactions = transactions[:pageSize]
+		page.NextCursor = encodeCursor(page.Transactions[pageSize-1].TransactionID)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, page)
+}
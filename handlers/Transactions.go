@@ -1,149 +1,241 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"httpserver/models"
+	"httpserver/store"
 	"httpserver/utils"
 	"net/http"
 	"strconv"
-)
-
-// Helper function to transfer currency
-func TransferCurrency(sourceAcc models.Account, destAcc models.Account, amount float64) error {
 
-	// Multiply by 100000 for higher accuracy when subtracting
-	tempSourceBalance := sourceAcc.CurrentBalance * 100000
-	tempDestinationBalance := destAcc.CurrentBalance * 100000
-	convertedAmount := amount * 100000
+	"github.com/shopspring/decimal"
+)
 
-	// Divide by 100000 for storage
-	newSourceBalance := (tempSourceBalance - convertedAmount) / 100000
-	newDestinationBalance := (tempDestinationBalance + convertedAmount) / 100000
+// Errors returned by TransferCurrency
+var (
+	ErrSameAccount         = errors.New("source and destination accounts must differ")
+	ErrSourceNotFound      = errors.New("source account not found")
+	ErrDestinationNotFound = errors.New("destination account not found")
+	ErrInsufficientFunds   = store.ErrInsufficientBalance
+	ErrCurrencyMismatch    = errors.New("source and destination accounts use different currencies")
+)
 
-	// DB begin
-	tx, err := models.DB.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		// rollback if the transaction is still active
-		if p := recover(); p != nil {
-			tx.Rollback()
-			panic(p)
-		}
-	}()
-
-	// Update source
-	res1, err := tx.Exec(
-		"UPDATE accounts SET balance = $1 WHERE account_id = $2",
-		newSourceBalance, sourceAcc.AccountID,
-	)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	rows1, err := res1.RowsAffected()
+// Helper function to transfer currency atomically between two accounts and record it in the ledger
+func (s *Server) TransferCurrency(ctx context.Context, req models.TransferRequest) (*models.Transaction, error) {
+
+	sourceID, destID, amount := req.SourceAccountID, req.DestinationAccountID, req.Amount
+
+	// Callers who may not debit any account are refused before the store is touched
+	if err := s.authorize(ctx, ActionDebitAccount); err != nil {
+		return nil, err
+	}
+	if sourceID == destID {
+		return nil, ErrSameAccount
+	}
+
+	// The whole transaction runs again if it loses to a concurrent one
+	var record *models.Transaction
+	err := s.retry(ctx, func() error {
+		return s.Store.WithTx(ctx, func(tx store.Tx) error {
+
+			// Lock both rows in account ID order so opposing transfers cannot deadlock
+			firstID, secondID := sourceID, destID
+			if firstID > secondID {
+				firstID, secondID = secondID, firstID
+			}
+			locked := make(map[int]*models.Account, 2)
+			for _, id := range []int{firstID, secondID} {
+				acc, err := tx.LockAccount(id)
+				if errors.Is(err, store.ErrAccountNotFound) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				locked[id] = acc
+			}
+
+			// Only the source is debited, so it is the account a customer must own.
+			// Checked before existence so customers cannot probe for other accounts
+			source, ok := locked[sourceID]
+			if !ok {
+				source = &models.Account{AccountID: sourceID}
+			}
+			if err := s.authorizeAccount(ctx, ActionDebitAccount, source); err != nil {
+				return err
+			}
+
+			// Verify both accounts exist and the amount fits the source currency
+			if !ok {
+				return ErrSourceNotFound
+			}
+			dest, ok := locked[destID]
+			if !ok {
+				return ErrDestinationNotFound
+			}
+			if err := models.CheckScale(amount, source.Currency); err != nil {
+				return err
+			}
+
+			record = &models.Transaction{
+				SourceAccountID:      sourceID,
+				DestinationAccountID: destID,
+				Currency:             source.Currency,
+				Amount:               amount,
+				DestinationCurrency:  dest.Currency,
+				DestinationAmount:    amount,
+				QuoteID:              req.QuoteID,
+				Status:               models.TransactionCompleted,
+			}
+
+			// Pick the rate from the quote, the provider, or refuse to convert
+			var rate decimal.Decimal
+			var err error
+			switch {
+			case req.QuoteID != "":
+				rate, err = claimFxQuote(tx, req.QuoteID, source.Currency, dest.Currency, amount)
+			case source.Currency == dest.Currency:
+				rate = decimal.NewFromInt(1)
+			case req.Convert:
+				rate, err = s.FxRates.Rate(source.Currency, dest.Currency)
+			default:
+				err = ErrCurrencyMismatch
+			}
+			if err != nil {
+				return err
+			}
+			if source.Currency != dest.Currency {
+				converted, remainder := models.Convert(amount, rate, dest.Currency)
+				if !converted.IsPositive() {
+					return ErrConversionTooThin
+				}
+				record.DestinationAmount = converted
+				record.FxRate = &rate
+				record.FxRemainder = &remainder
+			}
+
+			if source.CurrentBalance.LessThan(amount) {
+				return ErrInsufficientFunds
+			}
+
+			// Counted under the source lock, so the limit holds however many transfers race
+			if err := s.checkVelocity(tx, source, amount); err != nil {
+				return err
+			}
+
+			// Update source relative to the locked balance, the store rules out overdrafts regardless
+			if record.SourceBalance, err = tx.Debit(sourceID, amount); err != nil {
+				return err
+			}
+
+			// Update destination
+			if record.DestinationBalance, err = tx.Credit(destID, record.DestinationAmount); err != nil {
+				if errors.Is(err, store.ErrAccountNotFound) {
+					return ErrDestinationNotFound
+				}
+				return err
+			}
+
+			// Record the transfer in the same transaction as the balance updates
+			if err := tx.InsertTransaction(record); err != nil {
+				return err
+			}
+
+			// Double-entry postings backing the balance updates, conversions go through the FX account in each currency
+			postings := []models.Posting{
+				{AccountID: sourceID, Currency: record.Currency, Amount: amount.Neg()},
+				{AccountID: destID, Currency: record.DestinationCurrency, Amount: record.DestinationAmount},
+			}
+			if record.Currency != record.DestinationCurrency {
+				postings = append(postings,
+					models.Posting{AccountID: models.FxAccountID, Currency: record.Currency, Amount: amount},
+					models.Posting{AccountID: models.FxAccountID, Currency: record.DestinationCurrency, Amount: record.DestinationAmount.Neg()},
+				)
+			}
+			_, err = PostJournalEntry(tx, models.JournalTransfer, &record.TransactionID, postings)
+			return err
+		})
+	})
 	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	if rows1 == 0 {
-		tx.Rollback()
-		return errors.New("source account not found")
+		return nil, err
 	}
 
-	// Update destination
-	res2, err := tx.Exec(
-		"UPDATE accounts SET balance = $1 WHERE account_id = $2",
-		newDestinationBalance, destAcc.AccountID,
-	)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	rows2, err := res2.RowsAffected()
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	if rows2 == 0 {
-		tx.Rollback()
-		return errors.New("destination account not found")
-	}
+	return record, nil
+}
 
-	// Commit if all successful
-	if err := tx.Commit(); err != nil {
-		return err
+// Handler for transactions, responds with the new balances
+func (s *Server) TransactionHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := s.transferFromRequest(w, r)
+	if !ok {
+		return
 	}
 
-	return nil
+	// If successful, provide the ledger entry ID and current balances
+	response := map[string]interface{}{
+		"transaction_id":    record.TransactionID,
+		"currency":          record.Currency,
+		"source_account_id": record.SourceAccountID,
+		"source_balance":    record.SourceBalance,
+		"dest_account_id":   record.DestinationAccountID,
+		"dest_balance":      record.DestinationBalance,
+	}
+	if record.FxRate != nil {
+		response["dest_currency"] = record.DestinationCurrency
+		response["dest_amount"] = record.DestinationAmount
+		response["fx_rate"] = record.FxRate
+	}
+	utils.WriteJSON(w, http.StatusOK, response)
 }
 
-// Handler for transactions
-func TransactionHandler(w http.ResponseWriter, r *http.Request) {
-
-	// Ensure usage of POST method
-	if r.Method != http.MethodPost {
-		utils.WriteError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+// Handler for transactions under /v1, responds with the whole transaction as GET returns it
+func (s *Server) TransactionV1Handler(w http.ResponseWriter, r *http.Request) {
+	record, ok := s.transferFromRequest(w, r)
+	if !ok {
 		return
 	}
+	w.Header().Set("Location", "/v1/transactions/"+strconv.FormatInt(record.TransactionID, 10))
+	utils.WriteJSON(w, http.StatusCreated, record)
+}
+
+// Validate the request body and run the transfer, writing the error response if that fails
+func (s *Server) transferFromRequest(w http.ResponseWriter, r *http.Request) (*models.Transaction, bool) {
 
 	// Input structure
 	var input struct {
 		SourceAcc      int    `json:"source_account_id"`
 		DestinationAcc int    `json:"destination_account_id"`
 		Amount         string `json:"amount"`
+		Convert        bool   `json:"convert"`
+		QuoteID        string `json:"quote_id"`
 	}
 
 	// Verify JSON is valid
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-		utils.WriteError(w, http.StatusBadRequest, "Invalid JSON")
-		return
+		utils.WriteError(w, http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON")
+		return nil, false
 	}
 
-	// Verify amount is a number
-	amount, err := strconv.ParseFloat(input.Amount, 64)
-	if err != nil || amount <= 0 {
-		utils.WriteError(w, http.StatusBadRequest, "amount must be a positive number")
-		return
-	}
-	// Verify source account exists
-	source, err := GetAccountByID(input.SourceAcc)
-	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, "source account not found")
-		return
+	// Verify amount is a positive number, its scale is checked against the account currency
+	amount, err := models.ParseMoney(input.Amount, models.MaxScale())
+	if err != nil || !amount.IsPositive() {
+		writeError(w, r, invalid("amount", "amount must be a positive number with at most "+strconv.Itoa(int(models.MaxScale()))+" decimal places"), "")
+		return nil, false
 	}
 
-	// Verify destination account exists
-	dest, err := GetAccountByID(input.DestinationAcc)
-	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, "destination account not found")
-		return
-	}
-
-	// Verify source account has sufficient balance
-	if source.CurrentBalance < amount {
-		utils.WriteError(w, http.StatusBadRequest, "insufficient balance in source account")
-		return
-	}
-
-	// Attempt to transfer the currency
-	err = TransferCurrency(*source, *dest, amount)
+	// Existence, currency and balance checks happen under lock inside the transfer
+	record, err := s.TransferCurrency(r.Context(), models.TransferRequest{
+		SourceAccountID:      input.SourceAcc,
+		DestinationAccountID: input.DestinationAcc,
+		Amount:               amount,
+		Convert:              input.Convert,
+		QuoteID:              input.QuoteID,
+	})
 	if err != nil {
-		utils.WriteError(w, http.StatusInternalServerError, err.Error())
-		return
+		writeError(w, r, err, "Failed to transfer")
+		return nil, false
 	}
 
-	// Fetch updated balances from DB
-	updatedSource, _ := GetAccountByID(input.SourceAcc)
-	updatedDest, _ := GetAccountByID(input.DestinationAcc)
-
-	// If successful, provide current balances
-	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
-		"source_account_id": updatedSource.AccountID,
-		"source_balance":    updatedSource.CurrentBalance,
-		"dest_account_id":   updatedDest.AccountID,
-		"dest_balance":      updatedDest.CurrentBalance,
-	})
+	return record, true
 }
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"httpserver/models"
+	"httpserver/store"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Returned when a transfer would take its source account past a velocity limit of its tier
+var ErrVelocityLimit = errors.New("velocity limit exceeded")
+
+// Refuse a transfer of amount out of source if, with the ones already made in the window, it sends
+// more transfers or more money than the source's tier allows. The source is locked, so concurrent
+// transfers out of it are counted one after the other
+func (s *Server) checkVelocity(tx store.Tx, source *models.Account, amount decimal.Decimal) error {
+	limit, ok := s.VelocityLimits[source.Tier]
+	if !ok {
+		return nil
+	}
+	count, total, err := tx.TransfersOutSince(source.AccountID, time.Now().Add(-limit.Window))
+	if err != nil {
+		return err
+	}
+	if limit.MaxCount > 0 && count >= limit.MaxCount {
+		return fmt.Errorf("%w: at most %d transfers out of account %d per %s", ErrVelocityLimit, limit.MaxCount, source.AccountID, limit.Window)
+	}
+	if max, ok := limit.MaxAmount[source.Currency]; ok && total.Add(amount).GreaterThan(max) {
+		return fmt.Errorf("%w: at most %s %s out of account %d per %s, %s already sent", ErrVelocityLimit, max, source.Currency, source.AccountID, limit.Window, total)
+	}
+	return nil
+}
+
+// Whether accounts may be created in tier
+func (s *Server) knownTier(tier string) bool {
+	_, ok := s.VelocityLimits[tier]
+	return ok || tier == models.TierStandard
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"httpserver/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Prefix of the current API, the unversioned routes are deprecated aliases of it
+const V1Prefix = "/v1"
+
+// When /v1 was introduced and the unversioned routes became deprecated
+var LegacyDeprecatedAt = time.Date(2026, time.October, 17, 0, 0, 0, 0, time.UTC)
+
+// Mark an unversioned route as deprecated in favour of its /v1 successor (RFC 9745, RFC 8594).
+// Past LegacySunset the route is gone and only points at the successor
+func (s *Server) deprecated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(LegacyDeprecatedAt.Unix(), 10))
+		w.Header().Set("Link", "<"+V1Prefix+r.URL.Path+`>; rel="successor-version"`)
+		if !s.LegacySunset.IsZero() {
+			w.Header().Set("Sunset", s.LegacySunset.UTC().Format(http.TimeFormat))
+			if !time.Now().Before(s.LegacySunset) {
+				utils.WriteError(w, http.StatusGone, CodeVersionRetired, "This route was retired, use "+V1Prefix+r.URL.Path)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
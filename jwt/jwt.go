@@ -0,0 +1,203 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Signature algorithms accepted, anything else including none and HMAC is refused
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// Errors returned by Verify, all but ErrKeysUnavailable mean the token is not acceptable
+var (
+	ErrMalformed            = errors.New("malformed token")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrInvalidSignature     = errors.New("invalid token signature")
+	ErrExpired              = errors.New("token expired")
+	ErrNotValidYet          = errors.New("token not valid yet")
+	ErrIssuer               = errors.New("token issuer not accepted")
+	ErrAudience             = errors.New("token audience not accepted")
+)
+
+// Registered claims checked by Verify, the rest are kept in Extra
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+	Extra     map[string]json.RawMessage
+}
+
+// Checks bearer tokens against keys from a JWKS, and that they were issued by Issuer for Audience
+type Verifier struct {
+	Keys     KeySource
+	Issuer   string
+	Audience string
+
+	// Allowed clock difference with the issuer for exp and nbf
+	Leeway time.Duration
+}
+
+// Check the token's signature and registered claims, returning its claims
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformed
+	}
+	if header.Alg != RS256 && header.Alg != ES256 && header.Alg != EdDSA {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedAlgorithm, header.Alg)
+	}
+
+	// The key decides the algorithm, a token cannot pick another one for it
+	key, err := v.Keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.Algorithm != header.Alg {
+		return nil, ErrInvalidSignature
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !verifySignature(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	claims, err := parseClaims(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func verifySignature(key Key, signed []byte, signature []byte) bool {
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS signatures are r and s concatenated, not ASN.1
+		if len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, signed, signature)
+	}
+	return false
+}
+
+func (v *Verifier) checkClaims(claims *Claims) error {
+	now := time.Now()
+	if claims.ExpiresAt.IsZero() || !now.Before(claims.ExpiresAt.Add(v.Leeway)) {
+		return ErrExpired
+	}
+	if !claims.NotBefore.IsZero() && now.Add(v.Leeway).Before(claims.NotBefore) {
+		return ErrNotValidYet
+	}
+	if claims.Issuer != v.Issuer {
+		return ErrIssuer
+	}
+	if !slices.Contains(claims.Audience, v.Audience) {
+		return ErrAudience
+	}
+
+	// The subject is who the caller is, a token without one identifies nobody
+	if claims.Subject == "" {
+		return fmt.Errorf("%w: no sub claim", ErrMalformed)
+	}
+	return nil
+}
+
+// Decode the payload, aud may be a string or a list and times are NumericDates
+func parseClaims(segment string) (*Claims, error) {
+	var raw map[string]json.RawMessage
+	if err := decodeSegment(segment, &raw); err != nil {
+		return nil, ErrMalformed
+	}
+
+	claims := &Claims{Extra: map[string]json.RawMessage{}}
+	for name, value := range raw {
+		var err error
+		switch name {
+		case "sub":
+			err = json.Unmarshal(value, &claims.Subject)
+		case "iss":
+			err = json.Unmarshal(value, &claims.Issuer)
+		case "aud":
+			var one string
+			if err = json.Unmarshal(value, &one); err == nil {
+				claims.Audience = []string{one}
+			} else {
+				err = json.Unmarshal(value, &claims.Audience)
+			}
+		case "exp":
+			claims.ExpiresAt, err = numericDate(value)
+		case "nbf":
+			claims.NotBefore, err = numericDate(value)
+		case "iat":
+			claims.IssuedAt, err = numericDate(value)
+		default:
+			claims.Extra[name] = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid %s claim", ErrMalformed, name)
+		}
+	}
+	return claims, nil
+}
+
+// Last second of year 9999, later dates are refused rather than overflowing
+const maxNumericDate = 253402300799
+
+// Seconds since the epoch, possibly fractional
+func numericDate(value json.RawMessage) (time.Time, error) {
+	var seconds float64
+	if err := json.Unmarshal(value, &seconds); err != nil || seconds < 0 || seconds > maxNumericDate {
+		return time.Time{}, ErrMalformed
+	}
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*1e9)), nil
+}
+
+func decodeSegment(segment string, out any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
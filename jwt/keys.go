@@ -0,0 +1,257 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownKey       = errors.New("no key matches the token's kid")
+	ErrKeysUnavailable  = errors.New("verification keys unavailable")
+	errUnsupportedKey   = errors.New("unsupported key")
+	errInvalidKeyValues = errors.New("invalid key parameters")
+)
+
+// Smallest RSA modulus accepted, in bits
+const minRSABits = 2048
+
+// Largest JWKS document read from a URL
+const maxJWKSSize = 1 << 20
+
+// A verification key and the one algorithm it may be used with
+type Key struct {
+	ID        string
+	Algorithm string
+	Public    crypto.PublicKey
+}
+
+// Source of verification keys by key ID
+type KeySource interface {
+	Key(ctx context.Context, kid string) (Key, error)
+}
+
+// One entry of a JWKS document (RFC 7517)
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Read the signing keys of a JWKS document. Keys for other uses or
+// algorithms are skipped so a shared document can also carry them
+func ParseJWKS(raw []byte) (map[string]Key, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make(map[string]Key, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Kid == "" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := k.parse()
+		if errors.Is(err, errUnsupportedKey) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %q: %w", k.Kid, err)
+		}
+		if _, ok := keys[k.Kid]; ok {
+			return nil, fmt.Errorf("invalid JWKS: kid %q is used twice", k.Kid)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) parse() (Key, error) {
+	key := Key{ID: k.Kid}
+	switch {
+	case k.Kty == "RSA":
+		key.Algorithm = RS256
+		n, errN := decodeInt(k.N)
+		e, errE := decodeInt(k.E)
+		if errN != nil || errE != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return key, errInvalidKeyValues
+		}
+		if n.BitLen() < minRSABits {
+			return key, fmt.Errorf("RSA key of %d bits, at least %d needed", n.BitLen(), minRSABits)
+		}
+		key.Public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case k.Kty == "EC" && k.Crv == "P-256":
+		key.Algorithm = ES256
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return key, errInvalidKeyValues
+		}
+
+		// Refuse points off the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return key, errInvalidKeyValues
+		}
+		key.Public = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		key.Algorithm = EdDSA
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return key, errInvalidKeyValues
+		}
+		key.Public = ed25519.PublicKey(x)
+	default:
+		return key, errUnsupportedKey
+	}
+
+	// A key published for another algorithm is not used at all
+	if k.Alg != "" && k.Alg != key.Algorithm {
+		return key, errUnsupportedKey
+	}
+	return key, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errInvalidKeyValues
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Keys of a JWKS document, loaded again every RefreshInterval and when a token names an unknown key.
+// A failed load keeps the previous keys, so a brief outage of the source does not lock clients out
+type KeySet struct {
+	// How long loaded keys are used before loading them again
+	RefreshInterval time.Duration
+
+	// Loads happen at most this often, so tokens with made-up key IDs cannot hammer the source
+	MinRefreshInterval time.Duration
+
+	source string
+	load   func(ctx context.Context) ([]byte, error)
+
+	mu          sync.RWMutex
+	keys        map[string]Key
+	loadedAt    time.Time
+	attemptedAt time.Time
+
+	// Held while loading so concurrent requests wait for one load
+	loading sync.Mutex
+}
+
+// Keys read from a JSON file, rotated by replacing the file
+func NewFileKeySet(path string, refresh time.Duration) (*KeySet, error) {
+	return newKeySet(path, refresh, func(ctx context.Context) ([]byte, error) {
+		return os.ReadFile(path)
+	})
+}
+
+// Keys fetched from an identity provider's JWKS URL
+func NewRemoteKeySet(url string, client *http.Client, refresh time.Duration) (*KeySet, error) {
+	return newKeySet(url, refresh, func(ctx context.Context) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s answered %s", url, res.Status)
+		}
+		return io.ReadAll(io.LimitReader(res.Body, maxJWKSSize))
+	})
+}
+
+// Create a key set and load it once, failing if that load fails
+func newKeySet(source string, refresh time.Duration, load func(ctx context.Context) ([]byte, error)) (*KeySet, error) {
+	k := &KeySet{RefreshInterval: refresh, MinRefreshInterval: 30 * time.Second, source: source, load: load}
+	if err := k.refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Look up a key, loading the document again when it is due or the key is unknown
+func (k *KeySet) Key(ctx context.Context, kid string) (Key, error) {
+	k.mu.RLock()
+	key, ok := k.keys[kid]
+	due := time.Since(k.loadedAt) >= k.RefreshInterval
+	k.mu.RUnlock()
+	if ok && !due {
+		return key, nil
+	}
+
+	if err := k.refresh(ctx); err != nil {
+		log.Printf("Failed to load JWKS from %s: %v", k.source, err)
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	if len(k.keys) == 0 {
+		return Key{}, ErrKeysUnavailable
+	}
+	return Key{}, ErrUnknownKey
+}
+
+// Load the document unless another load happened within MinRefreshInterval
+func (k *KeySet) refresh(ctx context.Context) error {
+	k.loading.Lock()
+	defer k.loading.Unlock()
+
+	k.mu.Lock()
+	if !k.attemptedAt.IsZero() && time.Since(k.attemptedAt) < k.MinRefreshInterval {
+		k.mu.Unlock()
+		return nil
+	}
+	k.attemptedAt = time.Now()
+	k.mu.Unlock()
+
+	raw, err := k.load(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJWKS(raw)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no usable signing keys in %s", k.source)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.loadedAt = time.Now()
+	return nil
+}
@@ -1,63 +1,412 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
 	"database/sql"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"httpserver/certs"
+	"httpserver/fx"
 	"httpserver/handlers"
+	"httpserver/jwt"
+	"httpserver/migrations"
 	"httpserver/models"
+	"httpserver/store"
 
 	_ "github.com/lib/pq"
 )
 
-// Config holds DB configuration
-var config = models.Config{
-	DBUser:     "postgres",
-	DBPassword: "12345",
-	DBName:     "postgres",
-	DBHost:     "localhost",
-	DBPort:     5432,
-	ServerPort: ":3333",
-}
-
 func main() {
-	// Setup DB
-	connStr := fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		config.DBHost, config.DBPort, config.DBUser, config.DBPassword, config.DBName,
-	)
-
-	var err error
-	models.DB, err = sql.Open("postgres", connStr)
+	// Load config from defaults, config file, environment and flags
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	printConfig := fs.Bool("print-config", false, "print the resolved config with secrets redacted and exit")
+	config, err := models.LoadConfig(fs, os.Args[1:], os.Getenv)
 	if err != nil {
-		log.Fatalf("Failed to open DB: %v", err)
+		log.Fatal(err)
 	}
 
-	if err = models.DB.Ping(); err != nil {
-		log.Fatalf("Failed to connect to DB: %v", err)
+	if *printConfig {
+		out, _ := json.MarshalIndent(config.Redacted(), "", "  ")
+		fmt.Println(string(out))
+		return
 	}
 
-	log.Println("Database connection established")
+	// Amounts are validated against the decimal places of their currency
+	models.Currencies = config.Currencies
 
-	// Create accounts table if not exists
-	createTableQuery := `
-    CREATE TABLE IF NOT EXISTS accounts (
-        account_id VARCHAR(255) PRIMARY KEY,
-        balance NUMERIC NOT NULL
-    );`
+	if fs.Arg(0) == "migrate" && config.Store == models.StoreMemory {
+		log.Fatalf("migrate needs store %s or %s, got %s", models.StorePostgres, models.StoreSQLite, config.Store)
+	}
+	if fs.Arg(0) == "apikey" && config.Store == models.StoreMemory && config.SnapshotFile == "" {
+		log.Fatalf("apikey on store %s needs a snapshot-file to keep the keys in", models.StoreMemory)
+	}
 
-	_, err = models.DB.Exec(createTableQuery)
-	if err != nil {
-		log.Fatalf("Failed to create accounts table: %v", err)
+	// Pool limits for whichever SQL database backs the store
+	configurePool := func(db *sql.DB) {
+		db.SetMaxOpenConns(config.DBMaxOpenConns)
+		db.SetMaxIdleConns(config.DBMaxIdleConns)
+		db.SetConnMaxLifetime(config.DBConnMaxLifetime)
+	}
+
+	var st store.Store
+	var memory *store.Memory
+	switch config.Store {
+	case models.StoreMemory:
+		// Everything is kept in process, and only survives a restart through the snapshot file
+		memory = store.NewMemory()
+		if config.SnapshotFile != "" {
+			if memory, err = store.LoadMemorySnapshot(config.SnapshotFile); err != nil {
+				log.Fatalf("Failed to load snapshot: %v", err)
+			}
+			log.Printf("Loaded snapshot from %s\n", config.SnapshotFile)
+		}
+		log.Println("Using the in-memory store")
+		st = memory
+
+	case models.StoreSQLite:
+		db, err := store.OpenSQLite(config.SQLitePath)
+		if err != nil {
+			log.Fatalf("Failed to open SQLite DB: %v", err)
+		}
+		configurePool(db)
+
+		if fs.Arg(0) == "migrate" {
+			if err := runMigrate(db, migrations.SQLite, fs.Args()[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		applied, err := migrations.Up(db, migrations.SQLite)
+		if err != nil {
+			log.Fatalf("Failed to migrate SQLite DB: %v", err)
+		}
+		for _, m := range applied {
+			log.Printf("Applied migration %d_%s\n", m.Version, m.Name)
+		}
+		log.Printf("Using the SQLite store at %s\n", config.SQLitePath)
+		st = store.NewSQLite(db)
+
+	default:
+		// Setup DB
+		db, err := sql.Open("postgres", config.DSN())
+		if err != nil {
+			log.Fatalf("Failed to open DB: %v", err)
+		}
+		configurePool(db)
+
+		if err = db.Ping(); err != nil {
+			log.Fatalf("Failed to connect to DB: %v", err)
+		}
+
+		log.Println("Database connection established")
+
+		// Run the migrate subcommand instead of serving
+		if fs.Arg(0) == "migrate" {
+			if err := runMigrate(db, migrations.Postgres, fs.Args()[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		// Bring the schema up to date, replicas wait on each other through the migration lock
+		applied, err := migrations.Up(db, migrations.Postgres)
+		if err != nil {
+			log.Fatalf("Failed to migrate DB: %v", err)
+		}
+		for _, m := range applied {
+			log.Printf("Applied migration %d_%s\n", m.Version, m.Name)
+		}
+		st = store.NewPostgres(db)
+	}
+
+	// Signing keys of API keys are stored encrypted with a secret kept out of the store
+	var signingKeys cipher.AEAD
+	if config.SigningSecretFile != "" {
+		secret, err := os.ReadFile(config.SigningSecretFile)
+		if err == nil {
+			signingKeys, err = handlers.NewSigningKeyCipher(bytes.TrimRight(secret, "\r\n"))
+		}
+		if err != nil {
+			log.Fatalf("Failed to load api-key-signing-secret-file: %v", err)
+		}
+	}
+
+	// Manage API keys instead of serving, keys of the memory store live in its snapshot
+	if fs.Arg(0) == "apikey" {
+		if err := runAPIKey(context.Background(), st, signingKeys, fs.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		if memory != nil {
+			if err := memory.SaveSnapshot(config.SnapshotFile); err != nil {
+				log.Fatalf("Failed to save snapshot: %v", err)
+			}
+		}
+		return
+	}
+
+	// Handlers share the store, responses to Idempotency-Key requests are replayed for IdempotencyRetention
+	server := handlers.NewServer(st)
+	server.IdempotencyRetention = config.IdempotencyRetention
+
+	// Exchange rates for cross-currency transfers, quotes lock a rate for FxQuoteTTL
+	if config.FxRatesFile != "" {
+		rates, err := fx.NewStaticFileProvider(config.FxRatesFile)
+		if err != nil {
+			log.Fatalf("Failed to load FX rates: %v", err)
+		}
+		server.FxRates = rates
+	}
+	server.FxQuoteTTL = config.FxQuoteTTL
+
+	// Store calls are abandoned, and transfers rolled back, once a request passes its deadline
+	server.RequestTimeout = config.RequestTimeout
+
+	// Transfers that lose a serialization race or deadlock are run again before the client sees a 503
+	server.TransferRetry = handlers.RetryPolicy{
+		MaxRetries:  config.TransferRetries,
+		BaseBackoff: config.TransferRetryBackoff,
+		MaxBackoff:  config.TransferRetryMax,
 	}
 
-	// Handler functions
-	http.HandleFunc("/accounts", handlers.CreateAccountHandler)
-	http.HandleFunc("/accounts/", handlers.GetAccountHandler)
-	http.HandleFunc("/transactions", handlers.TransactionHandler)
+	// Clients authenticate with API keys, signed requests are only accepted once within SignatureWindow
+	server.APIKeyAuth = config.UsesAuth(models.AuthAPIKey)
+	server.SignatureWindow = config.SignatureWindow
+	server.SigningKeys = signingKeys
 
-	log.Printf("Server running on %s\n", config.ServerPort)
-	log.Fatal(http.ListenAndServe(config.ServerPort, nil))
+	// Or with JWTs from the identity provider, whose keys are loaded again as they rotate
+	if config.UsesAuth(models.AuthJWT) {
+		var keys *jwt.KeySet
+		if config.JWKSURL != "" {
+			keys, err = jwt.NewRemoteKeySet(config.JWKSURL, &http.Client{Timeout: 10 * time.Second}, config.JWKSRefresh)
+		} else {
+			keys, err = jwt.NewFileKeySet(config.JWKSFile, config.JWKSRefresh)
+		}
+		if err != nil {
+			log.Fatalf("Failed to load JWKS: %v", err)
+		}
+		server.JWT = &jwt.Verifier{Keys: keys, Issuer: config.JWTIssuer, Audience: config.JWTAudience, Leeway: config.JWTLeeway}
+		server.JWTRoleClaim = config.JWTRoleClaim
+	}
+	// Or with client certificates, mapped to the service they identify
+	if config.UsesAuth(models.AuthMTLS) {
+		server.ClientCerts, err = certs.LoadClientMap(config.TLSClientPrincipals)
+		if err != nil {
+			log.Fatalf("Failed to load client principals: %v", err)
+		}
+	}
+	if !server.APIKeyAuth && server.JWT == nil && server.ClientCerts == nil {
+		log.Println("Authentication is off, anyone who can reach the server can use the API")
+	}
+
+	// Each client gets a token bucket, refused requests are told when to come back
+	server.RateLimit = handlers.RateLimit{Rate: float64(config.RateLimit), Burst: config.RateLimitBurst}
+
+	// Transfers out of an account are capped by its tier, counted under the account's lock
+	if config.VelocityLimitsFile != "" {
+		server.VelocityLimits, err = models.LoadVelocityLimits(config.VelocityLimitsFile)
+		if err != nil {
+			log.Fatalf("Failed to load velocity limits: %v", err)
+		}
+	}
+
+	// Routes without /v1 are announced as deprecated and answer 410 from this date
+	server.LegacySunset = config.LegacySunset
+
+	// Purge expired idempotency keys in the background
+	go func() {
+		for range time.Tick(time.Hour) {
+			if _, err := server.Store.PurgeExpiredIdempotencyKeys(context.Background()); err != nil {
+				log.Printf("Failed to purge idempotency keys: %v", err)
+			}
+		}
+	}()
+
+	httpServer := &http.Server{
+		Addr:              config.ServerPort,
+		Handler:           server.Routes(),
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+
+	// Serve HTTPS when given a certificate, renewed files are picked up without a restart
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if config.TLSCertFile != "" {
+		reloader, err := certs.NewReloader(certs.Options{
+			CertFile:     config.TLSCertFile,
+			KeyFile:      config.TLSKeyFile,
+			MinVersion:   config.TLSMinVersion,
+			CipherPolicy: config.TLSCipherPolicy,
+			ClientCAFile: config.TLSClientCAFile,
+			ClientAuth:   config.TLSClientAuth,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		httpServer.TLSConfig = reloader.TLSConfig()
+		go reloader.Watch(ctx, config.TLSReloadInterval)
+	}
+	go func() {
+		log.Printf("Server running on %s\n", config.ServerPort)
+		var err error
+		if httpServer.TLSConfig != nil {
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Stop on SIGINT or SIGTERM, refusing new connections and letting in-flight requests finish
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to finish in-flight requests within %s: %v", config.ShutdownTimeout, err)
+	}
+	log.Printf("Transfer retries: %d, gave up: %d\n", server.RetryStats.Retries.Load(), server.RetryStats.Exhausted.Load())
+
+	// Transfers still running past the deadline commit or roll back before the database is closed
+	if err := st.Close(); err != nil {
+		log.Printf("Failed to close store: %v", err)
+	}
+
+	// Saved after requests have drained so every acknowledged transfer is in the snapshot
+	if memory != nil && config.SnapshotFile != "" {
+		if err := memory.SaveSnapshot(config.SnapshotFile); err != nil {
+			log.Fatalf("Failed to save snapshot: %v", err)
+		}
+		log.Printf("Saved snapshot to %s\n", config.SnapshotFile)
+	}
+}
+
+// Handle migrate up, migrate down [steps] and migrate status
+func runMigrate(db *sql.DB, dialect migrations.Dialect, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrations.Up(db, dialect)
+		for _, m := range applied {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("already up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("migrate down: steps must be a positive number")
+			}
+			steps = n
+		}
+		reverted, err := migrations.Down(db, dialect, steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %d_%s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrations.Statuses(db, dialect)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%d_%s\t%s\n", s.Version, s.Name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[0])
+	}
+}
+
+// Handle apikey create [-signed] <name>, apikey list and apikey revoke <key_id>.
+// Created keys can sign requests when signingKeys is set
+func runAPIKey(ctx context.Context, keys store.APIKeyStore, signingKeys cipher.AEAD, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: apikey create [-signed] [-role <role>] <name>|list|revoke <key_id>")
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		signed := fs.Bool("signed", false, "only accept requests signed with the key")
+		role := fs.String("role", models.RoleCustomer, "what the key may do: "+strings.Join(models.Roles, ", "))
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: apikey create [-signed] [-role <role>] <name>")
+		}
+		if !slices.Contains(models.Roles, *role) {
+			return fmt.Errorf("role must be one of %s, got %q", strings.Join(models.Roles, ", "), *role)
+		}
+		key, token, err := handlers.NewAPIKey(fs.Arg(0), *signed, *role, signingKeys)
+		if err != nil {
+			return err
+		}
+		if err := keys.CreateAPIKey(ctx, key); err != nil {
+			return err
+		}
+
+		// The only time the secret is shown, the store keeps its hash
+		fmt.Printf("key_id\t%s\napi_key\t%s\n", key.KeyID, token)
+		return nil
+	case "list":
+		list, err := keys.ListAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		for _, key := range list {
+			state := "active"
+			if key.RevokedAt != nil {
+				state = "revoked " + key.RevokedAt.Format(time.RFC3339)
+			}
+			use := "bearer or signed"
+			if key.RequireSignature {
+				use = "signed"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\tcreated %s\t%s\n", key.KeyID, key.Name, key.Role, use, key.CreatedAt.Format(time.RFC3339), state)
+		}
+		return nil
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: apikey revoke <key_id>")
+		}
+		if err := keys.RevokeAPIKey(ctx, args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("revoked %s\n", args[1])
+		return nil
+	default:
+		return fmt.Errorf("unknown apikey command %q, expected create, list or revoke", args[0])
+	}
 }
@@ -0,0 +1,275 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+// Database specific parts of migrating, each dialect has its own directory of migrations with the same versions
+type Dialect struct {
+	Name string
+
+	// Statements taking and releasing a session lock on lockKey so replicas starting together don't race, if needed
+	lock   string
+	unlock string
+
+	createTable string
+}
+
+// Key of the Postgres advisory lock held while migrating
+const lockKey int64 = 0x7472616e73666572
+
+var (
+	Postgres = Dialect{
+		Name:   "postgres",
+		lock:   "SELECT pg_advisory_lock($1)",
+		unlock: "SELECT pg_advisory_unlock($1)",
+		createTable: `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version BIGINT PRIMARY KEY,
+				name VARCHAR(255) NOT NULL,
+				applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			)`,
+	}
+
+	// SQLite serializes writers itself, each migration runs in its own write transaction
+	SQLite = Dialect{
+		Name: "sqlite",
+		createTable: `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version INTEGER PRIMARY KEY,
+				name TEXT NOT NULL,
+				applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+			)`,
+	}
+)
+
+// A versioned schema change with the SQL to apply and revert it
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// State of a migration in the database
+type Status struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// Load the migrations embedded in the binary for a dialect, ordered by version
+func Load(d Dialect) ([]Migration, error) {
+	sub, err := fs.Sub(files, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(sub)
+}
+
+// Parse migrations from files named <version>_<name>.up.sql and <version>_<name>.down.sql
+func Parse(files fs.FS) ([]Migration, error) {
+	paths, err := fs.Glob(files, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, p := range paths {
+		base := path.Base(p)
+		stem, direction := strings.TrimSuffix(base, ".sql"), ""
+		switch {
+		case strings.HasSuffix(stem, ".up"):
+			stem, direction = strings.TrimSuffix(stem, ".up"), "up"
+		case strings.HasSuffix(stem, ".down"):
+			stem, direction = strings.TrimSuffix(stem, ".down"), "down"
+		default:
+			return nil, fmt.Errorf("migration %s: must end in .up.sql or .down.sql", base)
+		}
+
+		prefix, name, ok := strings.Cut(stem, "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: must start with a positive version followed by _", base)
+		}
+
+		content, err := fs.ReadFile(files, p)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d: named both %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s: needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Run fn on a single connection holding the migration lock and knowing the applied versions
+func withLock(db *sql.DB, d Dialect, fn func(conn *sql.Conn, applied map[int64]time.Time) error) error {
+	ctx := context.Background()
+
+	// Advisory locks belong to a session, so everything runs on one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if d.lock != "" {
+		if _, err := conn.ExecContext(ctx, d.lock, lockKey); err != nil {
+			return fmt.Errorf("failed to take migration lock: %w", err)
+		}
+		defer conn.ExecContext(ctx, d.unlock, lockKey)
+	}
+
+	if _, err := conn.ExecContext(ctx, d.createTable); err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	return fn(conn, applied)
+}
+
+// Run one direction of a migration and record it, both in the same DB transaction
+func apply(conn *sql.Conn, m Migration, up bool) error {
+	ctx := context.Background()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// No-op once committed
+	defer tx.Rollback()
+
+	script, record, args := m.Down, "DELETE FROM schema_migrations WHERE version = $1", []interface{}{m.Version}
+	if up {
+		script, record, args = m.Up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", []interface{}{m.Version, m.Name}
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Apply every pending migration in version order, returning the ones applied
+func Up(db *sql.DB, d Dialect) ([]Migration, error) {
+	migrations, err := Load(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	err = withLock(db, d, func(conn *sql.Conn, applied map[int64]time.Time) error {
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := apply(conn, m, true); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Revert the latest applied migrations, returning the ones reverted
+func Down(db *sql.DB, d Dialect, steps int) ([]Migration, error) {
+	migrations, err := Load(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	err = withLock(db, d, func(conn *sql.Conn, applied map[int64]time.Time) error {
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := apply(conn, m, false); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Report every known migration and when it was applied, nil if pending
+func Statuses(db *sql.DB, d Dialect) ([]Status, error) {
+	migrations, err := Load(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	err = withLock(db, d, func(conn *sql.Conn, applied map[int64]time.Time) error {
+		for _, m := range migrations {
+			s := Status{Version: m.Version, Name: m.Name}
+			if at, ok := applied[m.Version]; ok {
+				s.AppliedAt = &at
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	})
+	return statuses, err
+}
@@ -0,0 +1,66 @@
+-- Schema as created by the server before versioned migrations, safe to run against an existing database
+CREATE TABLE IF NOT EXISTS accounts (
+    account_id VARCHAR(255) PRIMARY KEY,
+    balance NUMERIC NOT NULL
+);
+
+-- Accounts created before multi-currency support were all SGD
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS currency VARCHAR(16) NOT NULL DEFAULT 'SGD';
+
+CREATE TABLE IF NOT EXISTS transactions (
+    id BIGSERIAL PRIMARY KEY,
+    source_account_id BIGINT NOT NULL,
+    destination_account_id BIGINT NOT NULL,
+    amount NUMERIC NOT NULL,
+    source_balance NUMERIC NOT NULL,
+    destination_balance NUMERIC NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS currency VARCHAR(16) NOT NULL DEFAULT 'SGD';
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS destination_currency VARCHAR(16);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS destination_amount NUMERIC;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_rate NUMERIC;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_remainder NUMERIC;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS quote_id VARCHAR(64);
+CREATE INDEX IF NOT EXISTS transactions_source_idx ON transactions (source_account_id, id);
+CREATE INDEX IF NOT EXISTS transactions_destination_idx ON transactions (destination_account_id, id);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    idempotency_key VARCHAR(255) PRIMARY KEY,
+    fingerprint CHAR(64) NOT NULL,
+    status_code INT,
+    content_type VARCHAR(255),
+    response_body BYTEA,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_idx ON idempotency_keys (expires_at);
+
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id BIGSERIAL PRIMARY KEY,
+    kind VARCHAR(32) NOT NULL,
+    transaction_id BIGINT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS postings (
+    id BIGSERIAL PRIMARY KEY,
+    journal_entry_id BIGINT NOT NULL REFERENCES journal_entries (id),
+    account_id BIGINT NOT NULL,
+    amount NUMERIC NOT NULL
+);
+ALTER TABLE postings ADD COLUMN IF NOT EXISTS currency VARCHAR(16) NOT NULL DEFAULT 'SGD';
+CREATE INDEX IF NOT EXISTS postings_account_idx ON postings (account_id);
+CREATE INDEX IF NOT EXISTS postings_journal_entry_idx ON postings (journal_entry_id);
+
+CREATE TABLE IF NOT EXISTS fx_quotes (
+    id VARCHAR(64) PRIMARY KEY,
+    source_currency VARCHAR(16) NOT NULL,
+    destination_currency VARCHAR(16) NOT NULL,
+    amount NUMERIC NOT NULL,
+    rate NUMERIC NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
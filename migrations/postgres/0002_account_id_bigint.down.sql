@@ -0,0 +1,2 @@
+ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_balance_non_negative;
+ALTER TABLE accounts ALTER COLUMN account_id TYPE VARCHAR(255) USING account_id::VARCHAR;
@@ -0,0 +1,5 @@
+-- The API has always treated account IDs as integers
+ALTER TABLE accounts ALTER COLUMN account_id TYPE BIGINT USING account_id::BIGINT;
+
+-- Overdrafts are rejected by the database as well as by the transfer
+ALTER TABLE accounts ADD CONSTRAINT accounts_balance_non_negative CHECK (balance >= 0);
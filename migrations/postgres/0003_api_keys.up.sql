@@ -0,0 +1,9 @@
+-- Clients authenticate with API keys, only a hash of each secret is stored
+CREATE TABLE api_keys (
+    key_id VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    secret_hash BYTEA NOT NULL,
+    require_signature BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ
+);
@@ -0,0 +1,3 @@
+-- Customers may only act on the accounts they own, keys created before roles keep full access
+ALTER TABLE accounts ADD COLUMN owner VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE api_keys ADD COLUMN role VARCHAR(32) NOT NULL DEFAULT 'admin';
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS transactions_source_created_idx;
+ALTER TABLE accounts DROP COLUMN IF EXISTS tier;
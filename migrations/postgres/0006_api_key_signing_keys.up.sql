@@ -0,0 +1,2 @@
+-- Signed requests are checked with a key derived from the secret, stored encrypted. Keys created before have none
+ALTER TABLE api_keys ADD COLUMN signing_key BYTEA;
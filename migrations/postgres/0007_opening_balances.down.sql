@@ -0,0 +1,2 @@
+-- The backfilled entries are kept, they record balances the accounts really had
+SELECT 1;
@@ -0,0 +1,15 @@
+-- Accounts without postings get the opening entry CreateAccount posts against equity, so they reconcile.
+-- Accounts whose postings do not explain their balance are left for Reconcile to report
+CREATE TEMPORARY TABLE opening_backfill ON COMMIT DROP AS
+SELECT a.account_id, a.currency, a.balance AS amount,
+    (SELECT COALESCE(MAX(id), 0) FROM journal_entries) + ROW_NUMBER() OVER (ORDER BY a.account_id) AS entry_id
+FROM accounts a
+WHERE a.balance <> 0
+    AND NOT EXISTS (SELECT 1 FROM postings p WHERE p.account_id = a.account_id);
+
+INSERT INTO journal_entries (id, kind) SELECT entry_id, 'opening_balance' FROM opening_backfill;
+INSERT INTO postings (journal_entry_id, account_id, currency, amount)
+SELECT entry_id, -1, currency, -amount FROM opening_backfill
+UNION ALL
+SELECT entry_id, account_id, currency, amount FROM opening_backfill;
+SELECT setval(pg_get_serial_sequence('journal_entries', 'id'), GREATEST((SELECT MAX(id) FROM journal_entries), 1));
@@ -0,0 +1,65 @@
+-- Amounts are stored as text so they stay exact, SQLite has no decimal type
+CREATE TABLE IF NOT EXISTS accounts (
+    account_id INTEGER PRIMARY KEY,
+    balance TEXT NOT NULL,
+    currency TEXT NOT NULL DEFAULT 'SGD'
+);
+
+-- Timestamps are written by the server as UTC text so they compare in order
+CREATE TABLE IF NOT EXISTS transactions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    source_account_id INTEGER NOT NULL,
+    destination_account_id INTEGER NOT NULL,
+    currency TEXT NOT NULL DEFAULT 'SGD',
+    amount TEXT NOT NULL,
+    destination_currency TEXT,
+    destination_amount TEXT,
+    fx_rate TEXT,
+    fx_remainder TEXT,
+    quote_id TEXT,
+    source_balance TEXT NOT NULL,
+    destination_balance TEXT NOT NULL,
+    status TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transactions_source_idx ON transactions (source_account_id, id);
+CREATE INDEX IF NOT EXISTS transactions_destination_idx ON transactions (destination_account_id, id);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    idempotency_key TEXT PRIMARY KEY,
+    fingerprint TEXT NOT NULL,
+    status_code INTEGER,
+    content_type TEXT,
+    response_body BLOB,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_idx ON idempotency_keys (expires_at);
+
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL,
+    transaction_id INTEGER,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS postings (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    journal_entry_id INTEGER NOT NULL REFERENCES journal_entries (id),
+    account_id INTEGER NOT NULL,
+    currency TEXT NOT NULL DEFAULT 'SGD',
+    amount TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS postings_account_idx ON postings (account_id);
+CREATE INDEX IF NOT EXISTS postings_journal_entry_idx ON postings (journal_entry_id);
+
+CREATE TABLE IF NOT EXISTS fx_quotes (
+    id TEXT PRIMARY KEY,
+    source_currency TEXT NOT NULL,
+    destination_currency TEXT NOT NULL,
+    amount TEXT NOT NULL,
+    rate TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
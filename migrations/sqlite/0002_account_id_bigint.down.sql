@@ -0,0 +1,8 @@
+CREATE TABLE accounts_old (
+    account_id INTEGER PRIMARY KEY,
+    balance TEXT NOT NULL,
+    currency TEXT NOT NULL DEFAULT 'SGD'
+);
+INSERT INTO accounts_old (account_id, balance, currency) SELECT account_id, balance, currency FROM accounts;
+DROP TABLE accounts;
+ALTER TABLE accounts_old RENAME TO accounts;
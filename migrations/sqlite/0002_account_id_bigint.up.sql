@@ -0,0 +1,9 @@
+-- Account IDs are already integers here, SQLite can only add the overdraft check by rebuilding the table
+CREATE TABLE accounts_new (
+    account_id INTEGER PRIMARY KEY,
+    balance TEXT NOT NULL CONSTRAINT accounts_balance_non_negative CHECK (balance NOT LIKE '-%'),
+    currency TEXT NOT NULL DEFAULT 'SGD'
+);
+INSERT INTO accounts_new (account_id, balance, currency) SELECT account_id, balance, currency FROM accounts;
+DROP TABLE accounts;
+ALTER TABLE accounts_new RENAME TO accounts;
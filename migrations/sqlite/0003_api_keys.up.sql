@@ -0,0 +1,9 @@
+-- Clients authenticate with API keys, only a hash of each secret is stored
+CREATE TABLE api_keys (
+    key_id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    secret_hash BLOB NOT NULL,
+    require_signature BOOLEAN NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
@@ -0,0 +1,3 @@
+-- Velocity limits of transfers out of an account are set per tier, and count its recent transfers
+ALTER TABLE accounts ADD COLUMN tier TEXT NOT NULL DEFAULT 'standard';
+CREATE INDEX transactions_source_created_idx ON transactions (source_account_id, created_at);
@@ -0,0 +1,16 @@
+-- Accounts without postings get the opening entry CreateAccount posts against equity, so they reconcile.
+-- SQLite databases always had the ledger, so only accounts inserted around the server can lack one.
+-- Balances are text and never negative, so the equity side is the balance with a minus sign
+CREATE TEMPORARY TABLE opening_backfill AS
+SELECT a.account_id, a.currency, a.balance AS amount,
+    (SELECT COALESCE(MAX(id), 0) FROM journal_entries) + ROW_NUMBER() OVER (ORDER BY a.account_id) AS entry_id
+FROM accounts a
+WHERE CAST(a.balance AS REAL) <> 0
+    AND NOT EXISTS (SELECT 1 FROM postings p WHERE p.account_id = a.account_id);
+
+INSERT INTO journal_entries (id, kind, created_at) SELECT entry_id, 'opening_balance', CURRENT_TIMESTAMP FROM opening_backfill;
+INSERT INTO postings (journal_entry_id, account_id, currency, amount)
+SELECT entry_id, -1, currency, '-' || amount FROM opening_backfill
+UNION ALL
+SELECT entry_id, account_id, currency, amount FROM opening_backfill;
+DROP TABLE opening_backfill;
@@ -1,6 +1,15 @@
 package models
 
+import "github.com/shopspring/decimal"
+
 type Account struct {
-	AccountID      int     `json:"account_id"`
-	CurrentBalance float64 `json:"balance"`
+	AccountID      int             `json:"account_id"`
+	CurrentBalance decimal.Decimal `json:"balance"`
+	Currency       string          `json:"currency"`
+
+	// Principal ID of the customer the account belongs to, empty for none
+	Owner string `json:"owner,omitempty"`
+
+	// Picks the velocity limits of transfers out of the account
+	Tier string `json:"tier,omitempty"`
 }
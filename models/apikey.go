@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// Credential of an API client. Only a SHA-256 hash of the secret is kept to check bearer tokens,
+// signed requests are checked with a key derived from the secret that is stored encrypted
+type APIKey struct {
+	KeyID      string `json:"key_id"`
+	Name       string `json:"name"`
+	SecretHash []byte `json:"secret_hash"`
+
+	// Nonce and AES-GCM sealed signing key, empty for keys that cannot sign
+	SigningKey []byte `json:"signing_key,omitempty"`
+
+	// Requests made with the key must be signed, a bearer token alone is refused
+	RequireSignature bool `json:"require_signature"`
+
+	// What the key's holder may do, one of Roles
+	Role string `json:"role"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Roles a caller can hold. Customers act on the accounts they own, auditors read everything,
+// operators run accounts and transfers, admins do all of it
+const (
+	RoleCustomer = "customer"
+	RoleAuditor  = "auditor"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var Roles = []string{RoleCustomer, RoleAuditor, RoleOperator, RoleAdmin}
+
+// The authenticated caller of a request
+type Principal struct {
+	// Key ID for API keys, sub for JWTs. Accounts are owned by this ID
+	ID string
+
+	// How the caller proved who it is, e.g. api_key or signature
+	Method string
+
+	// One of Roles, empty when the credential names none and nothing is allowed
+	Role string
+}
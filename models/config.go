@@ -1,10 +1,850 @@
 package models
 
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
 type Config struct {
-	DBUser     string
-	DBPassword string
-	DBName     string
-	DBHost     string
-	DBPort     int
-	ServerPort string
+	Store                string
+	SnapshotFile         string
+	SQLitePath           string
+	DBDSN                string
+	DBUser               string
+	DBPassword           string
+	DBPasswordFile       string
+	DBName               string
+	DBHost               string
+	DBPort               int
+	DBSSLMode            string
+	DBMaxOpenConns       int
+	DBMaxIdleConns       int
+	DBConnMaxLifetime    time.Duration
+	ServerPort           string
+	ReadTimeout          time.Duration
+	ReadHeaderTimeout    time.Duration
+	WriteTimeout         time.Duration
+	RequestTimeout       time.Duration
+	IdleTimeout          time.Duration
+	ShutdownTimeout      time.Duration
+	Currencies           map[string]int32
+	IdempotencyRetention time.Duration
+	FxRatesFile          string
+	FxQuoteTTL           time.Duration
+	TransferRetries      int
+	TransferRetryBackoff time.Duration
+	TransferRetryMax     time.Duration
+	LegacySunset         time.Time
+	Auth                 string
+	SignatureWindow      time.Duration
+	SigningSecretFile    string
+	JWKSFile             string
+	JWKSURL              string
+	JWKSRefresh          time.Duration
+	JWTIssuer            string
+	JWTAudience          string
+	JWTLeeway            time.Duration
+	JWTRoleClaim         string
+	TLSCertFile          string
+	TLSKeyFile           string
+	TLSMinVersion        string
+	TLSCipherPolicy      string
+	TLSReloadInterval    time.Duration
+	TLSClientCAFile      string
+	TLSClientAuth        string
+	TLSClientPrincipals  string
+	RateLimit            int
+	RateLimitBurst       int
+	VelocityLimitsFile   string
+}
+
+// Storage backends selectable with --store
+const (
+	StorePostgres = "postgres"
+	StoreMemory   = "memory"
+	StoreSQLite   = "sqlite"
+)
+
+// Authentication methods selectable with --auth, as a list such as api-key,jwt or none
+const (
+	AuthAPIKey = "api-key"
+	AuthJWT    = "jwt"
+	AuthMTLS   = "mtls"
+	AuthNone   = "none"
+)
+
+// Prefix of the environment variable for every setting, e.g. TRANSFERS_DB_HOST
+const EnvPrefix = "TRANSFERS_"
+
+// Shown instead of secrets by Redacted
+const redactedSecret = "[REDACTED]"
+
+// Settings used when nothing else is given
+func DefaultConfig() Config {
+	currencies := make(map[string]int32, len(Currencies))
+	for code, scale := range Currencies {
+		currencies[code] = scale
+	}
+
+	return Config{
+		Store:                StorePostgres,
+		SQLitePath:           "transfers.db",
+		DBUser:               "postgres",
+		DBName:               "postgres",
+		DBHost:               "localhost",
+		DBPort:               5432,
+		DBSSLMode:            "disable",
+		DBMaxOpenConns:       25,
+		DBMaxIdleConns:       25,
+		DBConnMaxLifetime:    30 * time.Minute,
+		ServerPort:           ":3333",
+		ReadTimeout:          15 * time.Second,
+		ReadHeaderTimeout:    5 * time.Second,
+		WriteTimeout:         30 * time.Second,
+		RequestTimeout:       10 * time.Second,
+		IdleTimeout:          2 * time.Minute,
+		ShutdownTimeout:      30 * time.Second,
+		Currencies:           currencies,
+		IdempotencyRetention: 24 * time.Hour,
+		FxQuoteTTL:           30 * time.Second,
+		TransferRetries:      3,
+		TransferRetryBackoff: 10 * time.Millisecond,
+		TransferRetryMax:     200 * time.Millisecond,
+		LegacySunset:         time.Date(2027, time.April, 17, 0, 0, 0, 0, time.UTC),
+		Auth:                 AuthAPIKey,
+		SignatureWindow:      5 * time.Minute,
+		JWKSRefresh:          10 * time.Minute,
+		JWTLeeway:            30 * time.Second,
+		JWTRoleClaim:         "role",
+		TLSMinVersion:        "1.2",
+		TLSCipherPolicy:      "modern",
+		TLSReloadInterval:    30 * time.Second,
+		TLSClientAuth:        "optional",
+		RateLimit:            20,
+		RateLimitBurst:       40,
+	}
+}
+
+// One configurable value, reachable as a flag, an environment variable and a config file key
+type setting struct {
+	name   string
+	usage  string
+	secret bool
+	get    func(c *Config) string
+	set    func(c *Config, value string) error
+}
+
+// Flag name to environment variable, db-host becomes TRANSFERS_DB_HOST
+func (s setting) env() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+// Flag name to config file key, db-host becomes db_host
+func (s setting) key() string {
+	return strings.ReplaceAll(s.name, "-", "_")
+}
+
+func stringSetting(name string, usage string, field func(c *Config) *string) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return *field(c) },
+		set:   func(c *Config, value string) error { *field(c) = value; return nil },
+	}
+}
+
+// Mark a setting as never printed
+func secret(s setting) setting {
+	s.secret = true
+	return s
+}
+
+func intSetting(name string, usage string, field func(c *Config) *int) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.Itoa(*field(c)) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("must be a number")
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func durationSetting(name string, usage string, field func(c *Config) *time.Duration) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return field(c).String() },
+		set: func(c *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("must be a duration such as 30s or 24h")
+			}
+			*field(c) = d
+			return nil
+		},
+	}
+}
+
+// A UTC date such as 2027-04-17, empty for none
+func dateSetting(name string, usage string, field func(c *Config) *time.Time) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		get: func(c *Config) string {
+			if field(c).IsZero() {
+				return ""
+			}
+			return field(c).Format(time.DateOnly)
+		},
+		set: func(c *Config, value string) error {
+			if value == "" {
+				*field(c) = time.Time{}
+				return nil
+			}
+			d, err := time.Parse(time.DateOnly, value)
+			if err != nil {
+				return fmt.Errorf("must be a date such as 2027-04-17")
+			}
+			*field(c) = d
+			return nil
+		},
+	}
+}
+
+var settings = []setting{
+	stringSetting("store", "storage backend: postgres, sqlite for a single node, or memory for development without a database", func(c *Config) *string { return &c.Store }),
+	stringSetting("snapshot-file", "file the memory store is saved to on shutdown and loaded from on start", func(c *Config) *string { return &c.SnapshotFile }),
+	stringSetting("sqlite-path", "database file of the sqlite store", func(c *Config) *string { return &c.SQLitePath }),
+	secret(stringSetting("db-dsn", "full Postgres connection string, overrides the other db-* settings", func(c *Config) *string { return &c.DBDSN })),
+	stringSetting("db-host", "database host", func(c *Config) *string { return &c.DBHost }),
+	intSetting("db-port", "database port", func(c *Config) *int { return &c.DBPort }),
+	stringSetting("db-user", "database user", func(c *Config) *string { return &c.DBUser }),
+	secret(stringSetting("db-password", "database password, prefer db-password-file", func(c *Config) *string { return &c.DBPassword })),
+	stringSetting("db-password-file", "file containing the database password", func(c *Config) *string { return &c.DBPasswordFile }),
+	stringSetting("db-name", "database name", func(c *Config) *string { return &c.DBName }),
+	stringSetting("db-sslmode", "Postgres sslmode: disable, allow, prefer, require, verify-ca or verify-full", func(c *Config) *string { return &c.DBSSLMode }),
+	intSetting("db-max-open-conns", "maximum open database connections, 0 for no limit", func(c *Config) *int { return &c.DBMaxOpenConns }),
+	intSetting("db-max-idle-conns", "maximum idle database connections kept in the pool", func(c *Config) *int { return &c.DBMaxIdleConns }),
+	durationSetting("db-conn-max-lifetime", "how long a database connection is reused, 0 for ever", func(c *Config) *time.Duration { return &c.DBConnMaxLifetime }),
+	stringSetting("server-port", "address to listen on, e.g. :3333", func(c *Config) *string { return &c.ServerPort }),
+	durationSetting("read-timeout", "maximum time to read a whole request", func(c *Config) *time.Duration { return &c.ReadTimeout }),
+	durationSetting("read-header-timeout", "maximum time to read request headers", func(c *Config) *time.Duration { return &c.ReadHeaderTimeout }),
+	durationSetting("write-timeout", "maximum time to handle a request and write the response", func(c *Config) *time.Duration { return &c.WriteTimeout }),
+	durationSetting("request-timeout", "deadline of a request's database work, below write-timeout so the error still reaches the client", func(c *Config) *time.Duration { return &c.RequestTimeout }),
+	durationSetting("idle-timeout", "how long idle keep-alive connections stay open", func(c *Config) *time.Duration { return &c.IdleTimeout }),
+	durationSetting("shutdown-timeout", "how long in-flight requests may take to finish on shutdown", func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	{
+		name:  "currencies",
+		usage: "supported currencies and their decimal places, e.g. SGD=2,JPY=0",
+		get: func(c *Config) string {
+			codes := make([]string, 0, len(c.Currencies))
+			for code, scale := range c.Currencies {
+				codes = append(codes, fmt.Sprintf("%s=%d", code, scale))
+			}
+			sort.Strings(codes)
+			return strings.Join(codes, ",")
+		},
+		set: func(c *Config, value string) error {
+			currencies := map[string]int32{}
+
+			// Config files may give an object instead of a list
+			if strings.HasPrefix(strings.TrimSpace(value), "{") {
+				if err := json.Unmarshal([]byte(value), &currencies); err != nil {
+					return fmt.Errorf("must map currency codes to decimal places")
+				}
+			} else {
+				for _, pair := range strings.Split(value, ",") {
+					code, scale, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					n, err := strconv.ParseInt(scale, 10, 32)
+					if !ok || err != nil {
+						return fmt.Errorf("must be a list such as SGD=2,JPY=0")
+					}
+					currencies[code] = int32(n)
+				}
+			}
+
+			c.Currencies = map[string]int32{}
+			for code, scale := range currencies {
+				c.Currencies[strings.ToUpper(strings.TrimSpace(code))] = scale
+			}
+			return nil
+		},
+	},
+	durationSetting("idempotency-retention", "how long Idempotency-Key responses are replayed", func(c *Config) *time.Duration { return &c.IdempotencyRetention }),
+	stringSetting("fx-rates-file", "JSON file of exchange rates", func(c *Config) *string { return &c.FxRatesFile }),
+	durationSetting("fx-quote-ttl", "how long a quote locks its rate", func(c *Config) *time.Duration { return &c.FxQuoteTTL }),
+	intSetting("transfer-retries", "times a transfer that hit a serialization failure or deadlock is retried, 0 for never", func(c *Config) *int { return &c.TransferRetries }),
+	durationSetting("transfer-retry-backoff", "longest wait before the first retry, doubled for each one after", func(c *Config) *time.Duration { return &c.TransferRetryBackoff }),
+	durationSetting("transfer-retry-max-backoff", "longest wait before any retry", func(c *Config) *time.Duration { return &c.TransferRetryMax }),
+	dateSetting("legacy-sunset", "date the deprecated routes without /v1 stop answering, empty to keep them", func(c *Config) *time.Time { return &c.LegacySunset }),
+	stringSetting("auth", "how API clients authenticate: a list of api-key, jwt and mtls such as api-key,jwt, or none to leave the API open on a trusted network", func(c *Config) *string { return &c.Auth }),
+	durationSetting("signature-window", "how far a signed request's timestamp may be from now, and how long its signature is remembered against replays", func(c *Config) *time.Duration { return &c.SignatureWindow }),
+	stringSetting("api-key-signing-secret-file", "file containing the secret, at least 32 bytes, API key signing keys are stored encrypted with; signed requests are refused without it", func(c *Config) *string { return &c.SigningSecretFile }),
+	stringSetting("jwks-file", "JSON Web Key Set file holding the keys JWTs are verified with", func(c *Config) *string { return &c.JWKSFile }),
+	stringSetting("jwks-url", "URL of the identity provider's JSON Web Key Set, instead of jwks-file", func(c *Config) *string { return &c.JWKSURL }),
+	durationSetting("jwks-refresh", "how often the key set is loaded again, it is also loaded when a token names an unknown key", func(c *Config) *time.Duration { return &c.JWKSRefresh }),
+	stringSetting("jwt-issuer", "iss claim every JWT must carry", func(c *Config) *string { return &c.JWTIssuer }),
+	stringSetting("jwt-audience", "aud claim every JWT must include", func(c *Config) *string { return &c.JWTAudience }),
+	durationSetting("jwt-leeway", "allowed clock difference with the issuer when checking exp and nbf", func(c *Config) *time.Duration { return &c.JWTLeeway }),
+	stringSetting("jwt-role-claim", "claim holding the caller's role: customer, auditor, operator or admin", func(c *Config) *string { return &c.JWTRoleClaim }),
+	stringSetting("tls-cert-file", "PEM certificate chain to serve HTTPS with, plain HTTP when empty", func(c *Config) *string { return &c.TLSCertFile }),
+	stringSetting("tls-key-file", "PEM private key of tls-cert-file", func(c *Config) *string { return &c.TLSKeyFile }),
+	stringSetting("tls-min-version", "lowest TLS version accepted: 1.2 or 1.3", func(c *Config) *string { return &c.TLSMinVersion }),
+	stringSetting("tls-cipher-policy", "TLS 1.2 cipher suites: modern for forward secret AEAD only, or compatible for Go's defaults", func(c *Config) *string { return &c.TLSCipherPolicy }),
+	durationSetting("tls-reload-interval", "how often the certificate, key and client CA files are checked for changes", func(c *Config) *time.Duration { return &c.TLSReloadInterval }),
+	stringSetting("tls-client-ca-file", "PEM bundle of the CAs client certificates are verified against, empty to not ask for them", func(c *Config) *string { return &c.TLSClientCAFile }),
+	stringSetting("tls-client-auth", "optional to verify client certificates when sent, or require to refuse connections without one", func(c *Config) *string { return &c.TLSClientAuth }),
+	stringSetting("tls-client-principals", "JSON file mapping client certificate identities to the principal and role they act as", func(c *Config) *string { return &c.TLSClientPrincipals }),
+	intSetting("rate-limit", "requests per second each client may make on average, 0 for no limit", func(c *Config) *int { return &c.RateLimit }),
+	intSetting("rate-limit-burst", "requests each client may make at once before rate-limit applies", func(c *Config) *int { return &c.RateLimitBurst }),
+	stringSetting("velocity-limits-file", "JSON file of the most transfers and money each account tier may send per window", func(c *Config) *string { return &c.VelocityLimitsFile }),
+}
+
+// Load the config with precedence defaults < config file < environment < flags.
+// The config file is given by --config or TRANSFERS_CONFIG
+func LoadConfig(fs *flag.FlagSet, args []string, getenv func(string) string) (Config, error) {
+	config := DefaultConfig()
+
+	// Collect flags first, they are applied last
+	flagValues := map[string]string{}
+	var flagOrder []string
+	configPath := fs.String("config", "", "JSON, YAML or TOML config file, env "+EnvPrefix+"CONFIG")
+	for _, s := range settings {
+		name := s.name
+		fs.Func(name, s.usage+", env "+s.env(), func(value string) error {
+			if _, seen := flagValues[name]; !seen {
+				flagOrder = append(flagOrder, name)
+			}
+			flagValues[name] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return config, err
+	}
+
+	// Config file
+	path := *configPath
+	if path == "" {
+		path = getenv(EnvPrefix + "CONFIG")
+	}
+	if path != "" {
+		if err := config.loadFile(path); err != nil {
+			return config, err
+		}
+	}
+
+	// Environment
+	for _, s := range settings {
+		if value, ok := lookup(getenv, s.env()); ok {
+			if err := s.set(&config, value); err != nil {
+				return config, fmt.Errorf("invalid %s: %w", s.env(), err)
+			}
+		}
+	}
+
+	// Flags
+	for _, name := range flagOrder {
+		s := findSetting(name)
+		if err := s.set(&config, flagValues[name]); err != nil {
+			return config, fmt.Errorf("invalid --%s: %w", name, err)
+		}
+	}
+
+	// Secret from a file, e.g. a mounted Kubernetes or Docker secret
+	if config.DBPasswordFile != "" {
+		password, err := os.ReadFile(config.DBPasswordFile)
+		if err != nil {
+			return config, fmt.Errorf("failed to read db-password-file: %w", err)
+		}
+		config.DBPassword = strings.TrimRight(string(password), "\r\n")
+	}
+
+	return config, config.Validate()
+}
+
+// Environment variables that are set but empty count as unset
+func lookup(getenv func(string) string, name string) (string, bool) {
+	value := getenv(name)
+	return value, value != ""
+}
+
+func findSetting(name string) setting {
+	for _, s := range settings {
+		if s.name == name {
+			return s
+		}
+	}
+	panic("unknown setting " + name)
+}
+
+// Apply a JSON, YAML or TOML config file, keys are the flag names with underscores
+func (c *Config) loadFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values map[string]json.RawMessage
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(raw, &values)
+	case ".yaml", ".yml":
+		values, err = yamlValues(raw)
+	case ".toml":
+		values, err = tomlValues(raw)
+	default:
+		return fmt.Errorf("config file %s must be JSON (.json), YAML (.yaml, .yml) or TOML (.toml)", path)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	// Apply in a fixed order so errors are reproducible
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s, ok := settingForKey(key)
+		if !ok {
+			return fmt.Errorf("unknown setting %q in config file %s", key, path)
+		}
+
+		// Strings are unquoted, numbers and objects are passed through as written
+		value := string(values[key])
+		var str string
+		if json.Unmarshal(values[key], &str) == nil {
+			value = str
+		}
+		if err := s.set(c, value); err != nil {
+			return fmt.Errorf("invalid %s in config file %s: %w", key, path, err)
+		}
+	}
+	return nil
+}
+
+// Values of a YAML config file as JSON. Scalars are kept as written, so 24h or 2030-01-31
+// reach the setting as text rather than as YAML's idea of a duration or date
+func yamlValues(raw []byte) (map[string]json.RawMessage, error) {
+	var nodes map[string]yaml.Node
+	if err := yaml.Unmarshal(raw, &nodes); err != nil {
+		return nil, err
+	}
+	values := make(map[string]json.RawMessage, len(nodes))
+	for key, node := range nodes {
+		var value any = node.Value
+		if node.Kind != yaml.ScalarNode {
+			if err := node.Decode(&value); err != nil {
+				return nil, err
+			}
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		values[key] = encoded
+	}
+	return values, nil
+}
+
+// Values of a TOML config file as JSON. Only what the settings need is understood: key = value
+// pairs, inline tables and [table] headers. Bare values other than integers are kept as written
+func tomlValues(raw []byte) (map[string]json.RawMessage, error) {
+	top := map[string]any{}
+	current := top
+	for i, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(tomlComment(line))
+		if line == "" {
+			continue
+		}
+
+		// A header starts a table holding the pairs after it
+		if strings.HasPrefix(line, "[") {
+			name := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "["), "]"))
+			if !strings.HasSuffix(line, "]") || name == "" || strings.ContainsAny(name, "[]") {
+				return nil, fmt.Errorf("line %d: invalid table header %s", i+1, line)
+			}
+			if _, ok := top[name]; ok {
+				return nil, fmt.Errorf("line %d: %s is defined twice", i+1, name)
+			}
+			current = map[string]any{}
+			top[name] = current
+			continue
+		}
+
+		key, value, err := tomlPair(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if _, ok := current[key]; ok {
+			return nil, fmt.Errorf("line %d: %s is defined twice", i+1, key)
+		}
+		current[key] = value
+	}
+
+	values := make(map[string]json.RawMessage, len(top))
+	for key, value := range top {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		values[key] = encoded
+	}
+	return values, nil
+}
+
+// Line without its comment, a # inside a string is kept
+func tomlComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func tomlPair(pair string) (string, any, error) {
+	key, value, ok := strings.Cut(pair, "=")
+	if !ok {
+		return "", nil, fmt.Errorf("expected key = value, got %s", pair)
+	}
+	key, err := tomlString(strings.TrimSpace(key))
+	if err != nil || key == "" {
+		return "", nil, fmt.Errorf("invalid key in %s", pair)
+	}
+	parsed, err := tomlValue(strings.TrimSpace(value))
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return key, parsed, nil
+}
+
+func tomlValue(value string) (any, error) {
+	switch {
+	case value == "":
+		return nil, fmt.Errorf("missing value")
+	case strings.HasPrefix(value, "{"):
+		if !strings.HasSuffix(value, "}") {
+			return nil, fmt.Errorf("unterminated inline table %s", value)
+		}
+		table := map[string]any{}
+		body := strings.TrimSpace(value[1 : len(value)-1])
+		if body == "" {
+			return table, nil
+		}
+		for _, pair := range strings.Split(body, ",") {
+			key, parsed, err := tomlPair(strings.TrimSpace(pair))
+			if err != nil {
+				return nil, err
+			}
+			table[key] = parsed
+		}
+		return table, nil
+	case strings.HasPrefix(value, "["):
+		return nil, fmt.Errorf("arrays are not supported")
+	case strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "'"):
+		return tomlString(value)
+	}
+	if n, err := strconv.ParseInt(strings.ReplaceAll(value, "_", ""), 10, 64); err == nil {
+		return n, nil
+	}
+	return value, nil
+}
+
+// Text of a basic or literal string, bare keys are returned as they are
+func tomlString(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "\""):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") || strings.Contains(s[1:len(s)-1], "'") {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	}
+	return s, nil
+}
+
+func settingForKey(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key() == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+var sslModes = map[string]bool{
+	"disable": true, "allow": true, "prefer": true, "require": true, "verify-ca": true, "verify-full": true,
+}
+
+// Check every setting, reporting all problems at once
+func (c Config) Validate() error {
+	var problems []string
+
+	switch c.Store {
+	case StorePostgres:
+		if c.SnapshotFile != "" {
+			problems = append(problems, "snapshot-file is only used with store memory")
+		}
+	case StoreSQLite:
+		if c.SnapshotFile != "" {
+			problems = append(problems, "snapshot-file is only used with store memory")
+		}
+		if c.SQLitePath == "" {
+			problems = append(problems, "sqlite-path must be set for store sqlite")
+		}
+	case StoreMemory:
+	default:
+		problems = append(problems, fmt.Sprintf("store must be one of postgres, sqlite, memory, got %q", c.Store))
+	}
+
+	// Database settings only matter when there is a database
+	if c.Store == StorePostgres && c.DBDSN == "" {
+		if c.DBHost == "" {
+			problems = append(problems, "db-host is required unless db-dsn is set")
+		}
+		if c.DBPort < 1 || c.DBPort > 65535 {
+			problems = append(problems, fmt.Sprintf("db-port must be between 1 and 65535, got %d", c.DBPort))
+		}
+		if c.DBUser == "" {
+			problems = append(problems, "db-user is required unless db-dsn is set")
+		}
+		if c.DBName == "" {
+			problems = append(problems, "db-name is required unless db-dsn is set")
+		}
+		if !sslModes[c.DBSSLMode] {
+			problems = append(problems, fmt.Sprintf("db-sslmode must be one of disable, allow, prefer, require, verify-ca, verify-full, got %q", c.DBSSLMode))
+		}
+	}
+	if c.DBMaxOpenConns < 0 || c.DBMaxIdleConns < 0 {
+		problems = append(problems, "db-max-open-conns and db-max-idle-conns must not be negative")
+	}
+	if c.DBMaxOpenConns > 0 && c.DBMaxIdleConns > c.DBMaxOpenConns {
+		problems = append(problems, fmt.Sprintf("db-max-idle-conns must not exceed db-max-open-conns %d, got %d", c.DBMaxOpenConns, c.DBMaxIdleConns))
+	}
+	if c.DBConnMaxLifetime < 0 {
+		problems = append(problems, "db-conn-max-lifetime must not be negative")
+	}
+	if _, _, err := net.SplitHostPort(c.ServerPort); err != nil {
+		problems = append(problems, fmt.Sprintf("server-port must be an address such as :3333, got %q", c.ServerPort))
+	}
+	if len(c.Currencies) == 0 {
+		problems = append(problems, "currencies must list at least one currency")
+	}
+	for code, scale := range c.Currencies {
+		if code == "" || scale < 0 || scale > 18 {
+			problems = append(problems, fmt.Sprintf("currency %q must have between 0 and 18 decimal places, got %d", code, scale))
+		}
+	}
+	for name, timeout := range map[string]time.Duration{
+		"read-timeout": c.ReadTimeout, "read-header-timeout": c.ReadHeaderTimeout, "write-timeout": c.WriteTimeout, "request-timeout": c.RequestTimeout,
+		"idle-timeout": c.IdleTimeout, "shutdown-timeout": c.ShutdownTimeout,
+	} {
+		if timeout <= 0 {
+			problems = append(problems, name+" must be positive")
+		}
+	}
+	if c.RequestTimeout >= c.WriteTimeout {
+		problems = append(problems, fmt.Sprintf("request-timeout must be below write-timeout %s, got %s", c.WriteTimeout, c.RequestTimeout))
+	}
+	if c.IdempotencyRetention <= 0 {
+		problems = append(problems, "idempotency-retention must be positive")
+	}
+	if c.FxQuoteTTL <= 0 {
+		problems = append(problems, "fx-quote-ttl must be positive")
+	}
+	if c.TransferRetries < 0 {
+		problems = append(problems, fmt.Sprintf("transfer-retries must not be negative, got %d", c.TransferRetries))
+	}
+	if c.TransferRetryBackoff <= 0 || c.TransferRetryMax <= 0 {
+		problems = append(problems, "transfer-retry-backoff and transfer-retry-max-backoff must be positive")
+	}
+	if c.TransferRetryMax < c.TransferRetryBackoff {
+		problems = append(problems, fmt.Sprintf("transfer-retry-max-backoff must not be below transfer-retry-backoff %s, got %s", c.TransferRetryBackoff, c.TransferRetryMax))
+	}
+	if c.Auth != AuthNone {
+		for _, method := range strings.Split(c.Auth, ",") {
+			if method != AuthAPIKey && method != AuthJWT && method != AuthMTLS {
+				problems = append(problems, fmt.Sprintf("auth must be one of api-key, jwt, mtls, a list of them such as api-key,jwt or none, got %q", c.Auth))
+				break
+			}
+		}
+	}
+	if c.SignatureWindow <= 0 {
+		problems = append(problems, "signature-window must be positive")
+	}
+	if c.UsesAuth(AuthJWT) {
+		if (c.JWKSFile == "") == (c.JWKSURL == "") {
+			problems = append(problems, "exactly one of jwks-file and jwks-url must be set for auth jwt")
+		}
+		if c.JWKSURL != "" {
+			u, err := url.Parse(c.JWKSURL)
+			if err != nil || !(u.Scheme == "https" || (u.Scheme == "http" && isLoopback(u.Hostname()))) {
+				problems = append(problems, fmt.Sprintf("jwks-url must be an https URL, got %q", c.JWKSURL))
+			}
+		}
+		if c.JWTIssuer == "" || c.JWTAudience == "" {
+			problems = append(problems, "jwt-issuer and jwt-audience are required for auth jwt")
+		}
+		if c.JWKSRefresh <= 0 {
+			problems = append(problems, "jwks-refresh must be positive")
+		}
+		if c.JWTLeeway < 0 {
+			problems = append(problems, "jwt-leeway must not be negative")
+		}
+		if c.JWTRoleClaim == "" {
+			problems = append(problems, "jwt-role-claim must not be empty")
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problems = append(problems, "tls-cert-file and tls-key-file must be set together")
+	}
+	if c.TLSCertFile != "" {
+		if c.TLSMinVersion != "1.2" && c.TLSMinVersion != "1.3" {
+			problems = append(problems, fmt.Sprintf("tls-min-version must be one of 1.2, 1.3, got %q", c.TLSMinVersion))
+		}
+		if c.TLSCipherPolicy != "modern" && c.TLSCipherPolicy != "compatible" {
+			problems = append(problems, fmt.Sprintf("tls-cipher-policy must be one of modern, compatible, got %q", c.TLSCipherPolicy))
+		}
+		if c.TLSReloadInterval <= 0 {
+			problems = append(problems, "tls-reload-interval must be positive")
+		}
+	}
+	if c.TLSClientCAFile != "" {
+		if c.TLSCertFile == "" {
+			problems = append(problems, "tls-client-ca-file needs tls-cert-file, client certificates are only sent over TLS")
+		}
+		if c.TLSClientAuth != "optional" && c.TLSClientAuth != "require" {
+			problems = append(problems, fmt.Sprintf("tls-client-auth must be one of optional, require, got %q", c.TLSClientAuth))
+		}
+	}
+	if c.UsesAuth(AuthMTLS) && (c.TLSClientCAFile == "" || c.TLSClientPrincipals == "") {
+		problems = append(problems, "tls-client-ca-file and tls-client-principals are required for auth mtls")
+	}
+	if !c.UsesAuth(AuthMTLS) && c.TLSClientPrincipals != "" {
+		problems = append(problems, "tls-client-principals is only used with auth mtls")
+	}
+
+	if c.RateLimit < 0 {
+		problems = append(problems, fmt.Sprintf("rate-limit must not be negative, got %d", c.RateLimit))
+	}
+	if c.RateLimit > 0 && c.RateLimitBurst < 1 {
+		problems = append(problems, fmt.Sprintf("rate-limit-burst must be at least 1, got %d", c.RateLimitBurst))
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Whether clients may authenticate with method, one of AuthAPIKey, AuthJWT or AuthMTLS
+func (c Config) UsesAuth(method string) bool {
+	for _, m := range strings.Split(c.Auth, ",") {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Plain HTTP is only trusted on the local machine
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Quote a value for a key=value connection string
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// Connection string for the Postgres driver
+func (c Config) DSN() string {
+	if c.DBDSN != "" {
+		return c.DBDSN
+	}
+	return fmt.Sprintf(
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		quoteDSNValue(c.DBHost), c.DBPort, quoteDSNValue(c.DBUser), quoteDSNValue(c.DBPassword),
+		quoteDSNValue(c.DBName), quoteDSNValue(c.DBSSLMode),
+	)
+}
+
+var dsnPassword = regexp.MustCompile(`password=('(\\.|[^'])*'|\S*)`)
+
+// Hide the password in a connection string, in either URL or key=value form
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedSecret)
+		}
+		query := u.Query()
+		if query.Has("password") {
+			query.Set("password", redactedSecret)
+			u.RawQuery = query.Encode()
+		}
+		return strings.Replace(u.String(), url.QueryEscape(redactedSecret), redactedSecret, -1)
+	}
+	return dsnPassword.ReplaceAllString(dsn, "password="+redactedSecret)
+}
+
+// Settings as config file keys and values with secrets hidden, for --print-config
+func (c Config) Redacted() map[string]string {
+	values := make(map[string]string, len(settings))
+	for _, s := range settings {
+		value := s.get(&c)
+		if s.secret && value != "" {
+			if s.name == "db-dsn" {
+				value = redactDSN(value)
+			} else {
+				value = redactedSecret
+			}
+		}
+		values[s.key()] = value
+	}
+	return values
 }
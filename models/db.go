@@ -1,5 +0,0 @@
-package models
-
-import "database/sql"
-
-var DB *sql.DB
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// System account holding the FX position on both legs of a conversion, one per currency
+const FxAccountID = -2
+
+// Exchange rate locked for a conversion until it expires
+type FxQuote struct {
+	QuoteID             string          `json:"quote_id"`
+	SourceCurrency      string          `json:"source_currency"`
+	DestinationCurrency string          `json:"destination_currency"`
+	Amount              decimal.Decimal `json:"amount"`
+	Rate                decimal.Decimal `json:"rate"`
+	DestinationAmount   decimal.Decimal `json:"destination_amount"`
+	Remainder           decimal.Decimal `json:"remainder"`
+	ExpiresAt           time.Time       `json:"expires_at"`
+}
+
+// Convert an amount at a rate, rounding down to the destination currency's scale.
+// The remainder is what rounding kept back, in destination currency units
+func Convert(amount decimal.Decimal, rate decimal.Decimal, destinationCurrency string) (decimal.Decimal, decimal.Decimal) {
+	exact := amount.Mul(rate)
+	converted := exact.RoundDown(Currencies[destinationCurrency])
+	return converted, exact.Sub(converted)
+}
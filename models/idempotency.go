@@ -0,0 +1,12 @@
+package models
+
+// Request seen with an Idempotency-Key and, once it finished, its response
+type IdempotencyRecord struct {
+	Key         string
+	Fingerprint string
+
+	// Zero while the original request is still in progress
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Kinds of journal entries
+const (
+	JournalTransfer       = "transfer"
+	JournalOpeningBalance = "opening_balance"
+)
+
+// System account on the other side of opening balances, one per currency. Customer account IDs are always positive
+const EquityAccountID = -1
+
+// Signed movement on one account, credits are positive and debits negative
+type Posting struct {
+	AccountID int             `json:"account_id"`
+	Currency  string          `json:"currency"`
+	Amount    decimal.Decimal `json:"amount"`
+}
+
+// Balanced set of postings, the amounts always sum to zero
+type JournalEntry struct {
+	JournalEntryID int64     `json:"journal_entry_id"`
+	Kind           string    `json:"kind"`
+	TransactionID  *int64    `json:"transaction_id,omitempty"`
+	Postings       []Posting `json:"postings"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Account whose cached balance differs from the sum of its postings
+type BalanceMismatch struct {
+	AccountID     int             `json:"account_id"`
+	CachedBalance decimal.Decimal `json:"cached_balance"`
+	PostedBalance decimal.Decimal `json:"posted_balance"`
+	Difference    decimal.Decimal `json:"difference"`
+}
+
+// Journal entry whose postings in one currency do not sum to zero
+type UnbalancedEntry struct {
+	JournalEntryID int64           `json:"journal_entry_id"`
+	Currency       string          `json:"currency"`
+	Total          decimal.Decimal `json:"total"`
+}
+
+// Result of recomputing every balance from postings
+type ReconciliationReport struct {
+	CheckedAt         time.Time         `json:"checked_at"`
+	AccountsChecked   int               `json:"accounts_checked"`
+	Balanced          bool              `json:"balanced"`
+	Mismatches        []BalanceMismatch `json:"mismatches"`
+	UnbalancedEntries []UnbalancedEntry `json:"unbalanced_entries"`
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// Decimal places allowed for each supported currency
+var Currencies = map[string]int32{
+	"SGD": 2,
+	"USD": 2,
+	"EUR": 2,
+	"JPY": 0,
+	"BTC": 8,
+}
+
+// Most digits before the decimal point of any amount
+const MaxIntegerDigits = 18
+
+// Plain decimals only, exponents would make checking the scale as costly as the exponent is large
+var moneyPattern = regexp.MustCompile(fmt.Sprintf(`^-?\d{1,%d}(\.\d+)?$`, MaxIntegerDigits))
+
+var (
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+	ErrTooPrecise          = errors.New("amount has more decimal places than the currency allows")
+	ErrTooLarge            = fmt.Errorf("amount has more than %d digits before the decimal point", MaxIntegerDigits)
+)
+
+// Normalise a currency code and verify it is supported
+func ParseCurrency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if _, ok := Currencies[code]; !ok {
+		return "", fmt.Errorf("%w %q", ErrUnsupportedCurrency, code)
+	}
+	return code, nil
+}
+
+// Finest scale of any currency, used before the currency of an amount is known
+func MaxScale() int32 {
+	var max int32
+	for _, scale := range Currencies {
+		if scale > max {
+			max = scale
+		}
+	}
+	return max
+}
+
+// Verify an amount has no more decimal places than its currency allows, and no more than MaxIntegerDigits before them
+func CheckScale(amount decimal.Decimal, currency string) error {
+	scale, ok := Currencies[currency]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnsupportedCurrency, currency)
+	}
+	if amount.NumDigits()+int(amount.Exponent()) > MaxIntegerDigits {
+		return ErrTooLarge
+	}
+
+	// Reject instead of silently rounding. Finer than any currency is refused without
+	// rescaling, which for a large negative exponent would build an equally large number
+	if amount.Exponent() < -MaxScale() || !amount.Equal(amount.Truncate(scale)) {
+		return fmt.Errorf("%w (%s allows %d)", ErrTooPrecise, currency, scale)
+	}
+	return nil
+}
+
+// Parse a plain decimal string into an exact amount, rejecting anything finer than scale.
+// Exponents and more than MaxIntegerDigits digits are refused before parsing
+func ParseMoney(s string, scale int32) (decimal.Decimal, error) {
+	if !moneyPattern.MatchString(s) {
+		return decimal.Decimal{}, fmt.Errorf("invalid number %q", s)
+	}
+	if point := strings.IndexByte(s, '.'); point >= 0 && len(s)-point-1 > int(scale) {
+		return decimal.Decimal{}, fmt.Errorf("more than %d decimal places", scale)
+	}
+
+	amount, err := decimal.NewFromString(s)
+	if err != nil {
+		return decimal.Decimal{}, fmt.Errorf("invalid number %q", s)
+	}
+	return amount, nil
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Status of a recorded transfer
+const TransactionCompleted = "completed"
+
+// Ledger entry for a single transfer
+type Transaction struct {
+	TransactionID        int64            `json:"transaction_id"`
+	SourceAccountID      int              `json:"source_account_id"`
+	DestinationAccountID int              `json:"destination_account_id"`
+	Currency             string           `json:"currency"`
+	Amount               decimal.Decimal  `json:"amount"`
+	DestinationCurrency  string           `json:"destination_currency"`
+	DestinationAmount    decimal.Decimal  `json:"destination_amount"`
+	FxRate               *decimal.Decimal `json:"fx_rate,omitempty"`
+	FxRemainder          *decimal.Decimal `json:"fx_remainder,omitempty"`
+	QuoteID              string           `json:"quote_id,omitempty"`
+	SourceBalance        decimal.Decimal  `json:"source_balance"`
+	DestinationBalance   decimal.Decimal  `json:"destination_balance"`
+	Status               string           `json:"status"`
+	CreatedAt            time.Time        `json:"created_at"`
+}
+
+// Transfer to execute, Amount is in the source account currency
+type TransferRequest struct {
+	SourceAccountID      int
+	DestinationAccountID int
+	Amount               decimal.Decimal
+
+	// Cross-currency transfers need either Convert for the current rate or a QuoteID for a locked one
+	Convert bool
+	QuoteID string
+}
+
+// Filters for listing an account's transactions, zero values are ignored
+type TransactionFilter struct {
+	From     time.Time
+	To       time.Time
+	BeforeID int64
+	Limit    int
+}
+
+// One page of transactions with the cursor for the next page
+type TransactionPage struct {
+	Transactions []Transaction `json:"transactions"`
+	NextCursor   string        `json:"next_cursor,omitempty"`
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Tier of accounts created without one, and of every account before tiers
+const TierStandard = "standard"
+
+// Longest tier name the accounts table holds
+const maxTierLength = 32
+
+// Most an account may send within any Window, checked with each transfer out of it
+type VelocityLimit struct {
+	Window time.Duration
+
+	// Transfers out of the account, 0 for no limit
+	MaxCount int
+
+	// Total amount sent, by the account's currency. Currencies not listed have no limit
+	MaxAmount map[string]decimal.Decimal
+}
+
+// Limits by account tier, accounts in a tier not listed have none
+type VelocityLimits map[string]VelocityLimit
+
+// Read VelocityLimits from a JSON file of tiers, e.g.
+// {"standard": {"window": "24h", "max_count": 20, "max_amount": {"SGD": "10000"}}}
+func LoadVelocityLimits(path string) (VelocityLimits, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file map[string]struct {
+		Window    string                     `json:"window"`
+		MaxCount  int                        `json:"max_count"`
+		MaxAmount map[string]decimal.Decimal `json:"max_amount"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("invalid velocity limits %s: %w", path, err)
+	}
+
+	limits := make(VelocityLimits, len(file))
+	for tier, l := range file {
+		if tier == "" || len(tier) > maxTierLength {
+			return nil, fmt.Errorf("invalid velocity limits %s: tier %q must be 1 to %d characters", path, tier, maxTierLength)
+		}
+		window, err := time.ParseDuration(l.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid velocity limits %s: window of %q must be a positive duration such as 24h", path, tier)
+		}
+		if l.MaxCount < 0 {
+			return nil, fmt.Errorf("invalid velocity limits %s: max_count of %q must not be negative", path, tier)
+		}
+		for currency, amount := range l.MaxAmount {
+			if _, ok := Currencies[currency]; !ok || !amount.IsPositive() {
+				return nil, fmt.Errorf("invalid velocity limits %s: max_amount of %q must be positive amounts of supported currencies, got %s %s", path, tier, currency, amount)
+			}
+		}
+		limits[tier] = VelocityLimit{Window: window, MaxCount: l.MaxCount, MaxAmount: l.MaxAmount}
+	}
+	return limits, nil
+}
@@ -0,0 +1,366 @@
+package store
+
+import (
+	"context"
+	"httpserver/models"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Store held entirely in process memory, for development and tests.
+// Transactions are serialized by a single lock and staged until they commit
+type Memory struct {
+	mu           sync.RWMutex
+	accounts     map[int]models.Account
+	transactions []models.Transaction
+	journal      []models.JournalEntry
+	quotes       map[string]*memoryQuote
+	keys         map[string]*memoryKey
+	apiKeys      map[string]models.APIKey
+	closed       bool
+}
+
+type memoryQuote struct {
+	quote models.FxQuote
+	used  bool
+}
+
+type memoryKey struct {
+	record    models.IdempotencyRecord
+	expiresAt time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		accounts: map[int]models.Account{},
+		quotes:   map[string]*memoryQuote{},
+		keys:     map[string]*memoryKey{},
+		apiKeys:  map[string]models.APIKey{},
+	}
+}
+
+func (m *Memory) GetAccount(ctx context.Context, accountID int) (*models.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	acc, ok := m.accounts[accountID]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return &acc, nil
+}
+
+func (m *Memory) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tx := &memoryTx{m: m, accounts: map[int]models.Account{}, usedQuotes: map[string]bool{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	// Like a database, a request that gave up before the commit leaves nothing behind
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Commit the staged changes
+	for id, acc := range tx.accounts {
+		m.accounts[id] = acc
+	}
+	m.transactions = append(m.transactions, tx.transactions...)
+	m.journal = append(m.journal, tx.journal...)
+	for id := range tx.usedQuotes {
+		m.quotes[id].used = true
+	}
+	return nil
+}
+
+// Transactions hold the write lock, so taking it waits for them. The data stays readable for SaveSnapshot
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	return nil
+}
+
+// Changes made within one WithTx, only applied if it succeeds
+type memoryTx struct {
+	m            *Memory
+	accounts     map[int]models.Account
+	transactions []models.Transaction
+	journal      []models.JournalEntry
+	usedQuotes   map[string]bool
+}
+
+// Current state of an account as seen inside the transaction
+func (t *memoryTx) account(accountID int) (models.Account, bool) {
+	if acc, ok := t.accounts[accountID]; ok {
+		return acc, true
+	}
+	acc, ok := t.m.accounts[accountID]
+	return acc, ok
+}
+
+func (t *memoryTx) CreateAccount(account models.Account) error {
+	if _, exists := t.account(account.AccountID); exists {
+		return ErrDuplicateAccount
+	}
+
+	// Same as the CHECK constraint of the SQL stores
+	if account.CurrentBalance.IsNegative() {
+		return ErrConstraint
+	}
+	t.accounts[account.AccountID] = account
+	return nil
+}
+
+// Every transaction already holds the store lock
+func (t *memoryTx) LockAccount(accountID int) (*models.Account, error) {
+	acc, ok := t.account(accountID)
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return &acc, nil
+}
+
+func (t *memoryTx) Debit(accountID int, amount decimal.Decimal) (decimal.Decimal, error) {
+	acc, ok := t.account(accountID)
+	if !ok || acc.CurrentBalance.LessThan(amount) {
+		return decimal.Decimal{}, ErrInsufficientBalance
+	}
+	acc.CurrentBalance = acc.CurrentBalance.Sub(amount)
+	t.accounts[accountID] = acc
+	return acc.CurrentBalance, nil
+}
+
+func (t *memoryTx) Credit(accountID int, amount decimal.Decimal) (decimal.Decimal, error) {
+	acc, ok := t.account(accountID)
+	if !ok {
+		return decimal.Decimal{}, ErrAccountNotFound
+	}
+	acc.CurrentBalance = acc.CurrentBalance.Add(amount)
+	t.accounts[accountID] = acc
+	return acc.CurrentBalance, nil
+}
+
+func (t *memoryTx) InsertTransaction(record *models.Transaction) error {
+	record.TransactionID = int64(len(t.m.transactions) + len(t.transactions) + 1)
+	record.CreatedAt = time.Now().UTC()
+	t.transactions = append(t.transactions, *record)
+	return nil
+}
+
+func (t *memoryTx) InsertJournalEntry(kind string, transactionID *int64, postings []models.Posting) (int64, error) {
+	entry := models.JournalEntry{
+		JournalEntryID: int64(len(t.m.journal) + len(t.journal) + 1),
+		Kind:           kind,
+		TransactionID:  transactionID,
+		Postings:       append([]models.Posting(nil), postings...),
+		CreatedAt:      time.Now().UTC(),
+	}
+	t.journal = append(t.journal, entry)
+	return entry.JournalEntryID, nil
+}
+
+func (t *memoryTx) ClaimFxQuote(quoteID string) (*models.FxQuote, error) {
+	q, ok := t.m.quotes[quoteID]
+	if !ok || q.used || t.usedQuotes[quoteID] {
+		return nil, ErrQuoteNotFound
+	}
+	t.usedQuotes[quoteID] = true
+	quote := q.quote
+	return &quote, nil
+}
+
+// Transfers are appended in creation order, so the scan stops at the first one before since
+func (t *memoryTx) TransfersOutSince(accountID int, since time.Time) (int, decimal.Decimal, error) {
+	count, total := 0, decimal.Zero
+	for _, transactions := range [][]models.Transaction{t.transactions, t.m.transactions} {
+		for i := len(transactions) - 1; i >= 0 && !transactions[i].CreatedAt.Before(since); i-- {
+			if transactions[i].SourceAccountID == accountID {
+				count++
+				total = total.Add(transactions[i].Amount)
+			}
+		}
+	}
+	return count, total, nil
+}
+
+func (m *Memory) GetTransaction(ctx context.Context, transactionID int64) (*models.Transaction, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if transactionID < 1 || transactionID > int64(len(m.transactions)) {
+		return nil, ErrTransactionNotFound
+	}
+	t := m.transactions[transactionID-1]
+	return &t, nil
+}
+
+func (m *Memory) ListAccountTransactions(ctx context.Context, accountID int, filter models.TransactionFilter) ([]models.Transaction, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Newest first, IDs follow insertion order
+	transactions := []models.Transaction{}
+	for i := len(m.transactions) - 1; i >= 0 && len(transactions) < filter.Limit; i-- {
+		t := m.transactions[i]
+		switch {
+		case t.SourceAccountID != accountID && t.DestinationAccountID != accountID,
+			!filter.From.IsZero() && t.CreatedAt.Before(filter.From),
+			!filter.To.IsZero() && !t.CreatedAt.Before(filter.To),
+			filter.BeforeID > 0 && t.TransactionID >= filter.BeforeID:
+			continue
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, nil
+}
+
+func (m *Memory) Reconcile(ctx context.Context) (*models.ReconciliationReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	balances := make(map[int]decimal.Decimal, len(m.accounts))
+	for id, acc := range m.accounts {
+		balances[id] = acc.CurrentBalance
+	}
+	return reconcile(balances, m.journal), nil
+}
+
+func (m *Memory) CreateFxQuote(ctx context.Context, quote *models.FxQuote) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.quotes[quote.QuoteID] = &memoryQuote{quote: *quote}
+	return nil
+}
+
+func (m *Memory) ClaimIdempotencyKey(ctx context.Context, key string, fingerprint string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Expired keys are treated as never seen
+	if k, ok := m.keys[key]; ok && !k.expiresAt.After(time.Now()) {
+		delete(m.keys, key)
+	}
+	if _, ok := m.keys[key]; ok {
+		return false, nil
+	}
+	m.keys[key] = &memoryKey{record: models.IdempotencyRecord{Key: key, Fingerprint: fingerprint}, expiresAt: expiresAt}
+	return true, nil
+}
+
+func (m *Memory) GetIdempotencyKey(ctx context.Context, key string) (*models.IdempotencyRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	k, ok := m.keys[key]
+	if !ok {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+	record := k.record
+	return &record, nil
+}
+
+func (m *Memory) CompleteIdempotencyKey(ctx context.Context, key string, statusCode int, contentType string, body []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if k, ok := m.keys[key]; ok {
+		k.record.StatusCode = statusCode
+		k.record.ContentType = contentType
+		k.record.Body = append([]byte(nil), body...)
+	}
+	return nil
+}
+
+func (m *Memory) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.keys, key)
+	return nil
+}
+
+func (m *Memory) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged int64
+	now := time.Now()
+	for key, k := range m.keys {
+		if !k.expiresAt.After(now) {
+			delete(m.keys, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (m *Memory) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.apiKeys[key.KeyID]; ok {
+		return ErrConflict
+	}
+	key.CreatedAt = time.Now().UTC()
+	m.apiKeys[key.KeyID] = *key
+	return nil
+}
+
+func (m *Memory) GetAPIKey(ctx context.Context, keyID string) (*models.APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, ok := m.apiKeys[keyID]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &key, nil
+}
+
+func (m *Memory) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]models.APIKey, 0, len(m.apiKeys))
+	for _, key := range m.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].KeyID < keys[j].KeyID
+	})
+	return keys, nil
+}
+
+func (m *Memory) RevokeAPIKey(ctx context.Context, keyID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.apiKeys[keyID]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	if key.RevokedAt == nil {
+		now := time.Now().UTC()
+		key.RevokedAt = &now
+		m.apiKeys[keyID] = key
+	}
+	return nil
+}
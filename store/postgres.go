@@ -0,0 +1,291 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"httpserver/models"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
+)
+
+// Store backed by a Postgres database
+type Postgres struct {
+	sqlStore
+}
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{sqlStore: sqlStore{db: db, classify: postgresError}}
+}
+
+// Classify a Postgres failure by its SQLSTATE, anything unrecognised is left as is
+func postgresError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == "23505": // unique_violation
+			return &dbError{ErrConflict, err}
+		case pqErr.Code.Class() == "23", pqErr.Code == "22003": // integrity_constraint_violation, numeric_value_out_of_range
+			return &dbError{ErrConstraint, err}
+		case pqErr.Code == "40001", pqErr.Code == "40P01": // serialization_failure, deadlock_detected
+			return &dbError{ErrSerialization, err}
+		case pqErr.Code.Class() == "08", pqErr.Code.Class() == "53": // connection_exception, insufficient_resources
+			return &dbError{ErrUnavailable, err}
+		case pqErr.Code == "57P01", pqErr.Code == "57P02", pqErr.Code == "57P03": // admin_shutdown, crash_shutdown, cannot_connect_now
+			return &dbError{ErrUnavailable, err}
+		}
+		return err
+	}
+
+	// No connection to the server at all
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr) {
+		return &dbError{ErrUnavailable, err}
+	}
+	return err
+}
+
+func (p *Postgres) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	return p.track(func() error {
+
+		// DB begin
+		tx, err := p.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		// No-op once committed
+		defer tx.Rollback()
+
+		if err := fn(&postgresTx{ctx: ctx, tx: tx}); err != nil {
+			return err
+		}
+
+		// Commit if all successful
+		return tx.Commit()
+	})
+}
+
+type postgresTx struct {
+	ctx context.Context
+	tx  *sql.Tx
+}
+
+func (t *postgresTx) CreateAccount(account models.Account) error {
+	_, err := t.tx.ExecContext(t.ctx, "INSERT INTO accounts (account_id, balance, currency, owner, tier) VALUES ($1, $2, $3, $4, $5)", account.AccountID, account.CurrentBalance, account.Currency, account.Owner, account.Tier)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrDuplicateAccount
+	}
+	return err
+}
+
+func (t *postgresTx) LockAccount(accountID int) (*models.Account, error) {
+	acc := &models.Account{AccountID: accountID}
+	err := scanAccount(t.tx.QueryRowContext(t.ctx, "SELECT "+accountColumns+" FROM accounts WHERE account_id = $1 FOR UPDATE", accountID), acc)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// Update relative to the locked balance, the guard rules out overdrafts regardless
+func (t *postgresTx) Debit(accountID int, amount decimal.Decimal) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := t.tx.QueryRowContext(t.ctx,
+		"UPDATE accounts SET balance = balance - $1 WHERE account_id = $2 AND balance >= $1 RETURNING balance",
+		amount, accountID,
+	).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return balance, ErrInsufficientBalance
+	}
+	return balance, err
+}
+
+func (t *postgresTx) Credit(accountID int, amount decimal.Decimal) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := t.tx.QueryRowContext(t.ctx,
+		"UPDATE accounts SET balance = balance + $1 WHERE account_id = $2 RETURNING balance",
+		amount, accountID,
+	).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return balance, ErrAccountNotFound
+	}
+	return balance, err
+}
+
+func (t *postgresTx) InsertTransaction(record *models.Transaction) error {
+	return t.tx.QueryRowContext(t.ctx,
+		`INSERT INTO transactions (source_account_id, destination_account_id, currency, amount,
+			destination_currency, destination_amount, fx_rate, fx_remainder, quote_id,
+			source_balance, destination_balance, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id, created_at`,
+		record.SourceAccountID, record.DestinationAccountID, record.Currency, record.Amount,
+		record.DestinationCurrency, record.DestinationAmount, record.FxRate, record.FxRemainder, sql.NullString{String: record.QuoteID, Valid: record.QuoteID != ""},
+		record.SourceBalance, record.DestinationBalance, record.Status,
+	).Scan(&record.TransactionID, &record.CreatedAt)
+}
+
+func (t *postgresTx) InsertJournalEntry(kind string, transactionID *int64, postings []models.Posting) (int64, error) {
+	var journalEntryID int64
+	err := t.tx.QueryRowContext(t.ctx,
+		"INSERT INTO journal_entries (kind, transaction_id) VALUES ($1, $2) RETURNING id",
+		kind, transactionID,
+	).Scan(&journalEntryID)
+	if err != nil {
+		return 0, err
+	}
+
+	// All postings in a single statement
+	values := make([]string, 0, len(postings))
+	args := []any{journalEntryID}
+	for _, p := range postings {
+		args = append(args, p.AccountID, p.Currency, p.Amount)
+		values = append(values, fmt.Sprintf("($1, $%d, $%d, $%d)", len(args)-2, len(args)-1, len(args)))
+	}
+	_, err = t.tx.ExecContext(t.ctx, "INSERT INTO postings (journal_entry_id, account_id, currency, amount) VALUES "+strings.Join(values, ", "), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return journalEntryID, nil
+}
+
+func (t *postgresTx) ClaimFxQuote(quoteID string) (*models.FxQuote, error) {
+	quote := &models.FxQuote{QuoteID: quoteID}
+	err := t.tx.QueryRowContext(t.ctx,
+		`UPDATE fx_quotes SET used_at = now() WHERE id = $1 AND used_at IS NULL
+		RETURNING source_currency, destination_currency, amount, rate, expires_at`,
+		quoteID,
+	).Scan(&quote.SourceCurrency, &quote.DestinationCurrency, &quote.Amount, &quote.Rate, &quote.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrQuoteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
+
+// The source row is locked, so no other transfer out of it can commit in between
+func (t *postgresTx) TransfersOutSince(accountID int, since time.Time) (int, decimal.Decimal, error) {
+	return transfersOutSince(t.ctx, t.tx, accountID, since)
+}
+
+func (p *Postgres) Reconcile(ctx context.Context) (report *models.ReconciliationReport, err error) {
+	err = p.track(func() error {
+		report, err = p.reconciliation(ctx)
+		return err
+	})
+	return report, err
+}
+
+func (p *Postgres) reconciliation(ctx context.Context) (*models.ReconciliationReport, error) {
+
+	// Read everything from one consistent snapshot
+	tx, err := p.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, p.dbErr(err)
+	}
+	defer tx.Rollback()
+
+	report := &models.ReconciliationReport{
+		CheckedAt:         time.Now().UTC(),
+		Mismatches:        []models.BalanceMismatch{},
+		UnbalancedEntries: []models.UnbalancedEntry{},
+	}
+
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM accounts").Scan(&report.AccountsChecked); err != nil {
+		return nil, p.dbErr(err)
+	}
+
+	// Accounts whose cached balance differs from their postings
+	rows, err := tx.QueryContext(ctx, `
+		SELECT a.account_id, a.balance, COALESCE(p.total, 0)
+		FROM accounts a
+		LEFT JOIN (SELECT account_id, SUM(amount) AS total FROM postings GROUP BY account_id) p
+			ON p.account_id = a.account_id
+		WHERE a.balance <> COALESCE(p.total, 0)
+		ORDER BY a.account_id`)
+	if err != nil {
+		return nil, p.dbErr(err)
+	}
+	for rows.Next() {
+		var m models.BalanceMismatch
+		if err := rows.Scan(&m.AccountID, &m.CachedBalance, &m.PostedBalance); err != nil {
+			rows.Close()
+			return nil, p.dbErr(err)
+		}
+		m.Difference = m.CachedBalance.Sub(m.PostedBalance)
+		report.Mismatches = append(report.Mismatches, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, p.dbErr(err)
+	}
+
+	// Journal entries that do not balance in some currency
+	rows, err = tx.QueryContext(ctx, `
+		SELECT journal_entry_id, currency, SUM(amount)
+		FROM postings
+		GROUP BY journal_entry_id, currency
+		HAVING SUM(amount) <> 0
+		ORDER BY journal_entry_id, currency`)
+	if err != nil {
+		return nil, p.dbErr(err)
+	}
+	for rows.Next() {
+		var e models.UnbalancedEntry
+		if err := rows.Scan(&e.JournalEntryID, &e.Currency, &e.Total); err != nil {
+			rows.Close()
+			return nil, p.dbErr(err)
+		}
+		report.UnbalancedEntries = append(report.UnbalancedEntries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, p.dbErr(err)
+	}
+
+	report.Balanced = len(report.Mismatches) == 0 && len(report.UnbalancedEntries) == 0
+	return report, nil
+}
+
+func (p *Postgres) ClaimIdempotencyKey(ctx context.Context, key string, fingerprint string, expiresAt time.Time) (bool, error) {
+
+	// Expired keys are treated as never seen
+	_, err := p.exec(ctx, "DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND expires_at <= now()", key)
+	if err != nil {
+		return false, p.dbErr(err)
+	}
+
+	// Only one request can insert the key
+	res, err := p.exec(ctx,
+		"INSERT INTO idempotency_keys (idempotency_key, fingerprint, expires_at) VALUES ($1, $2, $3) ON CONFLICT (idempotency_key) DO NOTHING",
+		key, fingerprint, expiresAt,
+	)
+	if err != nil {
+		return false, p.dbErr(err)
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return false, p.dbErr(err)
+	}
+	return claimed == 1, nil
+}
+
+func (p *Postgres) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	res, err := p.exec(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= now()")
+	if err != nil {
+		return 0, p.dbErr(err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"httpserver/models"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Check cached balances against the journal in Go, for stores that cannot sum exactly themselves
+func reconcile(balances map[int]decimal.Decimal, journal []models.JournalEntry) *models.ReconciliationReport {
+	report := &models.ReconciliationReport{
+		CheckedAt:         time.Now().UTC(),
+		AccountsChecked:   len(balances),
+		Mismatches:        []models.BalanceMismatch{},
+		UnbalancedEntries: []models.UnbalancedEntry{},
+	}
+
+	// Sum postings per account and per entry and currency
+	posted := map[int]decimal.Decimal{}
+	for _, entry := range journal {
+		totals := map[string]decimal.Decimal{}
+		for _, p := range entry.Postings {
+			posted[p.AccountID] = posted[p.AccountID].Add(p.Amount)
+			totals[p.Currency] = totals[p.Currency].Add(p.Amount)
+		}
+		for currency, total := range totals {
+			if !total.IsZero() {
+				report.UnbalancedEntries = append(report.UnbalancedEntries, models.UnbalancedEntry{JournalEntryID: entry.JournalEntryID, Currency: currency, Total: total})
+			}
+		}
+	}
+
+	// Accounts whose cached balance differs from their postings
+	for id, balance := range balances {
+		if !balance.Equal(posted[id]) {
+			report.Mismatches = append(report.Mismatches, models.BalanceMismatch{
+				AccountID:     id,
+				CachedBalance: balance,
+				PostedBalance: posted[id],
+				Difference:    balance.Sub(posted[id]),
+			})
+		}
+	}
+
+	// Same order as the Postgres report
+	sort.Slice(report.Mismatches, func(i, j int) bool { return report.Mismatches[i].AccountID < report.Mismatches[j].AccountID })
+	sort.Slice(report.UnbalancedEntries, func(i, j int) bool {
+		a, b := report.UnbalancedEntries[i], report.UnbalancedEntries[j]
+		if a.JournalEntryID != b.JournalEntryID {
+			return a.JournalEntryID < b.JournalEntryID
+		}
+		return a.Currency < b.Currency
+	})
+
+	report.Balanced = len(report.Mismatches) == 0 && len(report.UnbalancedEntries) == 0
+	return report
+}
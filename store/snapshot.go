@@ -0,0 +1,155 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"httpserver/models"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// On-disk form of a Memory store
+type memorySnapshot struct {
+	SavedAt         time.Time             `json:"saved_at"`
+	Accounts        []models.Account      `json:"accounts"`
+	Transactions    []models.Transaction  `json:"transactions"`
+	Journal         []models.JournalEntry `json:"journal"`
+	Quotes          []snapshotQuote       `json:"fx_quotes"`
+	IdempotencyKeys []snapshotKey         `json:"idempotency_keys"`
+	APIKeys         []models.APIKey       `json:"api_keys"`
+}
+
+type snapshotQuote struct {
+	models.FxQuote
+	Used bool `json:"used"`
+}
+
+type snapshotKey struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Write the whole store to path, replacing the file only once the new one is complete
+func (m *Memory) SaveSnapshot(path string) error {
+	m.mu.RLock()
+	snapshot := memorySnapshot{
+		SavedAt:         time.Now().UTC(),
+		Accounts:        make([]models.Account, 0, len(m.accounts)),
+		Transactions:    m.transactions,
+		Journal:         m.journal,
+		Quotes:          make([]snapshotQuote, 0, len(m.quotes)),
+		IdempotencyKeys: make([]snapshotKey, 0, len(m.keys)),
+		APIKeys:         make([]models.APIKey, 0, len(m.apiKeys)),
+	}
+	for _, acc := range m.accounts {
+		snapshot.Accounts = append(snapshot.Accounts, acc)
+	}
+	for _, q := range m.quotes {
+		snapshot.Quotes = append(snapshot.Quotes, snapshotQuote{FxQuote: q.quote, Used: q.used})
+	}
+	for _, k := range m.keys {
+		snapshot.IdempotencyKeys = append(snapshot.IdempotencyKeys, snapshotKey{
+			Key:         k.record.Key,
+			Fingerprint: k.record.Fingerprint,
+			StatusCode:  k.record.StatusCode,
+			ContentType: k.record.ContentType,
+			Body:        k.record.Body,
+			ExpiresAt:   k.expiresAt,
+		})
+	}
+	for _, key := range m.apiKeys {
+		snapshot.APIKeys = append(snapshot.APIKeys, key)
+	}
+	raw, err := json.Marshal(snapshot)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load a store saved by SaveSnapshot, a missing file gives an empty store
+func LoadMemorySnapshot(path string) (*Memory, error) {
+	m := NewMemory()
+
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot memorySnapshot
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", path, err)
+	}
+
+	// IDs are positions in the slices, so they must run 1, 2, 3...
+	for i, t := range snapshot.Transactions {
+		if t.TransactionID != int64(i+1) {
+			return nil, fmt.Errorf("invalid snapshot %s: transaction %d out of sequence", path, t.TransactionID)
+		}
+	}
+	for i, e := range snapshot.Journal {
+		if e.JournalEntryID != int64(i+1) {
+			return nil, fmt.Errorf("invalid snapshot %s: journal entry %d out of sequence", path, e.JournalEntryID)
+		}
+	}
+
+	for _, acc := range snapshot.Accounts {
+		// Accounts saved before tiers are standard, as the migration makes them
+		if acc.Tier == "" {
+			acc.Tier = models.TierStandard
+		}
+		m.accounts[acc.AccountID] = acc
+	}
+	m.transactions = snapshot.Transactions
+	m.journal = snapshot.Journal
+	for _, q := range snapshot.Quotes {
+		m.quotes[q.QuoteID] = &memoryQuote{quote: q.FxQuote, used: q.Used}
+	}
+	for _, k := range snapshot.IdempotencyKeys {
+		m.keys[k.Key] = &memoryKey{
+			record: models.IdempotencyRecord{
+				Key:         k.Key,
+				Fingerprint: k.Fingerprint,
+				StatusCode:  k.StatusCode,
+				ContentType: k.ContentType,
+				Body:        k.Body,
+			},
+			expiresAt: k.ExpiresAt,
+		}
+	}
+	for _, key := range snapshot.APIKeys {
+		// Keys saved before roles keep full access, as the migration gives them
+		if key.Role == "" {
+			key.Role = models.RoleAdmin
+		}
+		m.apiKeys[key.KeyID] = key
+	}
+	return m, nil
+}
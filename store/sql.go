@@ -0,0 +1,312 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"httpserver/models"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Queries that read the same on every SQL database
+type sqlStore struct {
+	db *sql.DB
+
+	// Classifies driver errors into the store's errors, set by each database
+	classify func(err error) error
+
+	// Held for reading by every transaction and for writing by Close
+	closing sync.RWMutex
+	closed  bool
+
+	// Set by databases with a single write lock, SQLite. Only one write can hold it,
+	// the others of this process wait here for as long as their context allows rather than at most busy_timeout
+	writer chan struct{}
+}
+
+// Run a transaction or query unless the store is closed, Close waits for it to finish
+func (s *sqlStore) track(fn func() error) error {
+	s.closing.RLock()
+	defer s.closing.RUnlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return s.dbErr(fn())
+}
+
+// Wait for this process's turn at the write lock, the returned function gives it back.
+// Databases without one return at once
+func (s *sqlStore) lockWriter(ctx context.Context) (func(), error) {
+	if s.writer == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.writer <- struct{}{}:
+		return func() { <-s.writer }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Run a single write statement outside a transaction, under the write lock where there is one
+func (s *sqlStore) exec(ctx context.Context, query string, args ...any) (res sql.Result, err error) {
+	err = s.track(func() error {
+		unlock, err := s.lockWriter(ctx)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		res, err = s.db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
+}
+
+// Translate a driver error for the caller, nil and already known errors pass through
+func (s *sqlStore) dbErr(err error) error {
+	var known *dbError
+	if err == nil || s.classify == nil || errors.As(err, &known) {
+		return err
+	}
+	return s.classify(err)
+}
+
+func (s *sqlStore) Close() error {
+	s.closing.Lock()
+	defer s.closing.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.db.Close()
+}
+
+const accountColumns = "balance, currency, owner, tier"
+
+// Scan an accounts row selected with accountColumns
+func scanAccount(row interface{ Scan(...any) error }, acc *models.Account) error {
+	return row.Scan(&acc.CurrentBalance, &acc.Currency, &acc.Owner, &acc.Tier)
+}
+
+// Count and add up the transfers out of an account since a time, in UTC as SQLite compares timestamps as text.
+// Amounts are added here as SQLite would sum them as floats
+func transfersOutSince(ctx context.Context, tx *sql.Tx, accountID int, since time.Time) (int, decimal.Decimal, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT amount FROM transactions WHERE source_account_id = $1 AND created_at >= $2", accountID, since.UTC())
+	if err != nil {
+		return 0, decimal.Decimal{}, err
+	}
+	defer rows.Close()
+
+	count, total := 0, decimal.Zero
+	for rows.Next() {
+		var amount decimal.Decimal
+		if err := rows.Scan(&amount); err != nil {
+			return 0, decimal.Decimal{}, err
+		}
+		count++
+		total = total.Add(amount)
+	}
+	return count, total, rows.Err()
+}
+
+func (s *sqlStore) GetAccount(ctx context.Context, accountID int) (*models.Account, error) {
+	acc := &models.Account{AccountID: accountID}
+	err := s.track(func() error {
+		return scanAccount(s.db.QueryRowContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE account_id = $1", accountID), acc)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, s.dbErr(err)
+	}
+	return acc, nil
+}
+
+// Transfers recorded before FX support have no destination amount of their own
+const transactionColumns = `id, source_account_id, destination_account_id, currency, amount,
+	COALESCE(destination_currency, currency), COALESCE(destination_amount, amount), fx_rate, fx_remainder,
+	COALESCE(quote_id, ''), source_balance, destination_balance, status, created_at`
+
+// Scan a transactions row selected with transactionColumns
+func scanTransaction(row interface{ Scan(...any) error }, t *models.Transaction) error {
+	return row.Scan(
+		&t.TransactionID, &t.SourceAccountID, &t.DestinationAccountID, &t.Currency, &t.Amount,
+		&t.DestinationCurrency, &t.DestinationAmount, &t.FxRate, &t.FxRemainder,
+		&t.QuoteID, &t.SourceBalance, &t.DestinationBalance, &t.Status, &t.CreatedAt,
+	)
+}
+
+func (s *sqlStore) GetTransaction(ctx context.Context, transactionID int64) (*models.Transaction, error) {
+	var t models.Transaction
+	err := s.track(func() error {
+		return scanTransaction(s.db.QueryRowContext(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE id = $1", transactionID), &t)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrTransactionNotFound
+	}
+	if err != nil {
+		return nil, s.dbErr(err)
+	}
+	return &t, nil
+}
+
+func (s *sqlStore) ListAccountTransactions(ctx context.Context, accountID int, filter models.TransactionFilter) ([]models.Transaction, error) {
+
+	// Build the filters that were provided, in UTC as SQLite compares timestamps as text
+	query := "SELECT " + transactionColumns + " FROM transactions WHERE (source_account_id = $1 OR destination_account_id = $1)"
+	args := []any{accountID}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From.UTC())
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To.UTC())
+		query += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+	if filter.BeforeID > 0 {
+		args = append(args, filter.BeforeID)
+		query += fmt.Sprintf(" AND id < $%d", len(args))
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	transactions := []models.Transaction{}
+	err := s.track(func() error {
+		rows, err := s.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var t models.Transaction
+			if err := scanTransaction(rows, &t); err != nil {
+				return err
+			}
+			transactions = append(transactions, t)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+func (s *sqlStore) CreateFxQuote(ctx context.Context, quote *models.FxQuote) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO fx_quotes (id, source_currency, destination_currency, amount, rate, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		quote.QuoteID, quote.SourceCurrency, quote.DestinationCurrency, quote.Amount, quote.Rate, quote.ExpiresAt,
+	)
+	return s.dbErr(err)
+}
+
+func (s *sqlStore) GetIdempotencyKey(ctx context.Context, key string) (*models.IdempotencyRecord, error) {
+	record := &models.IdempotencyRecord{Key: key}
+	var contentType sql.NullString
+	var status sql.NullInt64
+	err := s.track(func() error {
+		return s.db.QueryRowContext(ctx,
+			"SELECT fingerprint, status_code, content_type, response_body FROM idempotency_keys WHERE idempotency_key = $1",
+			key,
+		).Scan(&record.Fingerprint, &status, &contentType, &record.Body)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+	if err != nil {
+		return nil, s.dbErr(err)
+	}
+	record.StatusCode = int(status.Int64)
+	record.ContentType = contentType.String
+	return record, nil
+}
+
+func (s *sqlStore) CompleteIdempotencyKey(ctx context.Context, key string, statusCode int, contentType string, body []byte) error {
+	_, err := s.exec(ctx,
+		"UPDATE idempotency_keys SET status_code = $2, content_type = $3, response_body = $4 WHERE idempotency_key = $1",
+		key, statusCode, contentType, body,
+	)
+	return s.dbErr(err)
+}
+
+func (s *sqlStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := s.exec(ctx, "DELETE FROM idempotency_keys WHERE idempotency_key = $1", key)
+	return s.dbErr(err)
+}
+
+const apiKeyColumns = "key_id, name, secret_hash, signing_key, require_signature, role, created_at, revoked_at"
+
+func scanAPIKey(row interface{ Scan(...any) error }, key *models.APIKey) error {
+	return row.Scan(&key.KeyID, &key.Name, &key.SecretHash, &key.SigningKey, &key.RequireSignature, &key.Role, &key.CreatedAt, &key.RevokedAt)
+}
+
+func (s *sqlStore) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	key.CreatedAt = time.Now().UTC()
+	_, err := s.exec(ctx,
+		"INSERT INTO api_keys (key_id, name, secret_hash, signing_key, require_signature, role, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		key.KeyID, key.Name, key.SecretHash, key.SigningKey, key.RequireSignature, key.Role, key.CreatedAt,
+	)
+	return s.dbErr(err)
+}
+
+func (s *sqlStore) GetAPIKey(ctx context.Context, keyID string) (*models.APIKey, error) {
+	key := &models.APIKey{}
+	err := s.track(func() error {
+		return scanAPIKey(s.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE key_id = $1", keyID), key)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, s.dbErr(err)
+	}
+	return key, nil
+}
+
+func (s *sqlStore) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	keys := []models.APIKey{}
+	err := s.track(func() error {
+		rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY created_at, key_id")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var key models.APIKey
+			if err := scanAPIKey(rows, &key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *sqlStore) RevokeAPIKey(ctx context.Context, keyID string) error {
+	res, err := s.exec(ctx, "UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $2) WHERE key_id = $1", keyID, time.Now().UTC())
+	if err != nil {
+		return s.dbErr(err)
+	}
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return s.dbErr(err)
+	}
+	if revoked == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
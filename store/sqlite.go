@@ -0,0 +1,315 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"httpserver/models"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Store backed by a single SQLite file, for deployments without a database server.
+// Amounts are kept as text and added up in Go, and every transaction takes the write lock when it begins
+type SQLite struct {
+	sqlStore
+}
+
+func NewSQLite(db *sql.DB) *SQLite {
+	return &SQLite{sqlStore: sqlStore{db: db, classify: sqliteError, writer: make(chan struct{}, 1)}}
+}
+
+// Classify a SQLite failure by its extended result code, anything unrecognised is left as is
+func sqliteError(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+	switch sqliteErr.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY, sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+		return &dbError{ErrConflict, err}
+	case sqlite3.SQLITE_CONSTRAINT_CHECK, sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY, sqlite3.SQLITE_CONSTRAINT_NOTNULL:
+		return &dbError{ErrConstraint, err}
+	}
+
+	// Still locked once busy_timeout ran out
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return &dbError{ErrUnavailable, err}
+	}
+	return err
+}
+
+// Open the SQLite file at path, creating it if needed.
+// Transactions begin immediate so concurrent transfers queue on the write lock instead of failing with SQLITE_BUSY
+func OpenSQLite(path string) (*sql.DB, error) {
+	params := url.Values{}
+	params.Add("_pragma", "busy_timeout(10000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Set("_txlock", "immediate")
+	params.Set("_time_format", "sqlite")
+	return sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+}
+
+// Timestamps are always written in UTC so they sort as text
+func sqliteNow() time.Time {
+	return time.Now().UTC()
+}
+
+func (s *SQLite) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	return s.track(func() error {
+		unlock, err := s.lockWriter(ctx)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		// No-op once committed
+		defer tx.Rollback()
+
+		if err := fn(&sqliteTx{ctx: ctx, tx: tx}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+type sqliteTx struct {
+	ctx context.Context
+	tx  *sql.Tx
+}
+
+func (t *sqliteTx) CreateAccount(account models.Account) error {
+	_, err := t.tx.ExecContext(t.ctx, "INSERT INTO accounts (account_id, balance, currency, owner, tier) VALUES ($1, $2, $3, $4, $5)", account.AccountID, account.CurrentBalance, account.Currency, account.Owner, account.Tier)
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+		return ErrDuplicateAccount
+	}
+	return err
+}
+
+// The transaction already holds the database write lock
+func (t *sqliteTx) LockAccount(accountID int) (*models.Account, error) {
+	acc := &models.Account{AccountID: accountID}
+	err := scanAccount(t.tx.QueryRowContext(t.ctx, "SELECT "+accountColumns+" FROM accounts WHERE account_id = $1", accountID), acc)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+func (t *sqliteTx) setBalance(accountID int, balance decimal.Decimal) error {
+	_, err := t.tx.ExecContext(t.ctx, "UPDATE accounts SET balance = $1 WHERE account_id = $2", balance, accountID)
+	return err
+}
+
+func (t *sqliteTx) Debit(accountID int, amount decimal.Decimal) (decimal.Decimal, error) {
+	acc, err := t.LockAccount(accountID)
+	if err == ErrAccountNotFound {
+		return decimal.Decimal{}, ErrInsufficientBalance
+	}
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	if acc.CurrentBalance.LessThan(amount) {
+		return decimal.Decimal{}, ErrInsufficientBalance
+	}
+	balance := acc.CurrentBalance.Sub(amount)
+	return balance, t.setBalance(accountID, balance)
+}
+
+func (t *sqliteTx) Credit(accountID int, amount decimal.Decimal) (decimal.Decimal, error) {
+	acc, err := t.LockAccount(accountID)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	balance := acc.CurrentBalance.Add(amount)
+	return balance, t.setBalance(accountID, balance)
+}
+
+func (t *sqliteTx) InsertTransaction(record *models.Transaction) error {
+	record.CreatedAt = sqliteNow()
+	return t.tx.QueryRowContext(t.ctx,
+		`INSERT INTO transactions (source_account_id, destination_account_id, currency, amount,
+			destination_currency, destination_amount, fx_rate, fx_remainder, quote_id,
+			source_balance, destination_balance, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id`,
+		record.SourceAccountID, record.DestinationAccountID, record.Currency, record.Amount,
+		record.DestinationCurrency, record.DestinationAmount, record.FxRate, record.FxRemainder, sql.NullString{String: record.QuoteID, Valid: record.QuoteID != ""},
+		record.SourceBalance, record.DestinationBalance, record.Status, record.CreatedAt,
+	).Scan(&record.TransactionID)
+}
+
+func (t *sqliteTx) InsertJournalEntry(kind string, transactionID *int64, postings []models.Posting) (int64, error) {
+	var journalEntryID int64
+	err := t.tx.QueryRowContext(t.ctx,
+		"INSERT INTO journal_entries (kind, transaction_id, created_at) VALUES ($1, $2, $3) RETURNING id",
+		kind, transactionID, sqliteNow(),
+	).Scan(&journalEntryID)
+	if err != nil {
+		return 0, err
+	}
+
+	// All postings in a single statement
+	values := make([]string, 0, len(postings))
+	args := []any{journalEntryID}
+	for _, p := range postings {
+		args = append(args, p.AccountID, p.Currency, p.Amount)
+		values = append(values, fmt.Sprintf("($1, $%d, $%d, $%d)", len(args)-2, len(args)-1, len(args)))
+	}
+	_, err = t.tx.ExecContext(t.ctx, "INSERT INTO postings (journal_entry_id, account_id, currency, amount) VALUES "+strings.Join(values, ", "), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return journalEntryID, nil
+}
+
+// The transaction holds the database write lock, so no other transfer can commit in between
+func (t *sqliteTx) TransfersOutSince(accountID int, since time.Time) (int, decimal.Decimal, error) {
+	return transfersOutSince(t.ctx, t.tx, accountID, since)
+}
+
+func (t *sqliteTx) ClaimFxQuote(quoteID string) (*models.FxQuote, error) {
+	quote := &models.FxQuote{QuoteID: quoteID}
+	err := t.tx.QueryRowContext(t.ctx,
+		`UPDATE fx_quotes SET used_at = $2 WHERE id = $1 AND used_at IS NULL
+		RETURNING source_currency, destination_currency, amount, rate, expires_at`,
+		quoteID, sqliteNow(),
+	).Scan(&quote.SourceCurrency, &quote.DestinationCurrency, &quote.Amount, &quote.Rate, &quote.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrQuoteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
+
+func (s *SQLite) Reconcile(ctx context.Context) (report *models.ReconciliationReport, err error) {
+	err = s.track(func() error {
+		report, err = s.reconciliation(ctx)
+		return err
+	})
+	return report, err
+}
+
+func (s *SQLite) reconciliation(ctx context.Context) (*models.ReconciliationReport, error) {
+
+	// Read everything inside one transaction so writers cannot interleave
+	unlock, err := s.lockWriter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, s.dbErr(err)
+	}
+	defer tx.Rollback()
+
+	balances := map[int]decimal.Decimal{}
+	rows, err := tx.QueryContext(ctx, "SELECT account_id, balance FROM accounts")
+	if err != nil {
+		return nil, s.dbErr(err)
+	}
+	for rows.Next() {
+		var id int
+		var balance decimal.Decimal
+		if err := rows.Scan(&id, &balance); err != nil {
+			rows.Close()
+			return nil, s.dbErr(err)
+		}
+		balances[id] = balance
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, s.dbErr(err)
+	}
+
+	// Postings grouped back into their journal entries
+	journal := []models.JournalEntry{}
+	rows, err = tx.QueryContext(ctx, "SELECT journal_entry_id, account_id, currency, amount FROM postings ORDER BY journal_entry_id, id")
+	if err != nil {
+		return nil, s.dbErr(err)
+	}
+	for rows.Next() {
+		var entryID int64
+		var p models.Posting
+		if err := rows.Scan(&entryID, &p.AccountID, &p.Currency, &p.Amount); err != nil {
+			rows.Close()
+			return nil, s.dbErr(err)
+		}
+		if len(journal) == 0 || journal[len(journal)-1].JournalEntryID != entryID {
+			journal = append(journal, models.JournalEntry{JournalEntryID: entryID})
+		}
+		last := &journal[len(journal)-1]
+		last.Postings = append(last.Postings, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, s.dbErr(err)
+	}
+
+	return reconcile(balances, journal), nil
+}
+
+func (s *SQLite) ClaimIdempotencyKey(ctx context.Context, key string, fingerprint string, expiresAt time.Time) (claimed bool, err error) {
+	err = s.track(func() error {
+		claimed, err = s.claimIdempotencyKey(ctx, key, fingerprint, expiresAt)
+		return err
+	})
+	return claimed, err
+}
+
+func (s *SQLite) claimIdempotencyKey(ctx context.Context, key string, fingerprint string, expiresAt time.Time) (bool, error) {
+
+	// Both statements run under one turn at the write lock
+	unlock, err := s.lockWriter(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	// Expired keys are treated as never seen
+	_, err = s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND expires_at <= $2", key, sqliteNow())
+	if err != nil {
+		return false, s.dbErr(err)
+	}
+
+	// Only one request can insert the key
+	res, err := s.db.ExecContext(ctx,
+		"INSERT INTO idempotency_keys (idempotency_key, fingerprint, expires_at) VALUES ($1, $2, $3) ON CONFLICT (idempotency_key) DO NOTHING",
+		key, fingerprint, expiresAt.UTC(),
+	)
+	if err != nil {
+		return false, s.dbErr(err)
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return false, s.dbErr(err)
+	}
+	return claimed == 1, nil
+}
+
+func (s *SQLite) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	res, err := s.exec(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= $1", sqliteNow())
+	if err != nil {
+		return 0, s.dbErr(err)
+	}
+	return res.RowsAffected()
+}
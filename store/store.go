@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"httpserver/models"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Errors returned by every Store implementation
+var (
+	ErrAccountNotFound        = errors.New("account not found")
+	ErrDuplicateAccount       = errors.New("account already exists")
+	ErrInsufficientBalance    = errors.New("insufficient balance in source account")
+	ErrTransactionNotFound    = errors.New("transaction not found")
+	ErrQuoteNotFound          = errors.New("quote not found or already used")
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+	ErrAPIKeyNotFound         = errors.New("API key not found")
+	ErrClosed                 = errors.New("store is closed")
+
+	// Database failures the caller can act on, the driver error is kept for logging
+	ErrConflict      = errors.New("conflicts with an existing record")
+	ErrConstraint    = errors.New("violates a data constraint")
+	ErrSerialization = errors.New("conflicted with a concurrent transaction, retry")
+	ErrUnavailable   = errors.New("database unavailable, retry")
+)
+
+// A driver error classified as one of the errors above.
+// It reads as the sentinel so driver details never reach a client
+type dbError struct {
+	kind  error
+	cause error
+}
+
+func (e *dbError) Error() string {
+	return e.kind.Error()
+}
+
+func (e *dbError) Unwrap() []error {
+	return []error{e.kind, e.cause}
+}
+
+// The driver error behind a classified one, for logs. Other errors are returned as is
+func DriverError(err error) error {
+	var e *dbError
+	if errors.As(err, &e) {
+		return e.cause
+	}
+	return err
+}
+
+// Reads of account state outside a transfer
+type AccountStore interface {
+	GetAccount(ctx context.Context, accountID int) (*models.Account, error)
+}
+
+// Writes to accounts and the ledger, all made through a Tx so they commit or roll back together
+type LedgerStore interface {
+	WithTx(ctx context.Context, fn func(tx Tx) error) error
+	GetTransaction(ctx context.Context, transactionID int64) (*models.Transaction, error)
+	ListAccountTransactions(ctx context.Context, accountID int, filter models.TransactionFilter) ([]models.Transaction, error)
+	Reconcile(ctx context.Context) (*models.ReconciliationReport, error)
+}
+
+// One atomic unit of work, nothing is visible to others until WithTx returns without error
+type Tx interface {
+	CreateAccount(account models.Account) error
+
+	// Lock an account until the end of the transaction and return its current state
+	LockAccount(accountID int) (*models.Account, error)
+
+	// Move money in or out of an account, returning the new balance. Debits never overdraw
+	Debit(accountID int, amount decimal.Decimal) (decimal.Decimal, error)
+	Credit(accountID int, amount decimal.Decimal) (decimal.Decimal, error)
+
+	// Record a transfer, filling in its ID and creation time
+	InsertTransaction(t *models.Transaction) error
+
+	// Record a journal entry and its postings, the caller checks they balance
+	InsertJournalEntry(kind string, transactionID *int64, postings []models.Posting) (int64, error)
+
+	// Mark a quote used and return it, a quote can be claimed once
+	ClaimFxQuote(quoteID string) (*models.FxQuote, error)
+
+	// Number and total amount of the transfers out of an account made at or after since
+	TransfersOutSince(accountID int, since time.Time) (int, decimal.Decimal, error)
+}
+
+// Locked exchange rates awaiting a transfer
+type FxQuoteStore interface {
+	CreateFxQuote(ctx context.Context, quote *models.FxQuote) error
+}
+
+// Stored responses for Idempotency-Key requests
+type IdempotencyStore interface {
+	// Claim a key for a request, false if it is already held by an unexpired request
+	ClaimIdempotencyKey(ctx context.Context, key string, fingerprint string, expiresAt time.Time) (bool, error)
+	GetIdempotencyKey(ctx context.Context, key string) (*models.IdempotencyRecord, error)
+	CompleteIdempotencyKey(ctx context.Context, key string, statusCode int, contentType string, body []byte) error
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+	PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+}
+
+// Credentials of API clients
+type APIKeyStore interface {
+	// Save a new key, filling in its creation time
+	CreateAPIKey(ctx context.Context, key *models.APIKey) error
+	GetAPIKey(ctx context.Context, keyID string) (*models.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]models.APIKey, error)
+
+	// Refuse the key from now on, revoking it again keeps the first revocation time
+	RevokeAPIKey(ctx context.Context, keyID string) error
+}
+
+// Everything the server persists
+type Store interface {
+	AccountStore
+	LedgerStore
+	FxQuoteStore
+	IdempotencyStore
+	APIKeyStore
+
+	// Wait for transactions in progress to commit or roll back, then refuse new ones with ErrClosed
+	Close() error
+}
@@ -0,0 +1,175 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"httpserver/handlers"
+	"httpserver/migrations"
+	"httpserver/models"
+	"httpserver/store"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/shopspring/decimal"
+)
+
+// Connect to the Postgres database in TRANSFERS_TEST_DSN, skipping when unset outside CI
+func setupRealDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("TRANSFERS_TEST_DSN")
+	if dsn == "" && os.Getenv("CI") != "" {
+		t.Fatal("TRANSFERS_TEST_DSN must be set in CI, the row locks are only tested against a real database")
+	}
+	if dsn == "" {
+		t.Skip("TRANSFERS_TEST_DSN not set, skipping test against a real database")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	if _, err := migrations.Up(db, migrations.Postgres); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	db.SetMaxOpenConns(20)
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// Remove an account with its ledger rows
+func clearTestAccount(db *sql.DB, id int) error {
+	if _, err := db.Exec("DELETE FROM postings WHERE journal_entry_id IN (SELECT journal_entry_id FROM postings WHERE account_id = $1)", id); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM journal_entries j WHERE NOT EXISTS (SELECT 1 FROM postings p WHERE p.journal_entry_id = j.id)"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM transactions WHERE source_account_id = $1 OR destination_account_id = $1", id); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM accounts WHERE account_id = $1", id)
+	return err
+}
+
+// Create accounts with the given balances, removing them after the test
+func createTestAccounts(t *testing.T, db *sql.DB, balances map[int]string) {
+	for id, balance := range balances {
+		if err := clearTestAccount(db, id); err != nil {
+			t.Fatalf("failed to clear account %d: %v", id, err)
+		}
+		if _, err := db.Exec("INSERT INTO accounts (account_id, balance, currency) VALUES ($1, $2, 'SGD')", id, balance); err != nil {
+			t.Fatalf("failed to create account %d: %v", id, err)
+		}
+	}
+	t.Cleanup(func() {
+		for id := range balances {
+			clearTestAccount(db, id)
+		}
+	})
+}
+
+// Read back the balance of an account
+func balanceOf(t *testing.T, db *sql.DB, id int) decimal.Decimal {
+	var balance decimal.Decimal
+	if err := db.QueryRow("SELECT balance FROM accounts WHERE account_id = $1", id).Scan(&balance); err != nil {
+		t.Fatalf("failed to read account %d: %v", id, err)
+	}
+	return balance
+}
+
+// Success: Money is conserved and never overdrawn under hundreds of parallel transfers
+func TestTransferCurrency_ConcurrentConservation(t *testing.T) {
+	db := setupRealDB(t)
+	srv := handlers.NewServer(store.NewPostgres(db))
+
+	ids := []int{900001, 900002, 900003, 900004, 900005}
+	balances := map[int]string{}
+	for _, id := range ids {
+		balances[id] = "100.00"
+	}
+	createTestAccounts(t, db, balances)
+
+	// Random transfers in both directions between a handful of accounts
+	var wg sync.WaitGroup
+	for i := 0; i < 500; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			source := ids[rng.Intn(len(ids))]
+			dest := ids[rng.Intn(len(ids))]
+			amount := decimal.New(rng.Int63n(3000)+1, -2)
+
+			_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: source, DestinationAccountID: dest, Amount: amount})
+			switch {
+			case err == nil, errors.Is(err, handlers.ErrSameAccount), errors.Is(err, handlers.ErrInsufficientFunds):
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	// Total is unchanged, no account went negative and postings explain every change
+	total := decimal.Zero
+	for _, id := range ids {
+		balance := balanceOf(t, db, id)
+		if balance.IsNegative() {
+			t.Errorf("account %d overdrawn: %s", id, balance)
+		}
+		total = total.Add(balance)
+
+		var posted decimal.Decimal
+		if err := db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM postings WHERE account_id = $1", id).Scan(&posted); err != nil {
+			t.Fatalf("failed to sum postings: %v", err)
+		}
+		if !posted.Equal(balance.Sub(decimal.NewFromInt(100))) {
+			t.Errorf("account %d postings %s do not explain balance %s", id, posted, balance)
+		}
+	}
+	if !total.Equal(decimal.NewFromInt(500)) {
+		t.Errorf("money not conserved, expected 500 got %s", total)
+	}
+}
+
+// Success: Parallel debits can never spend more than the balance
+func TestTransferCurrency_ConcurrentNoOverdraft(t *testing.T) {
+	db := setupRealDB(t)
+	srv := handlers.NewServer(store.NewPostgres(db))
+
+	createTestAccounts(t, db, map[int]string{900011: "100", 900012: "0"})
+
+	// 300 transfers of 1 against a balance of 100
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 900011, DestinationAccountID: 900012, Amount: decimal.NewFromInt(1)})
+			if err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			} else if err != handlers.ErrInsufficientFunds {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != 100 {
+		t.Errorf("expected exactly 100 successful transfers, got %d", succeeded)
+	}
+	if balance := balanceOf(t, db, 900011); !balance.IsZero() {
+		t.Errorf("expected source balance 0, got %s", balance)
+	}
+	if balance := balanceOf(t, db, 900012); !balance.Equal(decimal.NewFromInt(100)) {
+		t.Errorf("expected destination balance 100, got %s", balance)
+	}
+}
@@ -0,0 +1,387 @@
+package test
+
+import (
+	"flag"
+	"httpserver/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Load a config from args and a fake environment
+func loadConfig(args []string, env map[string]string) (models.Config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	return models.LoadConfig(fs, args, func(name string) string { return env[name] })
+}
+
+// Write a file in a temporary directory and return its path
+func writeTempFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// Success: Defaults without any input
+func TestLoadConfig_Defaults(t *testing.T) {
+	config, err := loadConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.DBHost != "localhost" || config.DBPort != 5432 || config.ServerPort != ":3333" || config.DBPassword != "" {
+		t.Errorf("unexpected defaults: %+v", config)
+	}
+}
+
+// Success: Flags beat the environment, which beats the config file
+func TestLoadConfig_Precedence(t *testing.T) {
+	path := writeTempFile(t, "config.json", `{"db_host": "file-host", "db_name": "file-db", "db_user": "file-user", "db_port": 6000, "fx_quote_ttl": "1m"}`)
+
+	config, err := loadConfig(
+		[]string{"--config", path, "--db-host", "flag-host"},
+		map[string]string{"TRANSFERS_DB_HOST": "env-host", "TRANSFERS_DB_NAME": "env-db"},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if config.DBHost != "flag-host" {
+		t.Errorf("expected flag to win, got %q", config.DBHost)
+	}
+	if config.DBName != "env-db" {
+		t.Errorf("expected environment to beat file, got %q", config.DBName)
+	}
+	if config.DBUser != "file-user" || config.DBPort != 6000 || config.FxQuoteTTL != time.Minute {
+		t.Errorf("expected file values, got %+v", config)
+	}
+}
+
+// Success: Config file path from the environment
+func TestLoadConfig_FileFromEnv(t *testing.T) {
+	path := writeTempFile(t, "config.json", `{"currencies": {"sgd": 2, "JPY": 0}}`)
+
+	config, err := loadConfig(nil, map[string]string{"TRANSFERS_CONFIG": path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(config.Currencies) != 2 || config.Currencies["SGD"] != 2 {
+		t.Errorf("unexpected currencies: %v", config.Currencies)
+	}
+}
+
+// Success: YAML files are read like JSON ones, other formats are refused naming the ones supported
+func TestLoadConfig_YAMLFile(t *testing.T) {
+	path := writeTempFile(t, "config.yaml", "# staging\ndb_host: yaml-host\ndb_port: 6000\nfx_quote_ttl: 1m\nlegacy_sunset: 2030-01-31\ncurrencies:\n  SGD: 2\n  JPY: 0\n")
+
+	config, err := loadConfig([]string{"--config", path}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.DBHost != "yaml-host" || config.DBPort != 6000 || config.FxQuoteTTL != time.Minute || config.LegacySunset.Year() != 2030 || config.Currencies["JPY"] != 0 || len(config.Currencies) != 2 {
+		t.Errorf("unexpected config from YAML %+v", config)
+	}
+
+	for name, content := range map[string]string{"config.yml": "db_hots: typo\n", "config.yaml": "- not a map\n"} {
+		if _, err := loadConfig([]string{"--config", writeTempFile(t, name, content)}, nil); err == nil {
+			t.Errorf("%s: expected %q to be refused", name, content)
+		}
+	}
+	_, err = loadConfig([]string{"--config", writeTempFile(t, "config.ini", "db_host = ini-host\n")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "must be JSON (.json), YAML (.yaml, .yml) or TOML (.toml)") {
+		t.Errorf("expected other formats to be refused, got %v", err)
+	}
+}
+
+// Success: TOML files are read like JSON ones, with currencies as a table or an inline table
+func TestLoadConfig_TOMLFile(t *testing.T) {
+	path := writeTempFile(t, "config.toml", "# staging\ndb_host = \"toml-host\" # primary\ndb_port = 6000\nfx_quote_ttl = '1m'\nlegacy_sunset = 2030-01-31\n\n[currencies]\nSGD = 2\nJPY = 0\n")
+
+	config, err := loadConfig([]string{"--config", path}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.DBHost != "toml-host" || config.DBPort != 6000 || config.FxQuoteTTL != time.Minute || config.LegacySunset.Year() != 2030 || config.Currencies["JPY"] != 0 || len(config.Currencies) != 2 {
+		t.Errorf("unexpected config from TOML %+v", config)
+	}
+
+	config, err = loadConfig([]string{"--config", writeTempFile(t, "inline.toml", "currencies = {SGD = 2, \"USD\" = 2, EUR = 2}\n")}, nil)
+	if err != nil || len(config.Currencies) != 3 || config.Currencies["USD"] != 2 {
+		t.Errorf("unexpected currencies from an inline table %v: %v", config.Currencies, err)
+	}
+
+	for _, content := range []string{"db_hots = \"typo\"\n", "db_host\n", "db_host = \"a\"\ndb_host = \"b\"\n", "db_host = \"unterminated\n", "[currencies\n"} {
+		if _, err := loadConfig([]string{"--config", writeTempFile(t, "config.toml", content)}, nil); err == nil {
+			t.Errorf("expected %q to be refused", content)
+		}
+	}
+}
+
+// Success: Password is read from a file without the trailing newline
+func TestLoadConfig_PasswordFile(t *testing.T) {
+	path := writeTempFile(t, "password", "s3cret\n")
+
+	config, err := loadConfig([]string{"--db-password-file", path}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.DBPassword != "s3cret" {
+		t.Errorf("unexpected password %q", config.DBPassword)
+	}
+}
+
+// Fail: Every invalid value is reported
+func TestLoadConfig_Validation(t *testing.T) {
+	_, err := loadConfig([]string{"--db-port", "70000", "--db-sslmode", "sometimes", "--server-port", "3333"}, nil)
+	if err == nil {
+		t.Fatalf("expected validation error")
+	}
+	for _, want := range []string{"db-port", "db-sslmode", "server-port"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got %v", want, err)
+		}
+	}
+}
+
+// Fail: Malformed values name their source
+func TestLoadConfig_InvalidValues(t *testing.T) {
+	if _, err := loadConfig(nil, map[string]string{"TRANSFERS_FX_QUOTE_TTL": "soon"}); err == nil || !strings.Contains(err.Error(), "TRANSFERS_FX_QUOTE_TTL") {
+		t.Errorf("expected error naming the variable, got %v", err)
+	}
+
+	path := writeTempFile(t, "config.json", `{"db_hots": "typo"}`)
+	if _, err := loadConfig([]string{"--config", path}, nil); err == nil || !strings.Contains(err.Error(), "db_hots") {
+		t.Errorf("expected error naming the unknown key, got %v", err)
+	}
+}
+
+// Success: DSN from parts quotes values and a full DSN is used as is
+func TestConfig_DSN(t *testing.T) {
+	config := models.DefaultConfig()
+	config.DBPassword = "it's secret"
+	if dsn := config.DSN(); !strings.Contains(dsn, `password='it\'s secret'`) || !strings.Contains(dsn, "sslmode=disable") {
+		t.Errorf("unexpected DSN %q", dsn)
+	}
+
+	config.DBDSN = "postgres://u:p@db/transfers?sslmode=verify-full"
+	if config.DSN() != config.DBDSN {
+		t.Errorf("expected full DSN to be used, got %q", config.DSN())
+	}
+}
+
+// Success: Secrets never appear in the printed config
+func TestConfig_Redacted(t *testing.T) {
+	config := models.DefaultConfig()
+	config.DBPassword = "hunter2"
+	config.DBDSN = "host=db password='hunter2' sslmode=require"
+
+	printed := config.Redacted()
+	if printed["db_password"] != "[REDACTED]" || strings.Contains(printed["db_dsn"], "hunter2") {
+		t.Errorf("secret leaked: %v", printed)
+	}
+
+	config.DBDSN = "postgres://user:hunter2@db/transfers"
+	if printed := config.Redacted(); strings.Contains(printed["db_dsn"], "hunter2") || !strings.Contains(printed["db_dsn"], "user:") {
+		t.Errorf("unexpected redacted URL: %v", printed["db_dsn"])
+	}
+}
+
+// Success: The memory store needs no database settings
+func TestLoadConfig_MemoryStore(t *testing.T) {
+	config, err := loadConfig([]string{"--store", "memory", "--snapshot-file", "data.json", "--db-host", ""}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Store != models.StoreMemory || config.SnapshotFile != "data.json" {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	if _, err := loadConfig([]string{"--store", "sqlite3"}, nil); err == nil || !strings.Contains(err.Error(), "store must be one of") {
+		t.Errorf("expected unknown store to be rejected, got %v", err)
+	}
+	if _, err := loadConfig([]string{"--snapshot-file", "data.json"}, nil); err == nil || !strings.Contains(err.Error(), "snapshot-file") {
+		t.Errorf("expected snapshot-file without the memory store to be rejected, got %v", err)
+	}
+}
+
+// Success: Server timeouts and pool limits are configurable, nonsense is rejected
+func TestLoadConfig_TimeoutsAndPool(t *testing.T) {
+	config, err := loadConfig(
+		[]string{"--write-timeout", "1m", "--db-max-open-conns", "10", "--db-max-idle-conns", "5"},
+		map[string]string{"TRANSFERS_SHUTDOWN_TIMEOUT": "45s", "TRANSFERS_DB_CONN_MAX_LIFETIME": "1h"},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.WriteTimeout != time.Minute || config.ShutdownTimeout != 45*time.Second || config.ReadHeaderTimeout != 5*time.Second {
+		t.Errorf("unexpected timeouts %+v", config)
+	}
+	if config.DBMaxOpenConns != 10 || config.DBMaxIdleConns != 5 || config.DBConnMaxLifetime != time.Hour {
+		t.Errorf("unexpected pool settings %+v", config)
+	}
+
+	_, err = loadConfig([]string{"--shutdown-timeout", "0s", "--db-max-open-conns", "2", "--db-max-idle-conns", "3"}, nil)
+	if err == nil {
+		t.Fatalf("expected validation error")
+	}
+	for _, want := range []string{"shutdown-timeout", "db-max-idle-conns"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got %v", want, err)
+		}
+	}
+
+	// The deadline must expire while the response can still be written
+	if _, err := loadConfig([]string{"--request-timeout", "1m"}, nil); err == nil || !strings.Contains(err.Error(), "request-timeout must be below write-timeout") {
+		t.Errorf("expected request-timeout above write-timeout to be rejected, got %v", err)
+	}
+}
+
+// Success: Transfer retries are configurable, a negative count or inverted backoff is refused
+func TestLoadConfig_TransferRetries(t *testing.T) {
+	config, err := loadConfig([]string{"--transfer-retries", "5"}, map[string]string{"TRANSFERS_TRANSFER_RETRY_BACKOFF": "50ms"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.TransferRetries != 5 || config.TransferRetryBackoff != 50*time.Millisecond || config.TransferRetryMax != 200*time.Millisecond {
+		t.Errorf("unexpected retry settings %+v", config)
+	}
+
+	_, err = loadConfig([]string{"--transfer-retries", "-1", "--transfer-retry-backoff", "1s"}, nil)
+	if err == nil {
+		t.Fatalf("expected validation error")
+	}
+	for _, want := range []string{"transfer-retries must not be negative", "transfer-retry-max-backoff must not be below"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got %v", want, err)
+		}
+	}
+}
+
+// Success: The legacy sunset is a date, empty keeps the unversioned routes
+func TestLoadConfig_LegacySunset(t *testing.T) {
+	config, err := loadConfig([]string{"--legacy-sunset", "2030-01-31"}, nil)
+	if err != nil || !config.LegacySunset.Equal(time.Date(2030, time.January, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected sunset %v %v", config.LegacySunset, err)
+	}
+	if config, err := loadConfig([]string{"--legacy-sunset", ""}, nil); err != nil || !config.LegacySunset.IsZero() {
+		t.Errorf("expected no sunset, got %v %v", config.LegacySunset, err)
+	}
+	if _, err := loadConfig([]string{"--legacy-sunset", "soon"}, nil); err == nil || !strings.Contains(err.Error(), "legacy-sunset") {
+		t.Errorf("expected an invalid date to be rejected, got %v", err)
+	}
+}
+
+// Success: API keys are required unless auth is none, the signature window is configurable
+func TestLoadConfig_Auth(t *testing.T) {
+	config, err := loadConfig(nil, nil)
+	if err != nil || config.Auth != models.AuthAPIKey || config.SignatureWindow != 5*time.Minute {
+		t.Errorf("unexpected auth defaults %q %s %v", config.Auth, config.SignatureWindow, err)
+	}
+	config, err = loadConfig([]string{"--auth", "none"}, map[string]string{"TRANSFERS_SIGNATURE_WINDOW": "1m"})
+	if err != nil || config.Auth != models.AuthNone || config.SignatureWindow != time.Minute {
+		t.Errorf("unexpected auth settings %q %s %v", config.Auth, config.SignatureWindow, err)
+	}
+
+	_, err = loadConfig([]string{"--auth", "basic", "--signature-window", "0s"}, nil)
+	if err == nil {
+		t.Fatalf("expected validation error")
+	}
+	for _, want := range []string{"auth must be one of", "signature-window must be positive"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_JWT(t *testing.T) {
+	config, err := loadConfig([]string{"--auth", "api-key,jwt", "--jwks-url", "https://id.internal/jwks.json", "--jwt-issuer", "https://id.internal"},
+		map[string]string{"TRANSFERS_JWT_AUDIENCE": "transfers", "TRANSFERS_JWT_LEEWAY": "5s"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !config.UsesAuth(models.AuthAPIKey) || !config.UsesAuth(models.AuthJWT) || config.JWKSRefresh != 10*time.Minute || config.JWTLeeway != 5*time.Second || config.JWTAudience != "transfers" || config.JWTRoleClaim != "role" {
+		t.Errorf("unexpected jwt settings %+v", config)
+	}
+
+	// Plain HTTP is only accepted for a key set on the local machine
+	if _, err := loadConfig([]string{"--auth", "jwt", "--jwks-url", "http://127.0.0.1:8081/jwks.json", "--jwt-issuer", "i", "--jwt-audience", "a"}, nil); err != nil {
+		t.Errorf("unexpected error for a loopback URL: %v", err)
+	}
+
+	_, err = loadConfig([]string{"--auth", "jwt", "--jwks-url", "http://id.internal/jwks.json", "--jwks-refresh", "0s", "--jwt-leeway", "-1s", "--jwt-role-claim", ""}, nil)
+	if err == nil {
+		t.Fatalf("expected validation error")
+	}
+	for _, want := range []string{"jwks-url must be an https URL", "jwt-issuer and jwt-audience are required", "jwks-refresh must be positive", "jwt-leeway must not be negative", "jwt-role-claim must not be empty"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got %v", want, err)
+		}
+	}
+	_, err = loadConfig([]string{"--auth", "jwt", "--jwks-file", "jwks.json", "--jwks-url", "https://id.internal/jwks.json", "--jwt-issuer", "i", "--jwt-audience", "a"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "exactly one of jwks-file and jwks-url") {
+		t.Errorf("expected both key sources to be refused, got %v", err)
+	}
+}
+
+// Success: TLS is off by default, its settings are checked once a certificate is given
+func TestLoadConfig_TLS(t *testing.T) {
+	config, err := loadConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.TLSCertFile != "" || config.TLSMinVersion != "1.2" || config.TLSCipherPolicy != "modern" || config.TLSReloadInterval != 30*time.Second || config.TLSClientAuth != "optional" {
+		t.Errorf("unexpected tls defaults %+v", config)
+	}
+
+	config, err = loadConfig([]string{"--auth", "api-key,mtls", "--tls-cert-file", "server.pem", "--tls-key-file", "server-key.pem", "--tls-client-ca-file", "clients.pem"},
+		map[string]string{"TRANSFERS_TLS_CLIENT_PRINCIPALS": "clients.json", "TRANSFERS_TLS_MIN_VERSION": "1.3", "TRANSFERS_TLS_CLIENT_AUTH": "require"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !config.UsesAuth(models.AuthMTLS) || config.TLSMinVersion != "1.3" || config.TLSClientAuth != "require" || config.TLSClientPrincipals != "clients.json" {
+		t.Errorf("unexpected tls settings %+v", config)
+	}
+
+	_, err = loadConfig([]string{"--auth", "mtls", "--tls-cert-file", "server.pem", "--tls-min-version", "1.1", "--tls-cipher-policy", "legacy",
+		"--tls-reload-interval", "0s", "--tls-client-auth", "request", "--tls-client-ca-file", "clients.pem"}, nil)
+	if err == nil {
+		t.Fatalf("expected validation error")
+	}
+	for _, want := range []string{"tls-cert-file and tls-key-file must be set together", "tls-min-version must be one of", "tls-cipher-policy must be one of",
+		"tls-reload-interval must be positive", "tls-client-auth must be one of", "tls-client-ca-file and tls-client-principals are required for auth mtls"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got %v", want, err)
+		}
+	}
+	_, err = loadConfig([]string{"--tls-client-ca-file", "clients.pem", "--tls-client-principals", "clients.json"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "tls-client-ca-file needs tls-cert-file") || !strings.Contains(err.Error(), "only used with auth mtls") {
+		t.Errorf("expected client certificates without TLS to be refused, got %v", err)
+	}
+}
+
+// Success: Clients get 20 requests a second with bursts of 40 by default, velocity limits are read from a file
+func TestLoadConfig_RateLimit(t *testing.T) {
+	config, err := loadConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.RateLimit != 20 || config.RateLimitBurst != 40 || config.VelocityLimitsFile != "" {
+		t.Errorf("unexpected rate limit defaults %+v", config)
+	}
+
+	config, err = loadConfig([]string{"--rate-limit", "0", "--rate-limit-burst", "0"}, map[string]string{"TRANSFERS_VELOCITY_LIMITS_FILE": "limits.json"})
+	if err != nil || config.RateLimit != 0 || config.VelocityLimitsFile != "limits.json" {
+		t.Errorf("expected the rate limit off, got %+v %v", config, err)
+	}
+
+	_, err = loadConfig([]string{"--rate-limit", "-1"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "rate-limit must not be negative") {
+		t.Errorf("expected a negative rate to be refused, got %v", err)
+	}
+	_, err = loadConfig([]string{"--rate-limit-burst", "0"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "rate-limit-burst must be at least 1") {
+		t.Errorf("expected an empty burst to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"httpserver/handlers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+/* Testcases for request deadlines and cancellation */
+
+// Fail: A slow database times the request out with 504
+func TestRequestTimeout_SlowQuery(t *testing.T) {
+	srv, mock := setupMockDB(t)
+	srv.RequestTimeout = 20 * time.Millisecond
+
+	mock.ExpectQuery("SELECT balance, currency, owner, tier FROM accounts WHERE account_id = \\$1").
+		WithArgs(1).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"balance", "currency", "owner", "tier"}).AddRow("150.75", "SGD", "", "standard"))
+
+	w := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/accounts/1", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+// Fail: A transfer past its deadline is rolled back and reported as 504
+func TestRequestTimeout_TransferRolledBack(t *testing.T) {
+	srv, mock := setupMockDB(t)
+	srv.RequestTimeout = 20 * time.Millisecond
+
+	mock.ExpectBegin()
+	expectLock(mock, 1, "100.00")
+	expectLock(mock, 2, "50.00")
+	mock.ExpectQuery(debitQuery).
+		WithArgs(decimal.RequireFromString("20"), 1).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("80.00"))
+	mock.ExpectRollback()
+
+	body := []byte(`{"source_account_id": 1, "destination_account_id": 2, "amount": "20"}`)
+	w := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/transactions", bytes.NewReader(body)))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %d %s", w.Code, w.Body.String())
+	}
+
+	// database/sql rolls back a canceled transaction in the background
+	deadline := time.Now().Add(time.Second)
+	for mock.ExpectationsWereMet() != nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: A client that went away gets 499 and its transfer never starts
+func TestRequestCanceled_Transfer(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "0", "currency": "SGD"}`)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		body := []byte(`{"source_account_id": 1, "destination_account_id": 2, "amount": "20"}`)
+		req := httptest.NewRequest(http.MethodPost, "/transactions", bytes.NewReader(body)).WithContext(ctx)
+		req.Header.Set("Idempotency-Key", "key-1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != handlers.StatusClientClosedRequest {
+			t.Errorf("expected 499, got %d %s", w.Code, w.Body.String())
+		}
+		if acc, err := srv.GetAccountByID(context.Background(), 1); err != nil || !acc.CurrentBalance.Equal(decimal.NewFromInt(100)) {
+			t.Errorf("expected balance untouched, got %+v %v", acc, err)
+		}
+
+		// The key is released so the client can retry
+		req = httptest.NewRequest(http.MethodPost, "/transactions", bytes.NewReader(body))
+		req.Header.Set("Idempotency-Key", "key-1")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("expected the retry to run, got %d %s", w.Code, w.Body.String())
+		}
+	})
+}
@@ -1,134 +1,268 @@
 package test
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"httpserver/handlers"
+	"httpserver/models"
+	"httpserver/store"
+	"httpserver/utils"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
 )
 
 /* Testcases for GetAccountByID */
 
 // Success: Valid request
 func TestCreateAccountHandler_Success(t *testing.T) {
-	mock := setupMockDB(t)
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		// Valid account details in body, expect empty response
+		w := call(t, h, http.MethodPost, "/accounts", `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`, nil)
+		if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+			t.Errorf("expected empty 204, got %d %s", w.Code, w.Body.String())
+		}
 
-	// Expect successful creation of account
-	mock.ExpectExec("INSERT INTO accounts").
-		WithArgs(1, 100.0).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-
-	// Valid account details in body
-	body := []byte(`{"account_id": 1, "initial_balance": "100.00"}`)
-	req := httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewReader(body))
-	w := httptest.NewRecorder()
-
-	handlers.CreateAccountHandler(w, req)
-
-	resp := w.Result()
-	defer resp.Body.Close()
-
-	// Expect empty response
-	if resp.StatusCode != http.StatusNoContent {
-		t.Errorf("expected 204, got %d", resp.StatusCode)
-	}
+		var account models.Account
+		call(t, h, http.MethodGet, "/accounts/1", "", &account)
+		if !account.CurrentBalance.Equal(decimal.RequireFromString("100")) || account.Currency != "SGD" {
+			t.Errorf("unexpected account %+v", account)
+		}
+	})
 }
 
 // Fail: Invalid JSON
 func TestCreateAccountHandler_InvalidJSON(t *testing.T) {
-	// Invalid JSON in body
-	req := httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewBufferString("{invalid json"))
-	w := httptest.NewRecorder()
-
-	handlers.CreateAccountHandler(w, req)
-
-	resp := w.Result()
-	defer resp.Body.Close()
-
-	// Expect bad request
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", resp.StatusCode)
-	}
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		// Expect bad request
+		if w := call(t, h, http.MethodPost, "/accounts", "{invalid json", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
 }
 
 // Fail: Invalid AccountID
 func TestCreateAccountHandler_InvalidAccountID(t *testing.T) {
-	// String for initial_balance instead of a number
-	body := []byte(`{"account_id": "not-a-number", "initial_balance": "100.00"}`)
-	req := httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewReader(body))
-	w := httptest.NewRecorder()
-
-	handlers.CreateAccountHandler(w, req)
-
-	resp := w.Result()
-	defer resp.Body.Close()
-
-	// Expect bad request
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", resp.StatusCode)
-	}
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		// String for account_id instead of a number
+		w := call(t, h, http.MethodPost, "/accounts", `{"account_id": "not-a-number", "initial_balance": "100.00", "currency": "SGD"}`, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
 }
 
 // Fail: Invalid Balance
 func TestCreateAccountHandler_InvalidBalance(t *testing.T) {
-	// String for initial_balance instead of a number
-	body := []byte(`{"account_id": 1, "initial_balance": "not-a-number"}`)
-	req := httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewReader(body))
-	w := httptest.NewRecorder()
-
-	handlers.CreateAccountHandler(w, req)
-
-	resp := w.Result()
-	defer resp.Body.Close()
-
-	// Expect bad request
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", resp.StatusCode)
-	}
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		// String for initial_balance instead of a number
+		w := call(t, h, http.MethodPost, "/accounts", `{"account_id": 1, "initial_balance": "not-a-number", "currency": "SGD"}`, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
 }
 
 // Fail: DB Error
 func TestCreateAccountHandler_DBError(t *testing.T) {
-	mock := setupMockDB(t)
+	srv, mock := setupMockDB(t)
 
 	// Simulate a DB error
+	mock.ExpectBegin()
 	mock.ExpectExec("INSERT INTO accounts").
-		WithArgs(1, 100.0).
+		WithArgs(1, decimal.RequireFromString("100.00"), "SGD", "", "standard").
 		WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	w := call(t, srv.Routes(), http.MethodPost, "/accounts", `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`, nil)
+
+	// Expect server error
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+}
 
-	// Valid account details in body
-	body := []byte(`{"account_id": 1, "initial_balance": "100.00"}`)
-	req := httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewReader(body))
-	w := httptest.NewRecorder()
+// Fail: Duplicate account ID
+func TestCreateAccountHandler_Duplicate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
 
-	handlers.CreateAccountHandler(w, req)
+		// Expect conflict rather than a server error, the first account is kept
+		var problem utils.Problem
+		w := call(t, h, http.MethodPost, "/accounts", `{"account_id": 1, "initial_balance": "5.00", "currency": "USD"}`, &problem)
+		if w.Code != http.StatusConflict || problem.Code != handlers.CodeDuplicateAccount {
+			t.Errorf("expected 409 duplicate_account, got %d %s", w.Code, w.Body.String())
+		}
 
-	resp := w.Result()
-	defer resp.Body.Close()
+		var account models.Account
+		call(t, h, http.MethodGet, "/accounts/1", "", &account)
+		if !account.CurrentBalance.Equal(decimal.RequireFromString("100")) || account.Currency != "SGD" {
+			t.Errorf("expected the first account unchanged, got %+v", account)
+		}
+	})
+}
 
-	// Expect server error
-	if resp.StatusCode != http.StatusInternalServerError {
-		t.Errorf("expected 500, got %d", resp.StatusCode)
+// Fail: A Postgres unique violation on the key is reported as a duplicate
+func TestCreateAccountHandler_DuplicatePostgres(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	// Simulate the primary key being taken
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO accounts").
+		WithArgs(1, decimal.RequireFromString("100.00"), "SGD", "", "standard").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "accounts_pkey"})
+	mock.ExpectRollback()
+
+	w := call(t, srv.Routes(), http.MethodPost, "/accounts", `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`, nil)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), handlers.CodeDuplicateAccount) {
+		t.Errorf("expected 409 duplicate_account, got %d %s", w.Code, w.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
 	}
 }
 
 // Fail: Invalid Method
 func TestCreateAccountHandler_InvalidMethod(t *testing.T) {
-	// Use GET instead of POST
-	req := httptest.NewRequest(http.MethodGet, "/accounts", nil)
-	w := httptest.NewRecorder()
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		// Use GET instead of POST
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/accounts", nil))
+
+		// Expect invalid method error naming the allowed method
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+			t.Errorf("expected 405 allowing POST, got %d %q", w.Code, w.Header().Get("Allow"))
+		}
+	})
+}
+
+// Success: Balance is stored exactly as given
+func TestCreateAccountHandler_ExactBalance(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.23344", "currency": "BTC"}`)
+
+		// Expect the exact decimal read back
+		var data map[string]any
+		call(t, h, http.MethodGet, "/accounts/1", "", &data)
+		if data["balance"] != "100.23344" {
+			t.Errorf("expected balance \"100.23344\", got %#v", data["balance"])
+		}
+	})
+}
+
+// Success: The exact decimal reaches the DB with its opening entry
+func TestCreateAccountHandler_ExactBalanceSQL(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	expectCreateAccount(mock, 1, "BTC", "100.23344")
+
+	w := call(t, srv.Routes(), http.MethodPost, "/accounts", `{"account_id": 1, "initial_balance": "100.23344", "currency": "BTC"}`, nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: Balance has more decimal places than allowed
+func TestCreateAccountHandler_BalanceTooPrecise(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		// One decimal place too many for SGD, must not be rounded
+		if w := call(t, h, http.MethodPost, "/accounts", `{"account_id": 1, "initial_balance": "100.123", "currency": "SGD"}`, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
 
-	handlers.CreateAccountHandler(w, req)
+		// Expect nothing stored
+		if w := call(t, h, http.MethodGet, "/accounts/1", "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected no account, got %d", w.Code)
+		}
+	})
+}
+
+// Success: Zero balance needs no opening entry
+func TestCreateAccountHandler_ZeroBalance(t *testing.T) {
+	srv, mock := setupMockDB(t)
 
-	resp := w.Result()
-	defer resp.Body.Close()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO accounts").
+		WithArgs(1, decimal.RequireFromString("0"), "JPY", "", "standard").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	// Expect invalid method error
-	if resp.StatusCode != http.StatusMethodNotAllowed {
-		t.Errorf("expected 405, got %d", resp.StatusCode)
+	w := call(t, srv.Routes(), http.MethodPost, "/accounts", `{"account_id": 1, "initial_balance": "0", "currency": "jpy"}`, nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
 	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: Non-positive account IDs are reserved
+func TestCreateAccountHandler_ReservedAccountID(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		for _, body := range []string{`{"account_id": 0, "initial_balance": "1", "currency": "SGD"}`, `{"account_id": -1, "initial_balance": "1", "currency": "SGD"}`, `{"initial_balance": "1", "currency": "SGD"}`} {
+			if w := call(t, h, http.MethodPost, "/accounts", body, nil); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d", body, w.Code)
+			}
+		}
+	})
+}
+
+// Fail: Currency missing or unsupported
+func TestCreateAccountHandler_InvalidCurrency(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		for _, body := range []string{`{"account_id": 1, "initial_balance": "1"}`, `{"account_id": 1, "initial_balance": "1", "currency": "XYZ"}`} {
+			if w := call(t, h, http.MethodPost, "/accounts", body, nil); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d", body, w.Code)
+			}
+		}
+	})
+}
+
+// Fail: Exponents and overlong numbers are refused before they are parsed
+func TestCreateAccountHandler_ExponentAndLongBalance(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		start := time.Now()
+		for _, balance := range []string{"1e3", "1E3", "1e-30000000", "1e10000000", strings.Repeat("9", 19), "1." + strings.Repeat("0", 100000)} {
+			body := `{"account_id": 1, "initial_balance": "` + balance + `", "currency": "SGD"}`
+			var problem utils.Problem
+			if w := call(t, h, http.MethodPost, "/accounts", body, &problem); w.Code != http.StatusBadRequest || problem.Details["field"] != "initial_balance" {
+				t.Errorf("%.20s: expected 400 on initial_balance, got %d %+v", balance, w.Code, problem)
+			}
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("expected the inputs refused quickly, took %s", elapsed)
+		}
+		if w := call(t, h, http.MethodGet, "/accounts/1", "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected no account, got %d", w.Code)
+		}
+	})
+}
+
+// Fail: Negative opening balances are refused by the handler and by every store
+func TestCreateAccountHandler_NegativeBalance(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		var problem utils.Problem
+		w := call(t, h, http.MethodPost, "/accounts", `{"account_id": 1, "initial_balance": "-50", "currency": "SGD"}`, &problem)
+		if w.Code != http.StatusBadRequest || problem.Code != handlers.CodeValidationFailed || problem.Details["field"] != "initial_balance" {
+			t.Errorf("expected 400 validation_failed on initial_balance, got %d %+v", w.Code, problem)
+		}
+
+		// Past the handler the store refuses it like the CHECK constraint
+		if err := srv.CreateAccount(context.Background(), 1, "SGD", decimal.NewFromInt(-50), "", ""); !errors.Is(err, store.ErrConstraint) {
+			t.Errorf("expected a constraint violation, got %v", err)
+		}
+		if w := call(t, h, http.MethodGet, "/accounts/1", "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected no account, got %d", w.Code)
+		}
+	})
 }
@@ -0,0 +1,241 @@
+package test
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"httpserver/handlers"
+	"httpserver/utils"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+// Send a request through the router and decode the problem it returns
+func callProblem(t *testing.T, h http.Handler, req *http.Request) (*httptest.ResponseRecorder, utils.Problem) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var problem utils.Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("invalid problem %q: %v", w.Body.String(), err)
+	}
+	return w, problem
+}
+
+/* Testcases for the error envelope */
+
+// Fail: Errors are problem+json carrying a code and the request ID
+func TestErrors_ProblemJSON(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		req := httptest.NewRequest(http.MethodGet, "/accounts/9", nil)
+		req.Header.Set("X-Request-ID", "req-123")
+		w, problem := callProblem(t, h, req)
+
+		if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Errorf("expected 404 problem+json, got %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		want := utils.Problem{Type: "about:blank", Title: "Not Found", Status: 404, Code: handlers.CodeAccountNotFound, Message: "account not found", RequestID: "req-123"}
+		if problem.Type != want.Type || problem.Title != want.Title || problem.Status != want.Status || problem.Code != want.Code || problem.Message != want.Message || problem.RequestID != want.RequestID {
+			t.Errorf("expected %+v, got %+v", want, problem)
+		}
+		if w.Header().Get("X-Request-ID") != "req-123" {
+			t.Errorf("expected request ID to be echoed, got %q", w.Header().Get("X-Request-ID"))
+		}
+	})
+}
+
+// Success: Requests without a usable ID get a generated one
+func TestErrors_GeneratedRequestID(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		for _, id := range []string{"", "has spaces", strings.Repeat("x", 200)} {
+			req := httptest.NewRequest(http.MethodGet, "/accounts/9", nil)
+			req.Header.Set("X-Request-ID", id)
+			w, problem := callProblem(t, h, req)
+
+			generated := w.Header().Get("X-Request-ID")
+			if len(generated) != 32 || generated == id || problem.RequestID != generated {
+				t.Errorf("%q: expected a generated ID in header and body, got %q and %q", id, generated, problem.RequestID)
+			}
+		}
+	})
+}
+
+// Fail: Unknown paths are 404 and unsupported methods 405 with Allow, both as problems
+func TestErrors_Routing(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		cases := []struct {
+			method string
+			path   string
+			status int
+			code   string
+			allow  string
+		}{
+			{http.MethodGet, "/accounts/1/extra", http.StatusNotFound, handlers.CodeNotFound, ""},
+			{http.MethodGet, "/unknown", http.StatusNotFound, handlers.CodeNotFound, ""},
+			{http.MethodDelete, "/accounts/1", http.StatusMethodNotAllowed, handlers.CodeMethodNotAllowed, "GET, HEAD"},
+			{http.MethodGet, "/transactions", http.StatusMethodNotAllowed, handlers.CodeMethodNotAllowed, "POST"},
+			{http.MethodPut, "/accounts/1/transactions", http.StatusMethodNotAllowed, handlers.CodeMethodNotAllowed, "GET, HEAD"},
+		}
+		for _, c := range cases {
+			w, problem := callProblem(t, h, httptest.NewRequest(c.method, c.path, nil))
+			if w.Code != c.status || problem.Code != c.code || w.Header().Get("Allow") != c.allow {
+				t.Errorf("%s %s: expected %d %s allowing %q, got %d %s allowing %q", c.method, c.path, c.status, c.code, c.allow, w.Code, problem.Code, w.Header().Get("Allow"))
+			}
+			if w.Header().Get("Content-Type") != "application/problem+json" || problem.RequestID == "" {
+				t.Errorf("%s %s: expected a problem with a request ID, got %s", c.method, c.path, w.Body.String())
+			}
+		}
+	})
+}
+
+// Fail: Invalid input names the offending field
+func TestErrors_ValidationDetails(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		body := []byte(`{"source_account_id": 1, "destination_account_id": 2, "amount": "lots"}`)
+		w, problem := callProblem(t, h, httptest.NewRequest(http.MethodPost, "/transactions", bytes.NewReader(body)))
+
+		if w.Code != http.StatusBadRequest || problem.Code != handlers.CodeValidationFailed || problem.Details["field"] != "amount" {
+			t.Errorf("expected validation_failed on amount, got %d %+v", w.Code, problem)
+		}
+
+		w, problem = callProblem(t, h, httptest.NewRequest(http.MethodGet, "/accounts/1/transactions?limit=0", nil))
+		if w.Code != http.StatusBadRequest || problem.Details["field"] != "limit" {
+			t.Errorf("expected validation_failed on limit, got %d %+v", w.Code, problem)
+		}
+	})
+}
+
+// Fail: Transfer errors have their own codes
+func TestErrors_TransferCodes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "10", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "0", "currency": "USD"}`)
+		createAccount(t, h, `{"account_id": 3, "initial_balance": "0", "currency": "SGD"}`)
+
+		cases := []struct {
+			body   string
+			status int
+			code   string
+		}{
+			{`{"source_account_id": 1, "destination_account_id": 3, "amount": "11"}`, http.StatusBadRequest, handlers.CodeInsufficientFunds},
+			{`{"source_account_id": 1, "destination_account_id": 1, "amount": "1"}`, http.StatusBadRequest, handlers.CodeSameAccount},
+			{`{"source_account_id": 9, "destination_account_id": 1, "amount": "1"}`, http.StatusBadRequest, handlers.CodeSourceNotFound},
+			{`{"source_account_id": 1, "destination_account_id": 2, "amount": "1"}`, http.StatusBadRequest, handlers.CodeCurrencyMismatch},
+			{`{"source_account_id": 1, "destination_account_id": 3, "amount": "1.001"}`, http.StatusBadRequest, handlers.CodeAmountTooPrecise},
+			{`{"source_account_id": 1, "destination_account_id": 2, "amount": "1", "quote_id": "q_missing"}`, http.StatusUnprocessableEntity, handlers.CodeQuoteNotFound},
+		}
+		for _, c := range cases {
+			w, problem := callProblem(t, h, httptest.NewRequest(http.MethodPost, "/transactions", bytes.NewBufferString(c.body)))
+			if w.Code != c.status || problem.Code != c.code {
+				t.Errorf("%s: expected %d %s, got %d %+v", c.body, c.status, c.code, w.Code, problem)
+			}
+		}
+	})
+}
+
+// Fail: Unexpected errors are a generic 500 that does not leak the cause
+func TestErrors_Internal(t *testing.T) {
+	srv, mock := setupMockDB(t)
+	mock.ExpectQuery("SELECT balance, currency, owner, tier FROM accounts").
+		WithArgs(1).
+		WillReturnError(sql.ErrConnDone)
+
+	w, problem := callProblem(t, srv.Routes(), httptest.NewRequest(http.MethodGet, "/accounts/1", nil))
+
+	if w.Code != http.StatusInternalServerError || problem.Code != handlers.CodeInternal {
+		t.Errorf("expected 500 internal_error, got %d %+v", w.Code, problem)
+	}
+	if strings.Contains(w.Body.String(), sql.ErrConnDone.Error()) {
+		t.Errorf("expected the cause to stay out of the response, got %s", w.Body.String())
+	}
+}
+
+/* Testcases for database failures */
+
+// Fail: Postgres errors map to a status by SQLSTATE, retryable ones ask the client to retry
+func TestErrors_PostgresCodes(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"unique_violation", &pq.Error{Code: "23505"}, http.StatusConflict, handlers.CodeConflict},
+		{"check_violation", &pq.Error{Code: "23514", Constraint: "accounts_balance_non_negative"}, http.StatusUnprocessableEntity, handlers.CodeConstraintViolation},
+		{"foreign_key_violation", &pq.Error{Code: "23503"}, http.StatusUnprocessableEntity, handlers.CodeConstraintViolation},
+		{"numeric_value_out_of_range", &pq.Error{Code: "22003"}, http.StatusUnprocessableEntity, handlers.CodeConstraintViolation},
+		{"serialization_failure", &pq.Error{Code: "40001"}, http.StatusServiceUnavailable, handlers.CodeTransactionConflict},
+		{"deadlock_detected", &pq.Error{Code: "40P01"}, http.StatusServiceUnavailable, handlers.CodeTransactionConflict},
+		{"too_many_connections", &pq.Error{Code: "53300"}, http.StatusServiceUnavailable, handlers.CodeServiceUnavailable},
+		{"admin_shutdown", &pq.Error{Code: "57P01"}, http.StatusServiceUnavailable, handlers.CodeServiceUnavailable},
+		{"connection_failure", &pq.Error{Code: "08006"}, http.StatusServiceUnavailable, handlers.CodeServiceUnavailable},
+		{"connection_refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, http.StatusServiceUnavailable, handlers.CodeServiceUnavailable},
+		{"syntax_error", &pq.Error{Code: "42601"}, http.StatusInternalServerError, handlers.CodeInternal},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, mock := setupMockDB(t)
+			srv.TransferRetry.MaxRetries = 0
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockQuery).WithArgs(1).WillReturnError(c.err)
+			mock.ExpectRollback()
+
+			body := `{"source_account_id": 1, "destination_account_id": 2, "amount": "10"}`
+			w, problem := callProblem(t, srv.Routes(), httptest.NewRequest(http.MethodPost, "/transactions", bytes.NewBufferString(body)))
+
+			if w.Code != c.status || problem.Code != c.code {
+				t.Errorf("expected %d %s, got %d %+v", c.status, c.code, w.Code, problem)
+			}
+			if retry := w.Header().Get("Retry-After"); (c.status == http.StatusServiceUnavailable) != (retry != "") {
+				t.Errorf("unexpected Retry-After %q for %d", retry, w.Code)
+			}
+			if strings.Contains(problem.Message, "pq:") || strings.Contains(problem.Message, "dial") {
+				t.Errorf("expected driver details to stay out of the response, got %q", problem.Message)
+			}
+		})
+	}
+}
+
+// Fail: An outage while reading an account is a 503, not a 404 or 400
+func TestErrors_DatabaseUnavailable(t *testing.T) {
+	srv, mock := setupMockDB(t)
+	mock.ExpectQuery("SELECT balance, currency, owner, tier FROM accounts").
+		WithArgs(1).
+		WillReturnError(&pq.Error{Code: "57P03"})
+
+	w, problem := callProblem(t, srv.Routes(), httptest.NewRequest(http.MethodGet, "/accounts/1", nil))
+
+	if w.Code != http.StatusServiceUnavailable || problem.Code != handlers.CodeServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 503 with Retry-After, got %d %+v", w.Code, problem)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: A commit that loses a serialization race is retryable
+func TestErrors_CommitSerializationFailure(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	// A zero opening balance writes no journal entry
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO accounts").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit().WillReturnError(&pq.Error{Code: "40001"})
+
+	body := `{"account_id": 1, "initial_balance": "0", "currency": "SGD"}`
+	w, problem := callProblem(t, srv.Routes(), httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewBufferString(body)))
+
+	if w.Code != http.StatusServiceUnavailable || problem.Code != handlers.CodeTransactionConflict {
+		t.Errorf("expected 503 transaction_conflict, got %d %+v", w.Code, problem)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"httpserver/fx"
+	"httpserver/handlers"
+	"httpserver/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+const claimQuoteQuery = `UPDATE fx_quotes SET used_at = now\(\) WHERE id = \$1 AND used_at IS NULL`
+
+// Use an in-memory SGD/USD rate for the duration of the test
+func setupFxRates(srv *handlers.Server) *fx.MemoryProvider {
+	rates := fx.NewMemoryProvider()
+	rates.Set("SGD", "USD", decimal.RequireFromString("0.7413"))
+	srv.FxRates = rates
+	return rates
+}
+
+// Expect a 10 SGD to 7.41 USD conversion from account 1 to account 2 at rate 0.7413
+func expectConversion(mock sqlmock.Sqlmock, quoteID interface{}) {
+	rate := decimal.RequireFromString("0.7413")
+	mock.ExpectQuery(debitQuery).
+		WithArgs(decimal.RequireFromString("10"), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("90.00"))
+	mock.ExpectQuery(creditQuery).
+		WithArgs(decimal.RequireFromString("7.41"), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("57.41"))
+	mock.ExpectQuery(ledgerQuery).
+		WithArgs(1, 2, "SGD", decimal.RequireFromString("10"), "USD", decimal.RequireFromString("7.41"),
+			rate, decimal.RequireFromString("0.003"), quoteID,
+			decimal.RequireFromString("90.00"), decimal.RequireFromString("57.41"), "completed").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(12, time.Now()))
+	mock.ExpectQuery("INSERT INTO journal_entries").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(13))
+
+	// Both legs balance through the FX account
+	mock.ExpectExec("INSERT INTO postings").
+		WithArgs(13,
+			1, "SGD", decimal.RequireFromString("-10"),
+			2, "USD", decimal.RequireFromString("7.41"),
+			models.FxAccountID, "SGD", decimal.RequireFromString("10"),
+			models.FxAccountID, "USD", decimal.RequireFromString("-7.41")).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+}
+
+/* Testcases for rate providers */
+
+// Success: Direct, inverse and identity rates
+func TestMemoryProvider_Rates(t *testing.T) {
+	rates := fx.NewMemoryProvider()
+	rates.Set("SGD", "USD", decimal.RequireFromString("0.8"))
+
+	if rate, err := rates.Rate("SGD", "USD"); err != nil || !rate.Equal(decimal.RequireFromString("0.8")) {
+		t.Errorf("unexpected direct rate %s, %v", rate, err)
+	}
+	if rate, err := rates.Rate("USD", "SGD"); err != nil || !rate.Equal(decimal.RequireFromString("1.25")) {
+		t.Errorf("unexpected inverse rate %s, %v", rate, err)
+	}
+	if rate, err := rates.Rate("EUR", "EUR"); err != nil || !rate.Equal(decimal.NewFromInt(1)) {
+		t.Errorf("unexpected identity rate %s, %v", rate, err)
+	}
+	if _, err := rates.Rate("SGD", "JPY"); !errors.Is(err, fx.ErrRateUnavailable) {
+		t.Errorf("expected rate unavailable, got %v", err)
+	}
+}
+
+// Success: Rates are read from a JSON file
+func TestStaticFileProvider_Load(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	os.WriteFile(path, []byte(`{"rates": {"SGD/USD": "0.7413", "usd/jpy": "150"}}`), 0o600)
+
+	rates, err := fx.NewStaticFileProvider(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rate, err := rates.Rate("USD", "JPY"); err != nil || !rate.Equal(decimal.NewFromInt(150)) {
+		t.Errorf("unexpected rate %s, %v", rate, err)
+	}
+
+	// An invalid file keeps the previous rates
+	os.WriteFile(path, []byte(`{"rates": {"SGD/USD": "-1"}}`), 0o600)
+	if err := rates.Reload(); err == nil {
+		t.Errorf("expected error for a negative rate")
+	}
+	if rate, _ := rates.Rate("SGD", "USD"); !rate.Equal(decimal.RequireFromString("0.7413")) {
+		t.Errorf("expected previous rate to be kept, got %s", rate)
+	}
+}
+
+// Success: Conversions round down and report the remainder
+func TestConvert_RoundsDown(t *testing.T) {
+	converted, remainder := models.Convert(decimal.RequireFromString("10"), decimal.RequireFromString("0.7413"), "USD")
+	if !converted.Equal(decimal.RequireFromString("7.41")) || !remainder.Equal(decimal.RequireFromString("0.003")) {
+		t.Errorf("unexpected conversion %s remainder %s", converted, remainder)
+	}
+
+	converted, remainder = models.Convert(decimal.RequireFromString("1.99"), decimal.RequireFromString("150.5"), "JPY")
+	if !converted.Equal(decimal.NewFromInt(299)) || !remainder.Equal(decimal.RequireFromString("0.495")) {
+		t.Errorf("unexpected conversion %s remainder %s", converted, remainder)
+	}
+}
+
+/* Testcases for CreateFxQuoteHandler */
+
+// Success: Quote is stored with its expiry
+func TestCreateFxQuoteHandler_Success(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		var quote models.FxQuote
+		if w := call(t, h, http.MethodPost, "/fx/quotes", `{"source_currency": "SGD", "destination_currency": "usd", "amount": "10"}`, &quote); w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d", w.Code)
+		}
+		if quote.QuoteID == "" || !quote.DestinationAmount.Equal(decimal.RequireFromString("7.41")) || !quote.ExpiresAt.After(time.Now()) {
+			t.Errorf("unexpected quote: %+v", quote)
+		}
+	})
+}
+
+// Success: Quote is inserted with its pair, amount and rate
+func TestCreateFxQuoteHandler_Insert(t *testing.T) {
+	srv, mock := setupMockDB(t)
+	setupFxRates(srv)
+
+	mock.ExpectExec("INSERT INTO fx_quotes").
+		WithArgs(sqlmock.AnyArg(), "SGD", "USD", decimal.RequireFromString("10"), decimal.RequireFromString("0.7413"), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	body := `{"source_currency": "SGD", "destination_currency": "usd", "amount": "10"}`
+	req := httptest.NewRequest(http.MethodPost, "/fx/quotes", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+
+	srv.CreateFxQuoteHandler(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+
+	var quote models.FxQuote
+	if err := json.NewDecoder(w.Body).Decode(&quote); err != nil {
+		t.Fatalf("failed to decode JSON: %v", err)
+	}
+	if quote.QuoteID == "" || !quote.DestinationAmount.Equal(decimal.RequireFromString("7.41")) || !quote.ExpiresAt.After(time.Now()) {
+		t.Errorf("unexpected quote: %+v", quote)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: No rate for the pair
+func TestCreateFxQuoteHandler_RateUnavailable(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		if w := call(t, h, http.MethodPost, "/fx/quotes", `{"source_currency": "SGD", "destination_currency": "JPY", "amount": "10"}`, nil); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", w.Code)
+		}
+	})
+}
+
+// Fail: Same currency on both sides
+func TestCreateFxQuoteHandler_SameCurrency(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		if w := call(t, h, http.MethodPost, "/fx/quotes", `{"source_currency": "SGD", "destination_currency": "SGD", "amount": "10"}`, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+}
+
+/* Testcases for cross-currency transfers */
+
+// Success: Conversion at the current rate
+func TestTransferCurrency_ConvertAtCurrentRate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "USD"}`)
+
+		record, err := srv.TransferCurrency(context.Background(), models.TransferRequest{
+			SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("10"), Convert: true,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if record.DestinationCurrency != "USD" || !record.DestinationAmount.Equal(decimal.RequireFromString("7.41")) || record.FxRate == nil {
+			t.Errorf("unexpected ledger entry: %+v", record)
+		}
+		if got := accountBalance(t, h, 2); !got.Equal(decimal.RequireFromString("57.41")) {
+			t.Errorf("unexpected destination balance %s", got)
+		}
+	})
+}
+
+// Success: Conversion at the rate locked by a quote, even after the live rate moved
+func TestTransferCurrency_ConvertWithQuote(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "USD"}`)
+
+		quote, err := srv.CreateFxQuote(context.Background(), "SGD", "USD", decimal.RequireFromString("10"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		setupFxRates(srv).Set("SGD", "USD", decimal.RequireFromString("0.9"))
+
+		record, err := srv.TransferCurrency(context.Background(), models.TransferRequest{
+			SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("10"), QuoteID: quote.QuoteID,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !record.DestinationAmount.Equal(decimal.RequireFromString("7.41")) || record.QuoteID != quote.QuoteID {
+			t.Errorf("unexpected ledger entry: %+v", record)
+		}
+	})
+}
+
+// Success: Both legs of a conversion are written and balanced through the FX account
+func TestTransferCurrency_ConversionStatements(t *testing.T) {
+	srv, mock := setupMockDB(t)
+	setupFxRates(srv)
+
+	mock.ExpectBegin()
+	expectLockCurrency(mock, 1, "100.00", "SGD")
+	expectLockCurrency(mock, 2, "50.00", "USD")
+	expectConversion(mock, nil)
+	mock.ExpectCommit()
+
+	record, err := srv.TransferCurrency(context.Background(), models.TransferRequest{
+		SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("10"), Convert: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if record.DestinationCurrency != "USD" || !record.DestinationAmount.Equal(decimal.RequireFromString("7.41")) || record.FxRate == nil {
+		t.Errorf("unexpected ledger entry: %+v", record)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Success: The quote is claimed in the transfer and its ID recorded with it
+func TestTransferCurrency_QuoteClaim(t *testing.T) {
+	srv, mock := setupMockDB(t)
+	rates := setupFxRates(srv)
+	rates.Set("SGD", "USD", decimal.RequireFromString("0.9"))
+
+	mock.ExpectBegin()
+	expectLockCurrency(mock, 1, "100.00", "SGD")
+	expectLockCurrency(mock, 2, "50.00", "USD")
+	mock.ExpectQuery(claimQuoteQuery).
+		WithArgs("q_1").
+		WillReturnRows(sqlmock.NewRows([]string{"source_currency", "destination_currency", "amount", "rate", "expires_at"}).
+			AddRow("SGD", "USD", "10", "0.7413", time.Now().Add(time.Minute)))
+	expectConversion(mock, "q_1")
+	mock.ExpectCommit()
+
+	_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{
+		SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("10"), QuoteID: "q_1",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: Quote is expired, used or does not match
+func TestTransferCurrency_QuoteErrors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		setupFxRates(srv).Set("SGD", "EUR", decimal.RequireFromString("0.68"))
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "USD"}`)
+
+		quote := func(ttl time.Duration, destination string, amount string) string {
+			srv.FxQuoteTTL = ttl
+			quote, err := srv.CreateFxQuote(context.Background(), "SGD", destination, decimal.RequireFromString(amount))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			return quote.QuoteID
+		}
+		used := quote(time.Minute, "USD", "10")
+		if _, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("10"), QuoteID: used}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		cases := []struct {
+			name     string
+			quoteID  string
+			expected error
+		}{
+			{"expired", quote(-time.Second, "USD", "10"), handlers.ErrQuoteExpired},
+			{"used", used, handlers.ErrQuoteNotFound},
+			{"other amount", quote(time.Minute, "USD", "11"), handlers.ErrQuoteMismatch},
+			{"other pair", quote(time.Minute, "EUR", "10"), handlers.ErrQuoteMismatch},
+		}
+		for _, c := range cases {
+			_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{
+				SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("10"), QuoteID: c.quoteID,
+			})
+			if !errors.Is(err, c.expected) {
+				t.Errorf("%s: expected %v, got %v", c.name, c.expected, err)
+			}
+		}
+		if got := accountBalance(t, h, 1); !got.Equal(decimal.RequireFromString("90")) {
+			t.Errorf("expected only the first transfer debited, got %s", got)
+		}
+	})
+}
+
+// Fail: Handler maps quote errors to 422
+func TestTransactionHandler_QuoteNotFound(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "USD"}`)
+
+		body := `{"source_account_id": 1, "destination_account_id": 2, "amount": "10", "quote_id": "q_missing"}`
+		if w := call(t, h, http.MethodPost, "/transactions", body, nil); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", w.Code)
+		}
+	})
+}
@@ -1,34 +1,34 @@
 package test
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"httpserver/handlers"
 	"httpserver/models"
 	"net/http"
-	"net/http/httptest"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
 )
 
 /* Testcases for GetAccountByID */
 
 // Success: Valid request
 func TestGetAccountByID_Success(t *testing.T) {
-	mock := setupMockDB(t)
+	srv, mock := setupMockDB(t)
 
 	// Expect successfully getting account
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
+	mock.ExpectQuery("SELECT balance, currency, owner, tier FROM accounts WHERE account_id =").
 		WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(150.75))
+		WillReturnRows(sqlmock.NewRows([]string{"balance", "currency", "owner", "tier"}).AddRow("150.75", "SGD", "", "standard"))
 
-	account, err := handlers.GetAccountByID(1)
+	account, err := srv.GetAccountByID(context.Background(), 1)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if account.AccountID != 1 || account.CurrentBalance != 150.75 {
+	if account.AccountID != 1 || !account.CurrentBalance.Equal(decimal.RequireFromString("150.75")) {
 		t.Errorf("unexpected account: %+v", account)
 	}
 
@@ -39,14 +39,14 @@ func TestGetAccountByID_Success(t *testing.T) {
 
 // Fail: DB Error
 func TestGetAccountByID_DBError(t *testing.T) {
-	mock := setupMockDB(t)
+	srv, mock := setupMockDB(t)
 
 	// Simulate a DB error
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
+	mock.ExpectQuery("SELECT balance, currency, owner, tier FROM accounts WHERE account_id =").
 		WithArgs(1).
 		WillReturnError(sql.ErrConnDone)
 
-	_, err := handlers.GetAccountByID(1)
+	_, err := srv.GetAccountByID(context.Background(), 1)
 	if err == nil {
 		t.Errorf("expected DB error, got nil")
 	}
@@ -56,96 +56,70 @@ func TestGetAccountByID_DBError(t *testing.T) {
 
 // Success: Valid request
 func TestGetAccountHandler_Success(t *testing.T) {
-	mock := setupMockDB(t)
-
-	// Expect successful creation of account
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
-		WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(200.50))
-
-	// Valid account
-	req := httptest.NewRequest(http.MethodGet, "/accounts/1", nil)
-	w := httptest.NewRecorder()
-
-	handlers.GetAccountHandler(w, req)
-
-	resp := w.Result()
-	defer resp.Body.Close()
-
-	// Checking for status 200
-	if resp.StatusCode != http.StatusOK {
-		t.Fatalf("expected 200 OK, got %d", resp.StatusCode)
-	}
-
-	var acc models.Account
-	if err := json.NewDecoder(resp.Body).Decode(&acc); err != nil {
-		t.Fatalf("failed to decode JSON: %v", err)
-	}
-
-	// Checking for correct account details
-	if acc.AccountID != 1 || acc.CurrentBalance != 200.50 {
-		t.Errorf("unexpected account data: %+v", acc)
-	}
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "200.50", "currency": "SGD"}`)
+
+		// Checking for status 200
+		var acc models.Account
+		if w := call(t, h, http.MethodGet, "/accounts/1", "", &acc); w.Code != http.StatusOK {
+			t.Fatalf("expected 200 OK, got %d", w.Code)
+		}
+
+		// Checking for correct account details
+		if acc.AccountID != 1 || !acc.CurrentBalance.Equal(decimal.RequireFromString("200.50")) {
+			t.Errorf("unexpected account data: %+v", acc)
+		}
+	})
 }
 
 // Fail: Invalid AccountID
 func TestGetAccountHandler_InvalidID(t *testing.T) {
-	req := httptest.NewRequest(http.MethodGet, "/accounts/abc", nil)
-	w := httptest.NewRecorder()
-
-	handlers.GetAccountHandler(w, req)
-
-	resp := w.Result()
-	defer resp.Body.Close()
-
-	// Expect bad request
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", resp.StatusCode)
-	}
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		// Expect bad request
+		if w := call(t, h, http.MethodGet, "/accounts/abc", "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
 }
 
 // Fail: Account not found
 func TestGetAccountHandler_NotFound(t *testing.T) {
-	mock := setupMockDB(t)
-
-	// Simulate account not found
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
-		WithArgs(999).
-		WillReturnError(sql.ErrNoRows)
-
-	req := httptest.NewRequest(http.MethodGet, "/accounts/999", nil)
-	w := httptest.NewRecorder()
-
-	handlers.GetAccountHandler(w, req)
-
-	resp := w.Result()
-	defer resp.Body.Close()
-
-	// Expect not found error
-	if resp.StatusCode != http.StatusNotFound {
-		t.Errorf("expected 404, got %d", resp.StatusCode)
-	}
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "1", "currency": "SGD"}`)
+
+		// Expect not found error
+		if w := call(t, h, http.MethodGet, "/accounts/999", "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
 }
 
 // Fail: DB Error
 func TestGetAccountHandler_DBError(t *testing.T) {
-	mock := setupMockDB(t)
+	srv, mock := setupMockDB(t)
 
 	// Simulate a DB error
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
+	mock.ExpectQuery("SELECT balance, currency, owner, tier FROM accounts WHERE account_id =").
 		WithArgs(1).
 		WillReturnError(sql.ErrConnDone)
 
-	req := httptest.NewRequest(http.MethodGet, "/accounts/1", nil)
-	w := httptest.NewRecorder()
+	// Expect server error
+	if w := call(t, srv.Routes(), http.MethodGet, "/accounts/1", "", nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+}
 
-	handlers.GetAccountHandler(w, req)
+// Success: Balance is returned as an exact string
+func TestGetAccountHandler_BalanceAsString(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.23344", "currency": "BTC"}`)
 
-	resp := w.Result()
-	defer resp.Body.Close()
+		var data map[string]interface{}
+		call(t, h, http.MethodGet, "/accounts/1", "", &data)
 
-	// Expect server error
-	if resp.StatusCode != http.StatusInternalServerError {
-		t.Errorf("expected 500, got %d", resp.StatusCode)
-	}
+		// Checking balance is serialised as a string, not a float
+		if data["balance"] != "100.23344" || data["currency"] != "BTC" {
+			t.Errorf("expected balance \"100.23344\", got %#v", data["balance"])
+		}
+	})
 }
@@ -0,0 +1,145 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"httpserver/handlers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const (
+	expireKeyQuery = `DELETE FROM idempotency_keys WHERE idempotency_key = \$1 AND expires_at <= now\(\)`
+	claimKeyQuery  = `INSERT INTO idempotency_keys`
+)
+
+var createAccountBody = []byte(`{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+
+// POST /accounts with an Idempotency-Key
+func idempotentCreateAccount(srv *handlers.Server, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewReader(body))
+	req.Header.Set("Idempotency-Key", "key-1")
+	w := httptest.NewRecorder()
+
+	srv.Idempotent(handlers.ActionCreateAccount, srv.CreateAccountHandler)(w, req)
+	return w
+}
+
+// Success: First use executes the handler and stores the response
+func TestIdempotent_FirstRequest(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	mock.ExpectExec(expireKeyQuery).WithArgs("key-1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(claimKeyQuery).
+		WithArgs("key-1", handlers.IdempotencyFingerprint("", http.MethodPost, "/accounts", createAccountBody), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectCreateAccount(mock, 1, "SGD", "100.00")
+	mock.ExpectExec("UPDATE idempotency_keys SET status_code").
+		WithArgs("key-1", http.StatusNoContent, "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := idempotentCreateAccount(srv, createAccountBody)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Success: Replay returns the stored response without running the handler
+func TestIdempotent_Replay(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		// One decimal place too many for SGD
+		body := []byte(`{"account_id": 1, "initial_balance": "100.001", "currency": "SGD"}`)
+		first := idempotentCreateAccount(srv, body)
+		if first.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d", first.Code)
+		}
+
+		// Identical status, content type and body
+		w := idempotentCreateAccount(srv, body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+		if w.Body.String() != first.Body.String() {
+			t.Errorf("unexpected body: %s", w.Body.String())
+		}
+		if w.Header().Get("Content-Type") != first.Header().Get("Content-Type") || w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("unexpected headers: %v", w.Header())
+		}
+	})
+}
+
+// Fail: Key reused with a different body
+func TestIdempotent_DifferentRequest(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		if w := idempotentCreateAccount(srv, createAccountBody); w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", w.Code)
+		}
+
+		w := idempotentCreateAccount(srv, []byte(`{"account_id": 1, "initial_balance": "999.00", "currency": "SGD"}`))
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", w.Code)
+		}
+	})
+}
+
+// Fail: Original request has not finished yet
+func TestIdempotent_InProgress(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		fingerprint := handlers.IdempotencyFingerprint("", http.MethodPost, "/accounts", createAccountBody)
+		if _, err := srv.Store.ClaimIdempotencyKey(context.Background(), "key-1", fingerprint, time.Now().Add(time.Minute)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if w := idempotentCreateAccount(srv, createAccountBody); w.Code != http.StatusConflict {
+			t.Errorf("expected 409, got %d", w.Code)
+		}
+	})
+}
+
+// Success: Server errors release the key for a retry
+func TestIdempotent_ServerErrorReleasesKey(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	mock.ExpectExec(expireKeyQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(claimKeyQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO accounts").WillReturnError(sqlmock.ErrCancelled)
+	mock.ExpectRollback()
+	mock.ExpectExec(`DELETE FROM idempotency_keys WHERE idempotency_key = \$1$`).
+		WithArgs("key-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := idempotentCreateAccount(srv, createAccountBody)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Success: Requests without the header are not deduplicated
+func TestIdempotent_NoKey(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		send := func() int {
+			req := httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewReader(createAccountBody))
+			w := httptest.NewRecorder()
+			srv.Idempotent(handlers.ActionCreateAccount, srv.CreateAccountHandler)(w, req)
+			return w.Code
+		}
+
+		// The second one runs again and finds the account taken
+		if got := []int{send(), send()}; got[0] != http.StatusNoContent || got[1] != http.StatusConflict {
+			t.Errorf("expected 204 then 409, got %v", got)
+		}
+	})
+}
@@ -0,0 +1,413 @@
+package test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"httpserver/handlers"
+	"httpserver/jwt"
+	"httpserver/models"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://id.internal"
+	testAudience = "transfers"
+)
+
+// Signing key of a test identity provider
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func newSigner(t *testing.T, alg string, kid string) testSigner {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case jwt.RS256:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.ES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.EdDSA:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatalf("failed to generate %s key: %v", alg, err)
+	}
+	return testSigner{kid: kid, alg: alg, key: key}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The public key as a JWKS entry
+func (s testSigner) jwk() map[string]string {
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kid": s.kid, "kty": "RSA", "use": "sig", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kid": s.kid, "kty": "EC", "crv": "P-256", "x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32)))}
+	default:
+		return map[string]string{"kid": s.kid, "kty": "OKP", "crv": "Ed25519", "x": b64(s.key.Public().(ed25519.PublicKey))}
+	}
+}
+
+// Sign claims into a compact JWT with header alg
+func (s testSigner) signAs(t *testing.T, alg string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": s.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, sv *big.Int
+		r, sv, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), sv.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	return signed + "." + b64(signature)
+}
+
+func (s testSigner) sign(t *testing.T, claims map[string]any) string {
+	return s.signAs(t, s.alg, claims)
+}
+
+// Claims the verifier accepts, with overrides applied and nil values removed
+func validClaims(overrides map[string]any) map[string]any {
+	claims := map[string]any{
+		"sub":  "service-a",
+		"iss":  testIssuer,
+		"aud":  testAudience,
+		"exp":  time.Now().Add(time.Hour).Unix(),
+		"iat":  time.Now().Unix(),
+		"role": models.RoleAuditor,
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+func jwksDocument(signers ...testSigner) []byte {
+	keys := make([]map[string]string, 0, len(signers))
+	for _, s := range signers {
+		keys = append(keys, s.jwk())
+	}
+	raw, _ := json.Marshal(map[string]any{"keys": keys})
+	return raw
+}
+
+// Write a JWKS file and open a key set on it that reloads on every unknown key
+func setupFileKeySet(t *testing.T, signers ...testSigner) (*jwt.KeySet, string) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwksDocument(signers...), 0o600); err != nil {
+		t.Fatalf("failed to write JWKS: %v", err)
+	}
+	keys, err := jwt.NewFileKeySet(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to load JWKS: %v", err)
+	}
+	keys.MinRefreshInterval = 0
+	return keys, path
+}
+
+func newVerifier(keys jwt.KeySource) *jwt.Verifier {
+	return &jwt.Verifier{Keys: keys, Issuer: testIssuer, Audience: testAudience, Leeway: 30 * time.Second}
+}
+
+/* Testcases for Verify */
+
+// Success: RS256, ES256 and EdDSA tokens verify against their JWKS entries
+func TestJWT_Algorithms(t *testing.T) {
+	signers := []testSigner{newSigner(t, jwt.RS256, "rsa-1"), newSigner(t, jwt.ES256, "ec-1"), newSigner(t, jwt.EdDSA, "ed-1")}
+	keys, _ := setupFileKeySet(t, signers...)
+	v := newVerifier(keys)
+
+	for _, s := range signers {
+		claims, err := v.Verify(context.Background(), s.sign(t, validClaims(map[string]any{"aud": []string{"other", testAudience}, "scope": "transfers:write"})))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", s.alg, err)
+			continue
+		}
+		if claims.Subject != "service-a" || claims.Issuer != testIssuer || string(claims.Extra["scope"]) != `"transfers:write"` {
+			t.Errorf("%s: unexpected claims %+v", s.alg, claims)
+		}
+	}
+}
+
+// Fail: Tokens with bad claims, signatures or algorithms are refused
+func TestJWT_Rejected(t *testing.T) {
+	rsaSigner := newSigner(t, jwt.RS256, "rsa-1")
+	ecSigner := newSigner(t, jwt.ES256, "ec-1")
+	keys, _ := setupFileKeySet(t, rsaSigner, ecSigner)
+	v := newVerifier(keys)
+	now := time.Now()
+
+	valid := ecSigner.sign(t, validClaims(nil))
+	parts := strings.Split(valid, ".")
+	tampered := parts[0] + "." + b64([]byte(`{"sub":"admin","iss":"`+testIssuer+`","aud":"`+testAudience+`","exp":9999999999}`)) + "." + parts[2]
+	header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "ec-1"})
+	unsigned := b64(header) + "." + parts[1] + "."
+
+	// HS256 keyed with the public key, the classic algorithm confusion attack
+	hsHeader, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa-1"})
+	mac := hmac.New(sha256.New, []byte(rsaSigner.jwk()["n"]))
+	mac.Write([]byte(b64(hsHeader) + "." + parts[1]))
+	confused := b64(hsHeader) + "." + parts[1] + "." + b64(mac.Sum(nil))
+
+	for name, tc := range map[string]struct {
+		token string
+		err   error
+	}{
+		"expired":        {ecSigner.sign(t, validClaims(map[string]any{"exp": now.Add(-time.Minute).Unix()})), jwt.ErrExpired},
+		"no exp":         {ecSigner.sign(t, validClaims(map[string]any{"exp": nil})), jwt.ErrExpired},
+		"not yet valid":  {ecSigner.sign(t, validClaims(map[string]any{"nbf": now.Add(time.Minute).Unix()})), jwt.ErrNotValidYet},
+		"issuer":         {ecSigner.sign(t, validClaims(map[string]any{"iss": "https://evil.example"})), jwt.ErrIssuer},
+		"audience":       {ecSigner.sign(t, validClaims(map[string]any{"aud": []string{"billing"}})), jwt.ErrAudience},
+		"no subject":     {ecSigner.sign(t, validClaims(map[string]any{"sub": nil})), jwt.ErrMalformed},
+		"bad exp":        {ecSigner.sign(t, validClaims(map[string]any{"exp": "tomorrow"})), jwt.ErrMalformed},
+		"tampered":       {tampered, jwt.ErrInvalidSignature},
+		"alg none":       {unsigned, jwt.ErrUnsupportedAlgorithm},
+		"hs256":          {confused, jwt.ErrUnsupportedAlgorithm},
+		"alg mismatch":   {rsaSigner.signAs(t, jwt.ES256, validClaims(nil)), jwt.ErrInvalidSignature},
+		"unknown kid":    {newSigner(t, jwt.EdDSA, "ed-9").sign(t, validClaims(nil)), jwt.ErrUnknownKey},
+		"wrong key, kid": {testSigner{kid: "ec-1", alg: jwt.ES256, key: newSigner(t, jwt.ES256, "x").key}.sign(t, validClaims(nil)), jwt.ErrInvalidSignature},
+		"malformed":      {"a.b", jwt.ErrMalformed},
+	} {
+		if _, err := v.Verify(context.Background(), tc.token); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", name, tc.err, err)
+		}
+	}
+
+	// Within the leeway a just-expired or not-quite-valid token is still accepted
+	for _, claims := range []map[string]any{{"exp": now.Add(-10 * time.Second).Unix()}, {"nbf": now.Add(10 * time.Second).Unix()}} {
+		if _, err := v.Verify(context.Background(), ecSigner.sign(t, validClaims(claims))); err != nil {
+			t.Errorf("expected %v to be within the leeway, got %v", claims, err)
+		}
+	}
+}
+
+// Fail: Keys that are too weak, off the curve or in a broken document are refused
+func TestJWT_ParseJWKS(t *testing.T) {
+	weak, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ec := newSigner(t, jwt.ES256, "ec-1").jwk()
+	ec["y"] = ec["x"]
+
+	for name, doc := range map[string]string{
+		"weak rsa":     `{"keys": [{"kid": "r", "kty": "RSA", "n": "` + b64(weak.N.Bytes()) + `", "e": "AQAB"}]}`,
+		"off curve":    `{"keys": [{"kid": "e", "kty": "EC", "crv": "P-256", "x": "` + ec["x"] + `", "y": "` + ec["y"] + `"}]}`,
+		"duplicate":    `{"keys": [{"kid": "d", "kty": "OKP", "crv": "Ed25519", "x": "` + newSigner(t, jwt.EdDSA, "d").jwk()["x"] + `"}, {"kid": "d", "kty": "OKP", "crv": "Ed25519", "x": "` + newSigner(t, jwt.EdDSA, "d").jwk()["x"] + `"}]}`,
+		"invalid json": `{"keys": [`,
+	} {
+		if _, err := jwt.ParseJWKS([]byte(doc)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	// Encryption keys and other algorithms are skipped, not errors
+	keys, err := jwt.ParseJWKS([]byte(`{"keys": [{"kid": "enc", "kty": "RSA", "use": "enc"}, {"kid": "hs", "kty": "oct", "k": "c2VjcmV0"}]}`))
+	if err != nil || len(keys) != 0 {
+		t.Errorf("expected both keys to be skipped, got %v %v", keys, err)
+	}
+}
+
+/* Testcases for key sets */
+
+// Success: Replacing the JWKS file rotates keys, a removed key stops verifying
+func TestJWT_FileRotation(t *testing.T) {
+	oldSigner := newSigner(t, jwt.EdDSA, "2026-01")
+	newSigner := newSigner(t, jwt.EdDSA, "2026-02")
+	keys, path := setupFileKeySet(t, oldSigner)
+	v := newVerifier(keys)
+
+	if _, err := v.Verify(context.Background(), newSigner.sign(t, validClaims(nil))); !errors.Is(err, jwt.ErrUnknownKey) {
+		t.Fatalf("expected the new key to be unknown, got %v", err)
+	}
+
+	// Both keys are published during the rotation, then only the new one
+	os.WriteFile(path, jwksDocument(oldSigner, newSigner), 0o600)
+	for _, s := range []testSigner{oldSigner, newSigner} {
+		if _, err := v.Verify(context.Background(), s.sign(t, validClaims(nil))); err != nil {
+			t.Errorf("%s: unexpected error during rotation: %v", s.kid, err)
+		}
+	}
+	os.WriteFile(path, jwksDocument(newSigner), 0o600)
+	keys.RefreshInterval = 0
+	if _, err := v.Verify(context.Background(), oldSigner.sign(t, validClaims(nil))); !errors.Is(err, jwt.ErrUnknownKey) {
+		t.Errorf("expected the retired key to be refused, got %v", err)
+	}
+}
+
+// Success: A JWKS URL is fetched once while fresh, again when due, and its last keys outlive an outage
+func TestJWT_RemoteKeySet(t *testing.T) {
+	first := newSigner(t, jwt.ES256, "ec-1")
+	second := newSigner(t, jwt.ES256, "ec-2")
+	var fetches atomic.Int32
+	var failing atomic.Bool
+	var doc atomic.Value
+	doc.Store(jwksDocument(first))
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if failing.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Write(doc.Load().([]byte))
+	}))
+	defer idp.Close()
+
+	keys, err := jwt.NewRemoteKeySet(idp.URL, idp.Client(), time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v := newVerifier(keys)
+	token := first.sign(t, validClaims(nil))
+	for i := 0; i < 5; i++ {
+		if _, err := v.Verify(context.Background(), token); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("expected the key set to be cached, fetched %d times", fetches.Load())
+	}
+
+	// Unknown keys only trigger a fetch once MinRefreshInterval has passed
+	doc.Store(jwksDocument(first, second))
+	if _, err := v.Verify(context.Background(), second.sign(t, validClaims(nil))); !errors.Is(err, jwt.ErrUnknownKey) || fetches.Load() != 1 {
+		t.Errorf("expected no fetch within MinRefreshInterval, got %v after %d fetches", err, fetches.Load())
+	}
+	keys.MinRefreshInterval = 0
+	if _, err := v.Verify(context.Background(), second.sign(t, validClaims(nil))); err != nil || fetches.Load() != 2 {
+		t.Errorf("expected the rotated key to be fetched, got %v after %d fetches", err, fetches.Load())
+	}
+
+	// An outage keeps the keys already loaded
+	failing.Store(true)
+	keys.RefreshInterval = 0
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Errorf("expected the cached key during the outage, got %v", err)
+	}
+	if fetches.Load() != 3 {
+		t.Errorf("expected a refresh attempt once due, fetched %d times", fetches.Load())
+	}
+
+	// Nothing can be verified without an initial load
+	if _, err := jwt.NewRemoteKeySet(idp.URL, idp.Client(), time.Hour); err == nil {
+		t.Errorf("expected the first load to fail")
+	}
+}
+
+/* Testcases for JWT authentication */
+
+// Server on the in-memory store accepting JWTs from a file key set
+func setupJWTServer(t *testing.T, signers ...testSigner) (*handlers.Server, http.Handler) {
+	srv, h := setupMemoryServer(t)
+	keys, _ := setupFileKeySet(t, signers...)
+	srv.JWT = newVerifier(keys)
+	return srv, h
+}
+
+// Success: A valid JWT is accepted and its subject is the principal, bad ones get 401 with the RFC 6750 challenge
+func TestAuth_JWT(t *testing.T) {
+	signer := newSigner(t, jwt.EdDSA, "ed-1")
+	srv, h := setupJWTServer(t, signer)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, bearerRequest(signer.sign(t, validClaims(nil)), http.MethodGet, "/v1/reconciliation", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the token to be accepted, got %d %s", w.Code, w.Body.String())
+	}
+
+	var subject, method string
+	srv.Authenticate(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := handlers.PrincipalFrom(r.Context())
+		subject, method = principal.ID, principal.Method
+	})(httptest.NewRecorder(), bearerRequest(signer.sign(t, validClaims(map[string]any{"sub": "payroll"})), http.MethodGet, "/", ""))
+	if subject != "payroll" || method != handlers.AuthMethodJWT {
+		t.Errorf("unexpected principal %q %q", subject, method)
+	}
+
+	for name, tc := range map[string]struct {
+		token string
+		code  string
+	}{
+		"expired":  {signer.sign(t, validClaims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})), handlers.CodeTokenExpired},
+		"audience": {signer.sign(t, validClaims(map[string]any{"aud": "billing"})), handlers.CodeInvalidToken},
+		"api key":  {"0123456789abcdef.secret", handlers.CodeInvalidToken},
+	} {
+		w, problem := callProblem(t, h, bearerRequest(tc.token, http.MethodGet, "/v1/reconciliation", ""))
+		if w.Code != http.StatusUnauthorized || problem.Code != tc.code || !strings.Contains(w.Header().Get("WWW-Authenticate"), `error="invalid_token"`) {
+			t.Errorf("%s: expected 401 %s, got %d %s %q", name, tc.code, w.Code, problem.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+// Success: With both methods on, API keys and JWTs are each accepted
+func TestAuth_JWTAndAPIKeys(t *testing.T) {
+	signer := newSigner(t, jwt.ES256, "ec-1")
+	srv, h := setupJWTServer(t, signer)
+	srv.APIKeyAuth = true
+	token, _ := createAPIKey(t, srv, false, models.RoleAdmin)
+
+	for name, credential := range map[string]string{"jwt": signer.sign(t, validClaims(nil)), "api key": token} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, bearerRequest(credential, http.MethodGet, "/v1/reconciliation", ""))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d %s", name, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Keys that can never be loaded
+type unavailableKeys struct{}
+
+func (unavailableKeys) Key(ctx context.Context, kid string) (jwt.Key, error) {
+	return jwt.Key{}, jwt.ErrKeysUnavailable
+}
+
+// Fail: When no keys can be loaded the server is at fault, a 503 rather than a 401
+func TestAuth_JWKSUnavailable(t *testing.T) {
+	signer := newSigner(t, jwt.EdDSA, "ed-1")
+	srv, h := setupMemoryServer(t)
+	srv.JWT = newVerifier(unavailableKeys{})
+
+	w, problem := callProblem(t, h, bearerRequest(signer.sign(t, validClaims(nil)), http.MethodGet, "/v1/reconciliation", ""))
+	if w.Code != http.StatusServiceUnavailable || problem.Code != handlers.CodeServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 503 with Retry-After, got %d %s", w.Code, problem.Code)
+	}
+}
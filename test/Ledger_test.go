@@ -0,0 +1,164 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"httpserver/handlers"
+	"httpserver/models"
+	"httpserver/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+// Expect a journal entry with two postings, moving amount from debitID to creditID
+func expectJournalEntry(mock sqlmock.Sqlmock, kind string, debitID int, creditID int, currency string, amount string) {
+	mock.ExpectQuery("INSERT INTO journal_entries").
+		WithArgs(kind, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(11))
+	mock.ExpectExec(`INSERT INTO postings \(journal_entry_id, account_id, currency, amount\) VALUES \(\$1, \$2, \$3, \$4\), \(\$1, \$5, \$6, \$7\)`).
+		WithArgs(11, debitID, currency, decimal.RequireFromString(amount).Neg(), creditID, currency, decimal.RequireFromString(amount)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+}
+
+// Expect the statements creating an account with an opening balance
+func expectCreateAccount(mock sqlmock.Sqlmock, accountID int, currency string, balance string) {
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO accounts").
+		WithArgs(accountID, decimal.RequireFromString(balance), currency, "", "standard").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectJournalEntry(mock, models.JournalOpeningBalance, models.EquityAccountID, accountID, currency, balance)
+	mock.ExpectCommit()
+}
+
+/* Testcases for PostJournalEntry */
+
+// Fail: Postings that do not sum to zero are never written
+func TestPostJournalEntry_Unbalanced(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	err := srv.Store.WithTx(context.Background(), func(tx store.Tx) error {
+		_, err := handlers.PostJournalEntry(tx, models.JournalTransfer, nil, []models.Posting{
+			{AccountID: 1, Currency: "SGD", Amount: decimal.RequireFromString("-10")},
+			{AccountID: 2, Currency: "SGD", Amount: decimal.RequireFromString("10.01")},
+		})
+		if !errors.Is(err, handlers.ErrUnbalancedEntry) {
+			t.Errorf("expected unbalanced entry error, got %v", err)
+		}
+
+		// Amounts only cancel out within the same currency
+		_, err = handlers.PostJournalEntry(tx, models.JournalTransfer, nil, []models.Posting{
+			{AccountID: 1, Currency: "SGD", Amount: decimal.RequireFromString("-10")},
+			{AccountID: 2, Currency: "USD", Amount: decimal.RequireFromString("10")},
+		})
+		return err
+	})
+	if !errors.Is(err, handlers.ErrUnbalancedEntry) {
+		t.Errorf("expected unbalanced entry error, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+/* Testcases for Reconcile */
+
+// Expect the reconciliation queries returning the given rows
+func expectReconcile(mock sqlmock.Sqlmock, accounts int, mismatches *sqlmock.Rows, unbalanced *sqlmock.Rows) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM accounts`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(accounts))
+	mock.ExpectQuery(`FROM accounts a\s+LEFT JOIN`).WillReturnRows(mismatches)
+	mock.ExpectQuery(`HAVING SUM\(amount\) <> 0`).WillReturnRows(unbalanced)
+	mock.ExpectRollback()
+}
+
+// Success: Cached balances match postings
+func TestReconcile_Balanced(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	expectReconcile(mock, 3,
+		sqlmock.NewRows([]string{"account_id", "balance", "total"}),
+		sqlmock.NewRows([]string{"journal_entry_id", "currency", "sum"}))
+
+	report, err := srv.Store.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !report.Balanced || report.AccountsChecked != 3 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: Mismatches and unbalanced entries are reported
+func TestReconcile_Mismatches(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	expectReconcile(mock, 3,
+		sqlmock.NewRows([]string{"account_id", "balance", "total"}).AddRow(2, "100.50", "100.00"),
+		sqlmock.NewRows([]string{"journal_entry_id", "currency", "sum"}).AddRow(7, "SGD", "0.01"))
+
+	report, err := srv.Store.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Balanced {
+		t.Errorf("expected report to be unbalanced")
+	}
+	if len(report.Mismatches) != 1 || report.Mismatches[0].AccountID != 2 || !report.Mismatches[0].Difference.Equal(decimal.RequireFromString("0.5")) {
+		t.Errorf("unexpected mismatches: %+v", report.Mismatches)
+	}
+	if len(report.UnbalancedEntries) != 1 || report.UnbalancedEntries[0].JournalEntryID != 7 || report.UnbalancedEntries[0].Currency != "SGD" {
+		t.Errorf("unexpected unbalanced entries: %+v", report.UnbalancedEntries)
+	}
+}
+
+// Fail: DB Error
+func TestReconcile_DBError(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	mock.ExpectBegin().WillReturnError(sql.ErrConnDone)
+
+	if _, err := srv.Store.Reconcile(context.Background()); err == nil {
+		t.Errorf("expected DB error, got nil")
+	}
+}
+
+/* Testcases for ReconciliationHandler */
+
+// Success: Report is returned as JSON
+func TestReconciliationHandler_Success(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	expectReconcile(mock, 1,
+		sqlmock.NewRows([]string{"account_id", "balance", "total"}).AddRow(1, "10", "0"),
+		sqlmock.NewRows([]string{"journal_entry_id", "currency", "sum"}))
+
+	req := httptest.NewRequest(http.MethodGet, "/reconciliation", nil)
+	w := httptest.NewRecorder()
+
+	srv.Routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var data map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+		t.Fatalf("failed to decode JSON: %v", err)
+	}
+	if data["balanced"] != false {
+		t.Errorf("expected balanced=false, got %v", data["balanced"])
+	}
+}
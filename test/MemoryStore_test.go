@@ -0,0 +1,95 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"httpserver/handlers"
+	"httpserver/models"
+	"httpserver/store"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// Server on the in-memory store, no database involved
+func setupMemoryServer(t *testing.T) (*handlers.Server, http.Handler) {
+	srv := handlers.NewServer(store.NewMemory())
+	setupFxRates(srv)
+	return srv, srv.Routes()
+}
+
+// Success: A snapshot restores accounts, history, used quotes and stored responses
+func TestMemoryStore_Snapshot(t *testing.T) {
+	srv, h := setupMemoryServer(t)
+
+	createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+	createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "USD"}`)
+	quote, err := srv.CreateFxQuote(context.Background(), "SGD", "USD", decimal.NewFromInt(10))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.NewFromInt(10), QuoteID: quote.QuoteID}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewBufferString(`{"account_id": 3, "initial_balance": "1", "currency": "SGD"}`))
+	req.Header.Set("Idempotency-Key", "key-1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := srv.Store.(*store.Memory).SaveSnapshot(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	loaded, err := store.LoadMemorySnapshot(path)
+	if err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	restored := handlers.NewServer(loaded)
+	setupFxRates(restored)
+
+	acc, err := restored.GetAccountByID(context.Background(), 2)
+	if err != nil || !acc.CurrentBalance.Equal(decimal.RequireFromString("57.41")) || acc.Currency != "USD" {
+		t.Errorf("unexpected restored account %+v %v", acc, err)
+	}
+	if _, err := restored.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.NewFromInt(10), QuoteID: quote.QuoteID}); !errors.Is(err, handlers.ErrQuoteNotFound) {
+		t.Errorf("expected used quote to stay used, got %v", err)
+	}
+
+	// IDs carry on from the snapshot
+	record, err := restored.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 3, Amount: decimal.NewFromInt(1)})
+	if err != nil || record.TransactionID != 2 {
+		t.Errorf("expected transaction 2, got %+v %v", record, err)
+	}
+
+	stored, err := loaded.GetIdempotencyKey(context.Background(), "key-1")
+	if err != nil || stored.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected stored response %+v %v", stored, err)
+	}
+	if report, err := loaded.Reconcile(context.Background()); err != nil || !report.Balanced {
+		t.Errorf("unexpected reconciliation %+v %v", report, err)
+	}
+}
+
+// Success: A missing snapshot starts empty, a corrupt one is refused
+func TestMemoryStore_LoadSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := store.LoadMemorySnapshot(filepath.Join(dir, "missing.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := m.GetAccount(context.Background(), 1); !errors.Is(err, store.ErrAccountNotFound) {
+		t.Errorf("expected empty store, got %v", err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	os.WriteFile(corrupt, []byte(`{"transactions": [{"transaction_id": 5}]}`), 0o600)
+	if _, err := store.LoadMemorySnapshot(corrupt); err == nil {
+		t.Errorf("expected error for transactions out of sequence")
+	}
+}
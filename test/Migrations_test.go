@@ -0,0 +1,321 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"httpserver/handlers"
+	"httpserver/migrations"
+	"httpserver/models"
+	"httpserver/store"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+// Expect the migration lock and the lookup of applied versions
+func expectMigrationLock(mock sqlmock.Sqlmock, applied ...int64) {
+	mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"version", "applied_at"})
+	for _, version := range applied {
+		rows.AddRow(version, time.Now())
+	}
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").WillReturnRows(rows)
+}
+
+/* Testcases for Parse and Load */
+
+// Success: Migrations are paired and ordered by version
+func TestParseMigrations(t *testing.T) {
+	files := fstest.MapFS{
+		"0010_later.up.sql":   {Data: []byte("SELECT 10")},
+		"0010_later.down.sql": {Data: []byte("SELECT -10")},
+		"0002_first.up.sql":   {Data: []byte("SELECT 2")},
+		"0002_first.down.sql": {Data: []byte("SELECT -2")},
+	}
+
+	got, err := migrations.Parse(files)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 || got[0].Version != 2 || got[1].Version != 10 {
+		t.Fatalf("unexpected migrations %+v", got)
+	}
+	if got[0].Name != "first" || got[0].Up != "SELECT 2" || got[0].Down != "SELECT -2" {
+		t.Errorf("unexpected migration %+v", got[0])
+	}
+}
+
+// Fail: Badly named or unpaired files are rejected
+func TestParseMigrations_Invalid(t *testing.T) {
+	cases := map[string]fstest.MapFS{
+		"missing down": {"0001_a.up.sql": {Data: []byte("SELECT 1")}},
+		"no version":   {"a.up.sql": {Data: []byte("SELECT 1")}, "a.down.sql": {Data: []byte("SELECT 1")}},
+		"no direction": {"0001_a.sql": {Data: []byte("SELECT 1")}},
+		"name differs": {"0001_a.up.sql": {Data: []byte("SELECT 1")}, "0001_b.down.sql": {Data: []byte("SELECT 1")}},
+	}
+	for name, files := range cases {
+		if _, err := migrations.Parse(files); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// Success: The embedded migrations fix the account ID type and forbid negative balances
+func TestLoadMigrations(t *testing.T) {
+	got, err := migrations.Load(migrations.Postgres)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) < 2 || got[0].Name != "baseline" {
+		t.Fatalf("unexpected migrations %+v", got)
+	}
+	if !strings.Contains(got[1].Up, "account_id TYPE BIGINT") || !strings.Contains(got[1].Up, "CHECK (balance >= 0)") {
+		t.Errorf("unexpected second migration:\n%s", got[1].Up)
+	}
+}
+
+/* Testcases for Up, Down and Statuses */
+
+// Success: Only pending migrations are applied, each in its own DB transaction
+func TestMigrateUp(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock DB: %v", err)
+	}
+	all, _ := migrations.Load(migrations.Postgres)
+
+	expectMigrationLock(mock, 1)
+	for _, m := range all[1:] {
+		mock.ExpectBegin()
+		mock.ExpectExec("ALTER TABLE|CREATE|DROP").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`INSERT INTO schema_migrations \(version, name\)`).
+			WithArgs(m.Version, m.Name).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := migrations.Up(mockDB, migrations.Postgres)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(applied) != len(all)-1 {
+		t.Errorf("expected %d migrations applied, got %d", len(all)-1, len(applied))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
+// Fail: A failing migration is rolled back, not recorded, and the lock released
+func TestMigrateUp_Failure(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock DB: %v", err)
+	}
+
+	expectMigrationLock(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS accounts").WillReturnError(errors.New("syntax error"))
+	mock.ExpectRollback()
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := migrations.Up(mockDB, migrations.Postgres)
+	if err == nil || !strings.Contains(err.Error(), "1_baseline") {
+		t.Errorf("expected error naming the migration, got %v", err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("expected nothing applied, got %+v", applied)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
+// Success: Down reverts the latest applied migration only
+func TestMigrateDown(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock DB: %v", err)
+	}
+
+	expectMigrationLock(mock, 1, 2)
+	mock.ExpectBegin()
+	mock.ExpectExec("DROP CONSTRAINT IF EXISTS accounts_balance_non_negative").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations").WithArgs(int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	reverted, err := migrations.Down(mockDB, migrations.Postgres, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reverted) != 1 || reverted[0].Version != 2 {
+		t.Errorf("unexpected reverted migrations %+v", reverted)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
+// Success: Status lists applied and pending migrations
+func TestMigrateStatus(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock DB: %v", err)
+	}
+
+	expectMigrationLock(mock, 1)
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	statuses, err := migrations.Statuses(mockDB, migrations.Postgres)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(statuses) < 2 || statuses[0].AppliedAt == nil || statuses[1].AppliedAt != nil {
+		t.Errorf("unexpected statuses %+v", statuses)
+	}
+}
+
+// Success: Migrations round trip against a real database
+func TestMigrate_RealDB(t *testing.T) {
+	db := setupRealDB(t)
+
+	if _, err := migrations.Down(db, migrations.Postgres, 1); err != nil {
+		t.Fatalf("failed to migrate down: %v", err)
+	}
+	applied, err := migrations.Up(db, migrations.Postgres)
+	if err != nil {
+		t.Fatalf("failed to migrate up: %v", err)
+	}
+	if len(applied) != 1 {
+		t.Errorf("expected the reverted migration to be reapplied, got %+v", applied)
+	}
+
+	// Negative balances are refused by the database itself
+	if _, err := db.Exec("INSERT INTO accounts (account_id, balance) VALUES (-100, -1)"); err == nil {
+		t.Errorf("expected check constraint violation")
+	}
+}
+
+// Success: Every dialect has the same migration versions
+func TestLoadMigrations_Dialects(t *testing.T) {
+	postgres, err := migrations.Load(migrations.Postgres)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sqlite, err := migrations.Load(migrations.SQLite)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(postgres) != len(sqlite) {
+		t.Fatalf("expected %d sqlite migrations, got %d", len(postgres), len(sqlite))
+	}
+	for i := range postgres {
+		if postgres[i].Version != sqlite[i].Version || postgres[i].Name != sqlite[i].Name {
+			t.Errorf("migration %d_%s has no sqlite equivalent, got %d_%s", postgres[i].Version, postgres[i].Name, sqlite[i].Version, sqlite[i].Name)
+		}
+	}
+}
+
+// Success: Migrations round trip against SQLite
+func TestMigrate_SQLite(t *testing.T) {
+	db := setupSQLiteDB(t)
+
+	if _, err := db.Exec("INSERT INTO accounts (account_id, balance, currency) VALUES (1, '10.50', 'SGD')"); err != nil {
+		t.Fatalf("failed to insert account: %v", err)
+	}
+	if _, err := migrations.Down(db, migrations.SQLite, 1); err != nil {
+		t.Fatalf("failed to migrate down: %v", err)
+	}
+	applied, err := migrations.Up(db, migrations.SQLite)
+	if err != nil {
+		t.Fatalf("failed to migrate up: %v", err)
+	}
+	if len(applied) != 1 {
+		t.Errorf("expected the reverted migration to be reapplied, got %+v", applied)
+	}
+
+	statuses, err := migrations.Statuses(db, migrations.SQLite)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			t.Errorf("expected %d_%s to be applied", s.Version, s.Name)
+		}
+	}
+
+	// Rows survive the table rebuild and negative balances are refused
+	var balance string
+	if err := db.QueryRow("SELECT balance FROM accounts WHERE account_id = 1").Scan(&balance); err != nil || balance != "10.50" {
+		t.Errorf("expected account to survive, got %q %v", balance, err)
+	}
+	if _, err := db.Exec("INSERT INTO accounts (account_id, balance) VALUES (2, '-1')"); err == nil {
+		t.Errorf("expected check constraint violation")
+	}
+}
+
+// Success: Accounts from before the ledger get an opening entry against equity and reconcile
+func TestMigrate_OpeningBalancesSQLite(t *testing.T) {
+	db := setupSQLiteDB(t)
+	srv := handlers.NewServer(store.NewSQLite(db))
+	ctx := context.Background()
+	srv.CreateAccount(ctx, 1, "SGD", decimal.NewFromInt(100), "", "")
+
+	if _, err := migrations.Down(db, migrations.SQLite, 1); err != nil {
+		t.Fatalf("failed to migrate down: %v", err)
+	}
+	for _, stmt := range []string{
+		"INSERT INTO accounts (account_id, balance, currency) VALUES (2, '25.50', 'SGD')",
+		"INSERT INTO accounts (account_id, balance, currency) VALUES (3, '7', 'USD')",
+		"INSERT INTO accounts (account_id, balance, currency) VALUES (4, '0', 'SGD')",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("failed to insert account: %v", err)
+		}
+	}
+	if report, _ := srv.Store.Reconcile(ctx); len(report.Mismatches) != 2 {
+		t.Fatalf("expected the accounts from before the ledger to mismatch, got %+v", report)
+	}
+
+	if _, err := migrations.Up(db, migrations.SQLite); err != nil {
+		t.Fatalf("failed to migrate up: %v", err)
+	}
+	report, err := srv.Store.Reconcile(ctx)
+	if err != nil || !report.Balanced || report.AccountsChecked != 4 {
+		t.Errorf("expected every account to reconcile, got %+v %v", report, err)
+	}
+
+	// Entries posted afterwards get IDs of their own
+	if _, err := srv.TransferCurrency(ctx, models.TransferRequest{SourceAccountID: 2, DestinationAccountID: 1, Amount: decimal.RequireFromString("5.50")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report, err := srv.Store.Reconcile(ctx); err != nil || !report.Balanced {
+		t.Errorf("expected the ledger to stay balanced, got %+v %v", report, err)
+	}
+}
+
+// Success: On Postgres the backfill covers what the postings of an older account do not explain
+func TestMigrate_OpeningBalancesRealDB(t *testing.T) {
+	db := setupRealDB(t)
+	if _, err := migrations.Down(db, migrations.Postgres, 1); err != nil {
+		t.Fatalf("failed to migrate down: %v", err)
+	}
+	createTestAccounts(t, db, map[int]string{990001: "40.25"})
+
+	if _, err := migrations.Up(db, migrations.Postgres); err != nil {
+		t.Fatalf("failed to migrate up: %v", err)
+	}
+	var posted, equity decimal.Decimal
+	err := db.QueryRow(`SELECT COALESCE(SUM(amount) FILTER (WHERE account_id = 990001), 0), COALESCE(SUM(amount) FILTER (WHERE account_id = -1), 0)
+		FROM postings WHERE journal_entry_id IN (SELECT journal_entry_id FROM postings WHERE account_id = 990001)`).Scan(&posted, &equity)
+	if err != nil || !posted.Equal(decimal.RequireFromString("40.25")) || !equity.Equal(posted.Neg()) {
+		t.Errorf("expected an opening entry of 40.25 against equity, got %s and %s %v", posted, equity, err)
+	}
+}
@@ -0,0 +1,273 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"httpserver/api"
+	"httpserver/handlers"
+	"httpserver/models"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+// Sends requests through the router and checks each response against the spec
+type contract struct {
+	t      *testing.T
+	h      http.Handler
+	spec   *openapi3.T
+	router routers.Router
+	seen   map[string]bool
+
+	// Sent with every call unless the call sets them itself
+	headers http.Header
+}
+
+func newContract(t *testing.T, h http.Handler) *contract {
+	spec, err := openapi3.NewLoader().LoadFromData(api.Spec)
+	if err != nil {
+		t.Fatalf("failed to load spec: %v", err)
+	}
+	if err := spec.Validate(context.Background()); err != nil {
+		t.Fatalf("invalid spec: %v", err)
+	}
+	router, err := gorillamux.NewRouter(spec)
+	if err != nil {
+		t.Fatalf("failed to route spec: %v", err)
+	}
+	return &contract{t: t, h: h, spec: spec, router: router, seen: map[string]bool{}, headers: http.Header{}}
+}
+
+// Send a request expecting status, the request must be valid too when it is expected to succeed
+func (c *contract) call(method string, path string, body string, status int, headers ...string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for name, values := range c.headers {
+			req.Header[name] = values
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		return req
+	}
+
+	w := httptest.NewRecorder()
+	c.h.ServeHTTP(w, newRequest())
+	if w.Code != status {
+		c.t.Errorf("%s %s: expected %d, got %d %s", method, path, status, w.Code, w.Body.String())
+	}
+
+	req := newRequest()
+	route, params, err := c.router.FindRoute(req)
+	if err != nil {
+		c.t.Errorf("%s %s is not in the spec: %v", method, path, err)
+		return w
+	}
+	c.seen[route.Method+" "+route.Path] = true
+
+	options := &openapi3filter.Options{IncludeResponseStatus: true, MultiError: true, AuthenticationFunc: hasCredentials}
+	input := &openapi3filter.RequestValidationInput{Request: req, PathParams: params, Route: route, Options: options}
+	if status < 400 {
+		if err := openapi3filter.ValidateRequest(context.Background(), input); err != nil {
+			c.t.Errorf("%s %s: request does not match the spec: %v", method, path, err)
+		}
+	}
+	err = openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 w.Code,
+		Header:                 w.Header(),
+		Body:                   io.NopCloser(bytes.NewReader(w.Body.Bytes())),
+		Options:                options,
+	})
+	if err != nil {
+		c.t.Errorf("%s %s: %d response does not match the spec: %v\n%s", method, path, w.Code, err, w.Body.String())
+	}
+	return w
+}
+
+// A security requirement of the spec is met when its header is present, the server checks the values
+func hasCredentials(ctx context.Context, input *openapi3filter.AuthenticationInput) error {
+	header := input.SecurityScheme.Name
+	if input.SecurityScheme.Type == "http" {
+		header = "Authorization"
+	}
+	if input.RequestValidationInput.Request.Header.Get(header) == "" {
+		return fmt.Errorf("missing %s", header)
+	}
+	return nil
+}
+
+// Fail the test for every operation in the spec no call went through
+func (c *contract) checkCoverage() {
+	var missing []string
+	for path, item := range c.spec.Paths.Map() {
+		for method := range item.Operations() {
+			if !c.seen[method+" "+path] {
+				missing = append(missing, method+" "+path)
+			}
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		c.t.Errorf("operations never exercised: %v", missing)
+	}
+}
+
+/* Testcases for the OpenAPI document */
+
+// Success: Every response of every operation, successes and errors, matches the spec
+func TestOpenAPI_Contract(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		srv.LegacySunset = time.Now().Add(time.Hour)
+		srv.APIKeyAuth = true
+		c := newContract(t, h)
+
+		// Refused without credentials, then authenticated with a key
+		c.call(http.MethodGet, "/v1/reconciliation", "", http.StatusUnauthorized)
+		token, _ := createAPIKey(t, srv, false, models.RoleAdmin)
+		admin := "Bearer " + token
+		c.headers.Set("Authorization", admin)
+
+		// Accounts
+		c.call(http.MethodPost, "/v1/accounts", `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD", "owner": "cust-1"}`, http.StatusCreated)
+		c.call(http.MethodPost, "/v1/accounts", `{"account_id": 2, "initial_balance": "0", "currency": "USD"}`, http.StatusCreated, "Idempotency-Key", "create-2")
+		c.call(http.MethodPost, "/v1/accounts", `{"account_id": 2, "initial_balance": "0", "currency": "USD"}`, http.StatusCreated, "Idempotency-Key", "create-2")
+		c.call(http.MethodPost, "/v1/accounts", `{"account_id": 3, "initial_balance": "0", "currency": "USD"}`, http.StatusUnprocessableEntity, "Idempotency-Key", "create-2")
+		c.call(http.MethodPost, "/v1/accounts", `{"account_id": 1, "initial_balance": "1", "currency": "SGD"}`, http.StatusConflict)
+		c.call(http.MethodPost, "/v1/accounts", `{"account_id": 4, "initial_balance": "1.001", "currency": "SGD"}`, http.StatusBadRequest)
+		c.call(http.MethodPost, "/v1/accounts", `{invalid`, http.StatusBadRequest)
+		c.call(http.MethodGet, "/v1/accounts/1", "", http.StatusOK)
+		c.call(http.MethodGet, "/v1/accounts/99", "", http.StatusNotFound)
+
+		// Quotes and transfers
+		w := c.call(http.MethodPost, "/v1/fx/quotes", `{"source_currency": "SGD", "destination_currency": "USD", "amount": "10"}`, http.StatusCreated)
+		var quote struct {
+			QuoteID string `json:"quote_id"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &quote)
+		c.call(http.MethodPost, "/v1/fx/quotes", `{"source_currency": "SGD", "destination_currency": "SGD", "amount": "10"}`, http.StatusBadRequest)
+		c.call(http.MethodPost, "/v1/fx/quotes", `{"source_currency": "SGD", "destination_currency": "EUR", "amount": "10"}`, http.StatusUnprocessableEntity)
+		c.call(http.MethodPost, "/v1/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "10", "quote_id": "`+quote.QuoteID+`"}`, http.StatusCreated)
+		c.call(http.MethodPost, "/v1/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "5", "convert": true}`, http.StatusCreated)
+		c.call(http.MethodPost, "/v1/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "500", "convert": true}`, http.StatusBadRequest)
+		c.call(http.MethodPost, "/v1/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "5", "quote_id": "q_missing"}`, http.StatusUnprocessableEntity)
+		c.call(http.MethodGet, "/v1/transactions/1", "", http.StatusOK)
+		c.call(http.MethodGet, "/v1/transactions/99", "", http.StatusNotFound)
+
+		// Past the velocity limit of its tier
+		srv.VelocityLimits = models.VelocityLimits{"capped": {Window: time.Hour, MaxCount: 1}}
+		c.call(http.MethodPost, "/v1/accounts", `{"account_id": 6, "initial_balance": "10", "currency": "SGD", "tier": "capped"}`, http.StatusCreated)
+		c.call(http.MethodPost, "/v1/transactions", `{"source_account_id": 6, "destination_account_id": 1, "amount": "1"}`, http.StatusCreated)
+		c.call(http.MethodPost, "/v1/transactions", `{"source_account_id": 6, "destination_account_id": 1, "amount": "1"}`, http.StatusUnprocessableEntity)
+
+		// History and reconciliation
+		w = c.call(http.MethodGet, "/v1/accounts/1/transactions?limit=1", "", http.StatusOK)
+		var page struct {
+			NextCursor string `json:"next_cursor"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &page)
+		c.call(http.MethodGet, "/v1/accounts/1/transactions?limit=1&cursor="+page.NextCursor, "", http.StatusOK)
+		c.call(http.MethodGet, "/v1/accounts/1/transactions?limit=0", "", http.StatusBadRequest)
+		c.call(http.MethodGet, "/v1/accounts/99/transactions", "", http.StatusNotFound)
+		c.call(http.MethodGet, "/v1/reconciliation", "", http.StatusOK)
+
+		// Refused for a customer who owns none of the accounts
+		customer, _ := createAPIKey(t, srv, false, models.RoleCustomer)
+		c.headers.Set("Authorization", "Bearer "+customer)
+		c.call(http.MethodGet, "/v1/accounts/1", "", http.StatusForbidden)
+		c.headers.Set("Authorization", admin)
+
+		// Deprecated aliases
+		c.call(http.MethodPost, "/accounts", `{"account_id": 5, "initial_balance": "50", "currency": "SGD"}`, http.StatusNoContent)
+		c.call(http.MethodGet, "/accounts/5", "", http.StatusOK)
+		c.call(http.MethodPost, "/transactions", `{"source_account_id": 5, "destination_account_id": 1, "amount": "5"}`, http.StatusOK)
+		c.call(http.MethodPost, "/transactions", `{"source_account_id": 5, "destination_account_id": 2, "amount": "5", "convert": true}`, http.StatusOK)
+		c.call(http.MethodGet, "/transactions/3", "", http.StatusOK)
+		c.call(http.MethodGet, "/accounts/5/transactions", "", http.StatusOK)
+		c.call(http.MethodGet, "/reconciliation", "", http.StatusOK)
+		c.call(http.MethodPost, "/fx/quotes", `{"source_currency": "SGD", "destination_currency": "USD", "amount": "1"}`, http.StatusCreated)
+
+		// Over the rate limit
+		srv.RateLimit = handlers.RateLimit{Rate: 0.001, Burst: 1}
+		c.call(http.MethodGet, "/v1/reconciliation", "", http.StatusOK)
+		c.call(http.MethodGet, "/v1/reconciliation", "", http.StatusTooManyRequests)
+		srv.RateLimit = handlers.RateLimit{}
+
+		// Past the sunset
+		srv.LegacySunset = time.Now().Add(-time.Hour)
+		c.call(http.MethodGet, "/accounts/5", "", http.StatusGone)
+
+		c.checkCoverage()
+	})
+}
+
+// Success: The document and the page to browse it are served
+func TestOpenAPI_Served(t *testing.T) {
+	_, h := setupMemoryServer(t)
+
+	w := call(t, h, http.MethodGet, "/openapi.json", "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" || !bytes.Equal(w.Body.Bytes(), api.Spec) {
+		t.Errorf("expected the spec, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	w = call(t, h, http.MethodGet, "/docs", "", nil)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "/openapi.json") {
+		t.Errorf("expected the docs page, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+// Success: Every error code the handlers use is listed in the spec
+func TestOpenAPI_ErrorCodes(t *testing.T) {
+	var spec struct {
+		Components struct {
+			Schemas struct {
+				Problem struct {
+					Properties struct {
+						Code struct {
+							Enum []string `json:"enum"`
+						} `json:"code"`
+					} `json:"properties"`
+				} `json:"Problem"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(api.Spec, &spec); err != nil {
+		t.Fatalf("invalid spec: %v", err)
+	}
+	listed := map[string]bool{}
+	for _, code := range spec.Components.Schemas.Problem.Properties.Code.Enum {
+		listed[code] = true
+	}
+
+	for _, code := range []string{
+		handlers.CodeNotFound, handlers.CodeMethodNotAllowed, handlers.CodeVersionRetired, handlers.CodeUnauthenticated, handlers.CodeInvalidAPIKey,
+		handlers.CodeSignatureRequired, handlers.CodeInvalidSignature, handlers.CodeSignatureExpired, handlers.CodeSignatureReplayed,
+		handlers.CodeInvalidToken, handlers.CodeTokenExpired, handlers.CodeForbidden,
+		handlers.CodeInvalidJSON, handlers.CodeInvalidBody,
+		handlers.CodeValidationFailed, handlers.CodeAccountNotFound, handlers.CodeDuplicateAccount, handlers.CodeTransactionNotFound,
+		handlers.CodeSameAccount, handlers.CodeSourceNotFound, handlers.CodeDestinationNotFound, handlers.CodeInsufficientFunds,
+		handlers.CodeCurrencyMismatch, handlers.CodeAmountTooPrecise, handlers.CodeConversionTooSmall, handlers.CodeQuoteNotFound,
+		handlers.CodeQuoteExpired, handlers.CodeQuoteMismatch, handlers.CodeRateUnavailable, handlers.CodeIdempotencyKeyReused,
+		handlers.CodeIdempotencyKeyInProgress, handlers.CodeConflict, handlers.CodeConstraintViolation, handlers.CodeTransactionConflict,
+		handlers.CodeServiceUnavailable, handlers.CodeTimeout, handlers.CodeClientClosedRequest, handlers.CodeInternal,
+	} {
+		if !listed[code] {
+			t.Errorf("error code %s is missing from the spec", code)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"httpserver/handlers"
+	"httpserver/jwt"
+	"httpserver/models"
+	"httpserver/store"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+/* Testcases for the role policy */
+
+// Success: Every role gets exactly the access the policy grants, on every endpoint
+func TestPolicy_Roles(t *testing.T) {
+	srv, h := setupAuthServer(t)
+	tokens, ids := map[string]string{}, map[string]string{}
+	for _, role := range models.Roles {
+		tokens[role], ids[role] = createAPIKey(t, srv, false, role)
+	}
+	customerID := ids[models.RoleCustomer]
+
+	// Account 1 is the customer's, 2 someone else's and 3 nobody's
+	ctx := context.Background()
+	srv.CreateAccount(ctx, 1, "SGD", decimal.NewFromInt(1000), customerID, "")
+	srv.CreateAccount(ctx, 2, "SGD", decimal.NewFromInt(1000), "someone-else", "")
+	srv.CreateAccount(ctx, 3, "SGD", decimal.NewFromInt(1000), "", "")
+	into, _ := srv.TransferCurrency(ctx, models.TransferRequest{SourceAccountID: 3, DestinationAccountID: 1, Amount: decimal.NewFromInt(1)})
+	between, _ := srv.TransferCurrency(ctx, models.TransferRequest{SourceAccountID: 2, DestinationAccountID: 3, Amount: decimal.NewFromInt(1)})
+
+	nextAccount := 100
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		body   string
+
+		// Status for customer, auditor, operator and admin
+		want [4]int
+	}{
+		{"read own account", http.MethodGet, "/v1/accounts/1", "", [4]int{200, 200, 200, 200}},
+		{"read other account", http.MethodGet, "/v1/accounts/2", "", [4]int{403, 200, 200, 200}},
+		{"read missing account", http.MethodGet, "/v1/accounts/99", "", [4]int{403, 404, 404, 404}},
+		{"read own history", http.MethodGet, "/v1/accounts/1/transactions", "", [4]int{200, 200, 200, 200}},
+		{"read other history", http.MethodGet, "/accounts/2/transactions", "", [4]int{403, 200, 200, 200}},
+		{"read transfer into own", http.MethodGet, "/v1/transactions/" + strconv.FormatInt(into.TransactionID, 10), "", [4]int{200, 200, 200, 200}},
+		{"read other transfer", http.MethodGet, "/v1/transactions/" + strconv.FormatInt(between.TransactionID, 10), "", [4]int{403, 200, 200, 200}},
+		{"read missing transfer", http.MethodGet, "/v1/transactions/99999", "", [4]int{403, 404, 404, 404}},
+		{"debit own account", http.MethodPost, "/v1/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "1"}`, [4]int{201, 403, 201, 201}},
+		{"debit other account", http.MethodPost, "/v1/transactions", `{"source_account_id": 2, "destination_account_id": 1, "amount": "1"}`, [4]int{403, 403, 201, 201}},
+		{"debit missing account", http.MethodPost, "/transactions", `{"source_account_id": 99, "destination_account_id": 1, "amount": "1"}`, [4]int{403, 403, 400, 400}},
+		{"create account", http.MethodPost, "/v1/accounts", `{"account_id": %d, "initial_balance": "0", "currency": "SGD", "owner": "cust-9"}`, [4]int{403, 403, 201, 201}},
+		{"quote", http.MethodPost, "/v1/fx/quotes", `{"source_currency": "SGD", "destination_currency": "USD", "amount": "10"}`, [4]int{201, 403, 201, 201}},
+		{"reconcile", http.MethodGet, "/v1/reconciliation", "", [4]int{403, 200, 403, 200}},
+	} {
+		for i, role := range models.Roles {
+			body := tc.body
+			if strings.Contains(body, "%d") {
+				nextAccount++
+				body = fmt.Sprintf(body, nextAccount)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, bearerRequest(tokens[role], tc.method, tc.path, body))
+			if w.Code != tc.want[i] {
+				t.Errorf("%s as %s: expected %d, got %d %s", tc.name, role, tc.want[i], w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusForbidden && !strings.Contains(w.Body.String(), `"code":"forbidden"`) {
+				t.Errorf("%s as %s: expected code forbidden, got %s", tc.name, role, w.Body.String())
+			}
+		}
+	}
+}
+
+// Success: A refused transfer moves no money, and created accounts report their owner
+func TestPolicy_RefusedTransfer(t *testing.T) {
+	srv, h := setupAuthServer(t)
+	customer, _ := createAPIKey(t, srv, false, models.RoleCustomer)
+	operator, _ := createAPIKey(t, srv, false, models.RoleOperator)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, bearerRequest(operator, http.MethodPost, "/v1/accounts", `{"account_id": 1, "initial_balance": "50", "currency": "SGD", "owner": "cust-1"}`))
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"owner":"cust-1"`) {
+		t.Fatalf("expected the account with its owner, got %d %s", w.Code, w.Body.String())
+	}
+	srv.CreateAccount(context.Background(), 2, "SGD", decimal.Zero, "", "")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, bearerRequest(customer, http.MethodPost, "/v1/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "50"}`))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d %s", w.Code, w.Body.String())
+	}
+	acc, _ := srv.Store.GetAccount(context.Background(), 1)
+	if !acc.CurrentBalance.Equal(decimal.NewFromInt(50)) || acc.Owner != "cust-1" {
+		t.Errorf("expected the account untouched, got %s owned by %q", acc.CurrentBalance, acc.Owner)
+	}
+	if w, _ := callProblem(t, h, bearerRequest(operator, http.MethodPost, "/v1/accounts", `{"account_id": 3, "initial_balance": "0", "currency": "SGD", "owner": "`+strings.Repeat("x", 256)+`"}`)); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an overlong owner to be refused, got %d", w.Code)
+	}
+}
+
+// Failure: An Idempotency-Key is only replayed to the caller who used it, while they may still take action
+func TestPolicy_IdempotencyKeyOfAnotherCaller(t *testing.T) {
+	srv, h := setupAuthServer(t)
+	first, firstID := createAPIKey(t, srv, false, models.RoleCustomer)
+	second, _ := createAPIKey(t, srv, false, models.RoleCustomer)
+	auditor, _ := createAPIKey(t, srv, false, models.RoleAuditor)
+	srv.CreateAccount(context.Background(), 1, "SGD", decimal.NewFromInt(100), firstID, "")
+	srv.CreateAccount(context.Background(), 2, "SGD", decimal.Zero, "", "")
+
+	body := `{"source_account_id": 1, "destination_account_id": 2, "amount": "10"}`
+	transfer := func(token string) *httptest.ResponseRecorder {
+		req := bearerRequest(token, http.MethodPost, "/v1/transactions", body)
+		req.Header.Set("Idempotency-Key", "transfer-1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	if w := transfer(first); w.Code != http.StatusCreated {
+		t.Fatalf("expected the transfer, got %d %s", w.Code, w.Body.String())
+	}
+	if w := transfer(first); w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the owner's retry replayed, got %d %v", w.Code, w.Header())
+	}
+
+	for token, want := range map[string]int{second: http.StatusUnprocessableEntity, auditor: http.StatusForbidden} {
+		w := transfer(token)
+		if w.Code != want || w.Header().Get("Idempotent-Replayed") != "" || strings.Contains(w.Body.String(), `"source_balance"`) {
+			t.Errorf("expected %d without the replay, got %d %s", want, w.Code, w.Body.String())
+		}
+	}
+	if acc, _ := srv.Store.GetAccount(context.Background(), 1); !acc.CurrentBalance.Equal(decimal.NewFromInt(90)) {
+		t.Errorf("expected a single transfer, got balance %s", acc.CurrentBalance)
+	}
+}
+
+// Success: JWT callers own accounts by subject and get the role in the role claim, unknown roles get nothing
+func TestPolicy_JWTRoles(t *testing.T) {
+	signer := newSigner(t, jwt.EdDSA, "ed-1")
+	srv, h := setupJWTServer(t, signer)
+	srv.JWTRoleClaim = "https://transfers/role"
+	srv.CreateAccount(context.Background(), 1, "SGD", decimal.NewFromInt(10), "cust-1", "")
+
+	for name, tc := range map[string]struct {
+		claims map[string]any
+		want   int
+	}{
+		"owner":         {map[string]any{"sub": "cust-1", "https://transfers/role": models.RoleCustomer}, http.StatusOK},
+		"other":         {map[string]any{"sub": "cust-2", "https://transfers/role": models.RoleCustomer}, http.StatusForbidden},
+		"auditor":       {map[string]any{"sub": "audit", "https://transfers/role": models.RoleAuditor}, http.StatusOK},
+		"default claim": {map[string]any{"sub": "cust-1", "role": models.RoleAdmin}, http.StatusForbidden},
+		"unknown role":  {map[string]any{"sub": "cust-1", "https://transfers/role": "superuser"}, http.StatusForbidden},
+		"not a string":  {map[string]any{"sub": "cust-1", "https://transfers/role": []string{models.RoleAdmin}}, http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, bearerRequest(signer.sign(t, validClaims(tc.claims)), http.MethodGet, "/v1/accounts/1", ""))
+		if w.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d %s", name, tc.want, w.Code, w.Body.String())
+		}
+	}
+}
+
+/* Testcases for owners and roles in the stores */
+
+// Success: Owners and key roles round trip on every embedded store
+func TestStores_OwnersAndRoles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		if err := srv.CreateAccount(context.Background(), 1, "SGD", decimal.Zero, "cust-1", ""); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		acc, err := srv.Store.GetAccount(context.Background(), 1)
+		if err != nil || acc.Owner != "cust-1" {
+			t.Errorf("expected owner cust-1, got %+v %v", acc, err)
+		}
+
+		_, keyID := createAPIKey(t, srv, false, models.RoleAuditor)
+		key, err := srv.Store.GetAPIKey(context.Background(), keyID)
+		if err != nil || key.Role != models.RoleAuditor {
+			t.Errorf("expected role auditor, got %+v %v", key, err)
+		}
+	})
+}
+
+// Success: Keys in a snapshot saved before roles keep full access
+func TestMemoryStore_SnapshotKeysBeforeRoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	os.WriteFile(path, []byte(`{"accounts": [], "api_keys": [{"key_id": "3f9c2a17d04b6e85", "name": "old", "secret_hash": "", "created_at": "2026-01-01T00:00:00Z"}]}`), 0o600)
+
+	restored, err := store.LoadMemorySnapshot(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	key, err := restored.GetAPIKey(context.Background(), "3f9c2a17d04b6e85")
+	if err != nil || key.Role != models.RoleAdmin {
+		t.Errorf("expected role admin, got %+v %v", key, err)
+	}
+}
@@ -0,0 +1,145 @@
+package test
+
+import (
+	"httpserver/handlers"
+	"httpserver/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/* Testcases for the rate limit */
+
+// Success: Every response says what is left, the request past the burst gets 429 with when to retry
+func TestRateLimit_Headers(t *testing.T) {
+	srv, h := setupMemoryServer(t)
+	srv.RateLimit = handlers.RateLimit{Rate: 0.5, Burst: 3}
+
+	for want := 2; want >= 0; want-- {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/reconciliation", nil))
+		if w.Code != http.StatusOK || w.Header().Get(handlers.RateLimitRemainingHeader) != strconv.Itoa(want) {
+			t.Errorf("expected 200 with %d remaining, got %d %q", want, w.Code, w.Header().Get(handlers.RateLimitRemainingHeader))
+		}
+		if w.Header().Get(handlers.RateLimitLimitHeader) != "3" || w.Header().Get(handlers.RateLimitPolicyHeader) != "3;w=6" {
+			t.Errorf("unexpected limit headers %v", w.Header())
+		}
+	}
+
+	w, problem := callProblem(t, h, httptest.NewRequest(http.MethodGet, "/v1/reconciliation", nil))
+	if w.Code != http.StatusTooManyRequests || problem.Code != handlers.CodeRateLimited {
+		t.Errorf("expected 429 rate_limited, got %d %+v", w.Code, problem)
+	}
+	if w.Header().Get("Retry-After") != "2" || w.Header().Get(handlers.RateLimitRemainingHeader) != "0" {
+		t.Errorf("expected a retry after 2 seconds, got %v", w.Header())
+	}
+}
+
+// Success: Each principal has its own bucket, which refills over time
+func TestRateLimit_PerPrincipal(t *testing.T) {
+	srv, h := setupAuthServer(t)
+	srv.RateLimit = handlers.RateLimit{Rate: 20, Burst: 1}
+	first, _ := createAPIKey(t, srv, false, models.RoleAdmin)
+	second, _ := createAPIKey(t, srv, false, models.RoleAuditor)
+
+	status := func(token string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, bearerRequest(token, http.MethodGet, "/v1/reconciliation", ""))
+		return w.Code
+	}
+	if got := []int{status(first), status(first), status(second)}; got[0] != http.StatusOK || got[1] != http.StatusTooManyRequests || got[2] != http.StatusOK {
+		t.Errorf("expected 200, 429 then 200 for another principal, got %v", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := status(first); got != http.StatusOK {
+		t.Errorf("expected the bucket refilled, got %d", got)
+	}
+}
+
+// Success: Without authentication callers are told apart by address, public documents are not limited
+func TestRateLimit_PerAddress(t *testing.T) {
+	srv, h := setupMemoryServer(t)
+	srv.RateLimit = handlers.RateLimit{Rate: 0.001, Burst: 1}
+
+	status := func(path string, addr string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = addr
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	if got := []int{status("/v1/reconciliation", "192.0.2.1:1000"), status("/v1/reconciliation", "192.0.2.1:2000"), status("/v1/reconciliation", "192.0.2.2:1000")}; got[0] != http.StatusOK || got[1] != http.StatusTooManyRequests || got[2] != http.StatusOK {
+		t.Errorf("expected 200, 429 from the same address then 200, got %v", got)
+	}
+	for i := 0; i < 3; i++ {
+		if got := status("/openapi.json", "192.0.2.1:1000"); got != http.StatusOK {
+			t.Errorf("expected the document served, got %d", got)
+		}
+	}
+}
+
+// Success: Parallel requests get exactly the burst through
+func TestRateLimit_Concurrent(t *testing.T) {
+	srv, h := setupMemoryServer(t)
+	srv.RateLimit = handlers.RateLimit{Rate: 0.001, Burst: 10}
+
+	var wg sync.WaitGroup
+	var allowed atomic.Int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/reconciliation", nil))
+			if w.Code == http.StatusOK {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed.Load() != 10 {
+		t.Errorf("expected exactly 10 requests allowed, got %d", allowed.Load())
+	}
+}
+
+// Failure: Failed authentications are charged to the address, once it runs out it is refused before any lookup
+func TestRateLimit_FailedAuthentication(t *testing.T) {
+	srv, h := setupAuthServer(t)
+	srv.RateLimit = handlers.RateLimit{Rate: 0.001, Burst: 3}
+	token, keyID := createAPIKey(t, srv, false, models.RoleAdmin)
+
+	guess := func(token string, addr string) *httptest.ResponseRecorder {
+		req := bearerRequest(token, http.MethodGet, "/v1/reconciliation", "")
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	for want := 2; want >= 0; want-- {
+		w := guess(keyID+".wrong", "192.0.2.1:1000")
+		if w.Code != http.StatusUnauthorized || w.Header().Get(handlers.RateLimitRemainingHeader) != strconv.Itoa(want) {
+			t.Errorf("expected 401 with %d remaining, got %d %q", want, w.Code, w.Header().Get(handlers.RateLimitRemainingHeader))
+		}
+	}
+
+	w, problem := callProblem(t, h, func() *http.Request {
+		req := bearerRequest(keyID+".wrong", http.MethodGet, "/v1/reconciliation", "")
+		req.RemoteAddr = "192.0.2.1:1000"
+		return req
+	}())
+	if w.Code != http.StatusTooManyRequests || problem.Code != handlers.CodeRateLimited || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 rate_limited with Retry-After, got %d %+v", w.Code, problem)
+	}
+	if w := guess(token, "192.0.2.1:2000"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the address refused whatever it sends, got %d", w.Code)
+	}
+	if w := guess(token, "192.0.2.2:1000"); w.Code != http.StatusOK {
+		t.Errorf("expected other addresses unaffected, got %d %s", w.Code, w.Body.String())
+	}
+}
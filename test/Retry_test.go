@@ -0,0 +1,136 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"httpserver/handlers"
+	"httpserver/models"
+	"httpserver/store"
+	"httpserver/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
+)
+
+// Server on a mock DB that retries without waiting
+func setupRetryServer(t *testing.T, maxRetries int) (*handlers.Server, sqlmock.Sqlmock) {
+	srv, mock := setupMockDB(t)
+	srv.TransferRetry = handlers.RetryPolicy{MaxRetries: maxRetries, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	return srv, mock
+}
+
+// Expect an attempt that fails with a deadlock while locking the first account
+func expectDeadlock(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockQuery).WithArgs(1).WillReturnError(&pq.Error{Code: "40P01"})
+	mock.ExpectRollback()
+}
+
+/* Testcases for retrying transfers */
+
+// Success: A transfer that deadlocks once is run again and commits
+func TestTransferCurrency_RetriesDeadlock(t *testing.T) {
+	srv, mock := setupRetryServer(t, 3)
+
+	expectDeadlock(mock)
+	expectTransfer(mock)
+	mock.ExpectCommit()
+
+	record, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.NewFromInt(20)})
+	if err != nil || record.TransactionID != 7 {
+		t.Fatalf("expected transaction 7, got %+v %v", record, err)
+	}
+	if retries := srv.RetryStats.Retries.Load(); retries != 1 {
+		t.Errorf("expected 1 retry, got %d", retries)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: A serialization failure on commit is retried until the budget runs out, then a 503
+func TestTransactionHandler_RetriesExhausted(t *testing.T) {
+	srv, mock := setupRetryServer(t, 2)
+
+	// The first attempt plus two retries, each losing at commit
+	for i := 0; i < 3; i++ {
+		expectTransfer(mock)
+		mock.ExpectCommit().WillReturnError(&pq.Error{Code: "40001"})
+	}
+
+	body := `{"source_account_id": 1, "destination_account_id": 2, "amount": "20"}`
+	w := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/transactions", bytes.NewBufferString(body)))
+
+	var problem utils.Problem
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	if w.Code != http.StatusServiceUnavailable || problem.Code != handlers.CodeTransactionConflict || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 503 transaction_conflict with Retry-After, got %d %+v", w.Code, problem)
+	}
+	if srv.RetryStats.Retries.Load() != 2 || srv.RetryStats.Exhausted.Load() != 1 {
+		t.Errorf("expected 2 retries and 1 exhausted, got %d and %d", srv.RetryStats.Retries.Load(), srv.RetryStats.Exhausted.Load())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: Errors retrying cannot fix are returned after one attempt
+func TestTransferCurrency_NoRetryForOtherErrors(t *testing.T) {
+	srv, mock := setupRetryServer(t, 3)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockQuery).WithArgs(1).WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.NewFromInt(20)})
+	if !errors.Is(err, sql.ErrConnDone) {
+		t.Errorf("expected the original error, got %v", err)
+	}
+	if retries := srv.RetryStats.Retries.Load(); retries != 0 {
+		t.Errorf("expected no retries, got %d", retries)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: A retry policy of 0 surfaces the first conflict
+func TestTransferCurrency_RetriesDisabled(t *testing.T) {
+	srv, mock := setupRetryServer(t, 0)
+
+	expectDeadlock(mock)
+
+	_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.NewFromInt(20)})
+	if !errors.Is(err, handlers.ErrTooManyConflicts) || !errors.Is(err, store.ErrSerialization) {
+		t.Errorf("expected too many conflicts, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: The backoff never outlasts the request
+func TestTransferCurrency_RetryStopsAtDeadline(t *testing.T) {
+	srv, mock := setupMockDB(t)
+	srv.TransferRetry = handlers.RetryPolicy{MaxRetries: 3, BaseBackoff: time.Hour, MaxBackoff: time.Hour}
+
+	expectDeadlock(mock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := srv.TransferCurrency(ctx, models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.NewFromInt(20)})
+
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("expected the deadline to cut the backoff short, got %v after %s", err, time.Since(start))
+	}
+}
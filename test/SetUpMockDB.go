@@ -1,22 +1,21 @@
 package test
 
 import (
-	"httpserver/models"
+	"httpserver/handlers"
+	"httpserver/store"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
 )
 
-// Setup Mock DB so as to not override the actual DB
-func setupMockDB(t *testing.T) sqlmock.Sqlmock {
+// Setup a server on a mock DB so as to not touch the actual DB
+func setupMockDB(t *testing.T) (*handlers.Server, sqlmock.Sqlmock) {
 	mockDB, mock, err := sqlmock.New()
 
 	if err != nil {
 		t.Fatalf("failed to create mock DB: %v", err)
 	}
 
-	// Override the global DB with mock
-	models.DB = mockDB
-
-	return mock
+	// Each test gets its own server, nothing global is overridden
+	return handlers.NewServer(store.NewPostgres(mockDB)), mock
 }
@@ -0,0 +1,461 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"httpserver/handlers"
+	"httpserver/migrations"
+	"httpserver/models"
+	"httpserver/store"
+	"httpserver/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Open a migrated SQLite database in a temporary directory
+func setupSQLiteDB(t *testing.T) *sql.DB {
+	db, err := store.OpenSQLite(filepath.Join(t.TempDir(), "transfers.db"))
+	if err != nil {
+		t.Fatalf("failed to open SQLite DB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrations.Up(db, migrations.SQLite); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	return db
+}
+
+// Run a test against a fresh server on each store that needs no database server
+func forEachStore(t *testing.T, test func(t *testing.T, srv *handlers.Server, h http.Handler)) {
+	backends := map[string]func(t *testing.T) store.Store{
+		"memory": func(t *testing.T) store.Store { return store.NewMemory() },
+		"sqlite": func(t *testing.T) store.Store { return store.NewSQLite(setupSQLiteDB(t)) },
+	}
+	for _, name := range []string{"memory", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			srv := handlers.NewServer(backends[name](t))
+			setupFxRates(srv)
+			test(t, srv, srv.Routes())
+		})
+	}
+}
+
+// Send a request through the router and decode the JSON response into out, if given
+func call(t *testing.T, h http.Handler, method string, path string, body string, out any) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if out != nil && w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: invalid JSON response %q: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+// Create an account through the API
+func createAccount(t *testing.T, h http.Handler, body string) {
+	if w := call(t, h, http.MethodPost, "/accounts", body, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("failed to create account %s: %d %s", body, w.Code, w.Body.String())
+	}
+}
+
+// Read an account's balance through the API
+func accountBalance(t *testing.T, h http.Handler, id int) decimal.Decimal {
+	var account models.Account
+	if w := call(t, h, http.MethodGet, "/accounts/"+strconv.Itoa(id), "", &account); w.Code != http.StatusOK {
+		t.Fatalf("failed to read account %d: %d %s", id, w.Code, w.Body.String())
+	}
+	return account.CurrentBalance
+}
+
+// Success: Accounts, transfers and history work end to end on every embedded store
+func TestStores_TransferFlow(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
+
+		var result map[string]any
+		w := call(t, h, http.MethodPost, "/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "20"}`, &result)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+		}
+		if result["source_balance"] != "80" || result["dest_balance"] != "70" || result["transaction_id"] != float64(1) {
+			t.Errorf("unexpected transfer response %v", result)
+		}
+
+		var account models.Account
+		call(t, h, http.MethodGet, "/accounts/2", "", &account)
+		if !account.CurrentBalance.Equal(decimal.RequireFromString("70")) {
+			t.Errorf("unexpected destination account %+v", account)
+		}
+
+		var transaction models.Transaction
+		if w := call(t, h, http.MethodGet, "/transactions/1", "", &transaction); w.Code != http.StatusOK || transaction.SourceAccountID != 1 {
+			t.Errorf("unexpected transaction %d %+v", w.Code, transaction)
+		}
+
+		var page models.TransactionPage
+		call(t, h, http.MethodGet, "/accounts/1/transactions", "", &page)
+		if len(page.Transactions) != 1 || page.NextCursor != "" {
+			t.Errorf("unexpected history %+v", page)
+		}
+	})
+}
+
+// Fail: Errors are reported the same on every store and failed transfers leave no trace
+func TestStores_Errors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "10.00", "currency": "SGD"}`)
+
+		var problem utils.Problem
+		w := call(t, h, http.MethodPost, "/accounts", `{"account_id": 1, "initial_balance": "10.00", "currency": "SGD"}`, &problem)
+		if w.Code != http.StatusConflict || problem.Code != handlers.CodeDuplicateAccount {
+			t.Errorf("expected duplicate account conflict, got %d %+v", w.Code, problem)
+		}
+
+		problem = utils.Problem{}
+		if w := call(t, h, http.MethodGet, "/accounts/9", "", &problem); w.Code != http.StatusNotFound || problem.Code != handlers.CodeAccountNotFound {
+			t.Errorf("expected 404, got %d %q", w.Code, w.Body.String())
+		}
+
+		_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 9, Amount: decimal.NewFromInt(1)})
+		if !errors.Is(err, handlers.ErrDestinationNotFound) {
+			t.Errorf("expected destination not found, got %v", err)
+		}
+
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "0", "currency": "SGD"}`)
+		_, err = srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("10.01")})
+		if !errors.Is(err, handlers.ErrInsufficientFunds) {
+			t.Errorf("expected insufficient balance, got %v", err)
+		}
+
+		// A quote refused by a failed transfer is not used up
+		quote, err := srv.CreateFxQuote(context.Background(), "SGD", "USD", decimal.NewFromInt(1))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, err = srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.NewFromInt(1), QuoteID: quote.QuoteID})
+		if !errors.Is(err, handlers.ErrQuoteMismatch) {
+			t.Errorf("expected quote mismatch, got %v", err)
+		}
+
+		if _, err := srv.Store.GetTransaction(context.Background(), 1); !errors.Is(err, store.ErrTransactionNotFound) {
+			t.Errorf("expected no transaction recorded, got %v", err)
+		}
+		report, err := srv.Store.Reconcile(context.Background())
+		if err != nil || !report.Balanced || report.AccountsChecked != 2 {
+			t.Errorf("unexpected reconciliation %+v %v", report, err)
+		}
+
+		createAccount(t, h, `{"account_id": 3, "initial_balance": "0", "currency": "USD"}`)
+		_, err = srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 3, Amount: decimal.NewFromInt(1), QuoteID: quote.QuoteID})
+		if err != nil {
+			t.Errorf("expected quote to still be usable, got %v", err)
+		}
+	})
+}
+
+// Success: Quotes convert once and the ledger stays balanced
+func TestStores_CrossCurrency(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "USD"}`)
+
+		var quote models.FxQuote
+		if w := call(t, h, http.MethodPost, "/fx/quotes", `{"source_currency": "SGD", "destination_currency": "USD", "amount": "10"}`, &quote); w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d %s", w.Code, w.Body.String())
+		}
+
+		req := models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.NewFromInt(10), QuoteID: quote.QuoteID}
+		record, err := srv.TransferCurrency(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !record.DestinationAmount.Equal(decimal.RequireFromString("7.41")) {
+			t.Errorf("unexpected destination amount %s", record.DestinationAmount)
+		}
+		if _, err := srv.TransferCurrency(context.Background(), req); !errors.Is(err, handlers.ErrQuoteNotFound) {
+			t.Errorf("expected quote to be single use, got %v", err)
+		}
+
+		report, err := srv.Store.Reconcile(context.Background())
+		if err != nil || !report.Balanced {
+			t.Errorf("unexpected reconciliation %+v %v", report, err)
+		}
+	})
+}
+
+// Success: Idempotency-Key replays work on every embedded store
+func TestStores_Idempotency(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		send := func(body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewBufferString(body))
+			req.Header.Set("Idempotency-Key", "key-1")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+
+		body := `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`
+		if w := send(body); w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", w.Code)
+		}
+		if w := send(body); w.Code != http.StatusNoContent || w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("expected replayed 204, got %d", w.Code)
+		}
+		if w := send(`{"account_id": 2, "initial_balance": "1", "currency": "SGD"}`); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422 for a different body, got %d", w.Code)
+		}
+	})
+}
+
+// Success: Money is conserved under parallel transfers on every embedded store
+func TestStores_ConcurrentConservation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		ids := []int{1, 2, 3, 4, 5}
+		for _, id := range ids {
+			if err := srv.CreateAccount(context.Background(), id, "SGD", decimal.NewFromInt(100), "", ""); err != nil {
+				t.Fatalf("failed to create account %d: %v", id, err)
+			}
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 500; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				req := models.TransferRequest{SourceAccountID: ids[i%5], DestinationAccountID: ids[(i*3+1)%5], Amount: decimal.New(int64(i%37+1), 0)}
+				_, err := srv.TransferCurrency(context.Background(), req)
+				switch {
+				case err == nil, errors.Is(err, handlers.ErrSameAccount), errors.Is(err, handlers.ErrInsufficientFunds):
+				default:
+					t.Errorf("unexpected error: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		total := decimal.Zero
+		for _, id := range ids {
+			acc, err := srv.GetAccountByID(context.Background(), id)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if acc.CurrentBalance.IsNegative() {
+				t.Errorf("account %d overdrawn: %s", id, acc.CurrentBalance)
+			}
+			total = total.Add(acc.CurrentBalance)
+		}
+		if !total.Equal(decimal.NewFromInt(500)) {
+			t.Errorf("money not conserved, expected 500 got %s", total)
+		}
+		if report, err := srv.Store.Reconcile(context.Background()); err != nil || !report.Balanced {
+			t.Errorf("unexpected reconciliation %+v %v", report, err)
+		}
+	})
+}
+
+// Success: History date filters compare timestamps correctly
+func TestStores_HistoryDateFilter(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "0", "currency": "SGD"}`)
+		for i := 0; i < 3; i++ {
+			if _, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.NewFromInt(1)}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		// Offsets other than UTC select the same instants
+		from := time.Now().Add(-time.Hour).In(time.FixedZone("SGT", 8*60*60)).Format(time.RFC3339)
+		to := time.Now().Add(time.Hour).Format(time.RFC3339)
+		var page models.TransactionPage
+		if w := call(t, h, http.MethodGet, "/accounts/1/transactions?from="+url.QueryEscape(from)+"&to="+url.QueryEscape(to), "", &page); w.Code != http.StatusOK || len(page.Transactions) != 3 {
+			t.Errorf("expected 3 transactions, got %d %+v", w.Code, page)
+		}
+
+		page = models.TransactionPage{}
+		call(t, h, http.MethodGet, "/accounts/1/transactions?from="+url.QueryEscape(to), "", &page)
+		if len(page.Transactions) != 0 {
+			t.Errorf("expected no transactions after %s, got %+v", to, page)
+		}
+	})
+}
+
+// Success: Parallel debits can never spend more than the balance
+func TestStores_ConcurrentNoOverdraft(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "0", "currency": "SGD"}`)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		succeeded := 0
+		for i := 0; i < 150; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.NewFromInt(1)})
+				if err == nil {
+					mu.Lock()
+					succeeded++
+					mu.Unlock()
+				} else if err != handlers.ErrInsufficientFunds {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if succeeded != 100 {
+			t.Errorf("expected exactly 100 successful transfers, got %d", succeeded)
+		}
+		if acc, err := srv.GetAccountByID(context.Background(), 1); err != nil || !acc.CurrentBalance.IsZero() {
+			t.Errorf("expected source balance 0, got %+v %v", acc, err)
+		}
+	})
+}
+
+// Success: Close waits for the transfer in progress, later transfers are refused
+func TestStores_Close(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "0", "currency": "SGD"}`)
+
+		// Hold a transaction open half way through a transfer
+		started, release := make(chan struct{}), make(chan struct{})
+		txDone := make(chan error)
+		go func() {
+			txDone <- srv.Store.WithTx(context.Background(), func(tx store.Tx) error {
+				if _, err := tx.Debit(1, decimal.NewFromInt(30)); err != nil {
+					return err
+				}
+				close(started)
+				<-release
+				_, err := tx.Credit(2, decimal.NewFromInt(30))
+				return err
+			})
+		}()
+		<-started
+
+		closed := make(chan error)
+		go func() { closed <- srv.Store.Close() }()
+		select {
+		case err := <-closed:
+			t.Fatalf("Close returned before the transaction finished: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		if err := <-txDone; err != nil {
+			t.Fatalf("expected the transaction to commit, got %v", err)
+		}
+		if err := <-closed; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := call(t, h, http.MethodPost, "/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "1"}`, nil)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503 after close, got %d %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// Fail: Reads and writes outside a transaction are refused once the SQLite store is closed, rather than failing in the driver
+func TestStores_SQLiteClosedQueries(t *testing.T) {
+	srv := handlers.NewServer(store.NewSQLite(setupSQLiteDB(t)))
+	h := srv.Routes()
+	createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+	if err := srv.Store.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, path := range []string{"/accounts/1", "/accounts/1/transactions", "/transactions/1", "/reconciliation"} {
+		if w := call(t, h, http.MethodGet, path, "", nil); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503 for %s after close, got %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	ctx := context.Background()
+	if _, err := srv.Store.GetAPIKey(ctx, "key-1"); !errors.Is(err, store.ErrClosed) {
+		t.Errorf("expected ErrClosed reading an API key, got %v", err)
+	}
+	if _, err := srv.Store.ListAPIKeys(ctx); !errors.Is(err, store.ErrClosed) {
+		t.Errorf("expected ErrClosed listing API keys, got %v", err)
+	}
+	if _, err := srv.Store.GetIdempotencyKey(ctx, "key-1"); !errors.Is(err, store.ErrClosed) {
+		t.Errorf("expected ErrClosed reading an idempotency key, got %v", err)
+	}
+	if _, err := srv.Store.ClaimIdempotencyKey(ctx, "key-1", "fingerprint", time.Now().Add(time.Hour)); !errors.Is(err, store.ErrClosed) {
+		t.Errorf("expected ErrClosed claiming an idempotency key, got %v", err)
+	}
+	if err := srv.Store.RevokeAPIKey(ctx, "key-1"); !errors.Is(err, store.ErrClosed) {
+		t.Errorf("expected ErrClosed revoking an API key, got %v", err)
+	}
+}
+
+// Success: SQLite writes outside a transaction wait their turn behind one in progress, for as long as their context allows
+func TestStores_SQLiteWritesQueue(t *testing.T) {
+	s := store.NewSQLite(setupSQLiteDB(t))
+
+	// Hold the write lock open
+	started, release := make(chan struct{}), make(chan struct{})
+	txDone := make(chan error)
+	go func() {
+		txDone <- s.WithTx(context.Background(), func(tx store.Tx) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	writes := map[string]func(ctx context.Context) error{
+		"claim idempotency key": func(ctx context.Context) error {
+			_, err := s.ClaimIdempotencyKey(ctx, "key-1", "fingerprint", time.Now().Add(time.Hour))
+			return err
+		},
+		"purge idempotency keys": func(ctx context.Context) error {
+			_, err := s.PurgeExpiredIdempotencyKeys(ctx)
+			return err
+		},
+		"create API key": func(ctx context.Context) error {
+			return s.CreateAPIKey(ctx, &models.APIKey{KeyID: "key-1", Name: "queued", SecretHash: []byte("hash"), Role: models.RoleAdmin})
+		},
+		"create fx quote": func(ctx context.Context) error {
+			return s.CreateFxQuote(ctx, &models.FxQuote{QuoteID: "quote-1", SourceCurrency: "SGD", DestinationCurrency: "USD", Amount: decimal.NewFromInt(1), Rate: decimal.NewFromInt(1), ExpiresAt: time.Now().Add(time.Hour)})
+		},
+	}
+	for name, write := range writes {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		start := time.Now()
+		err := write(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+			t.Errorf("%s: expected to wait for the write lock until the deadline, got %v after %v", name, err, time.Since(start))
+		}
+	}
+
+	// Once the transaction is done they go through
+	close(release)
+	if err := <-txDone; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, write := range writes {
+		if err := write(context.Background()); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
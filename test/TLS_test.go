@@ -0,0 +1,423 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"httpserver/certs"
+	"httpserver/handlers"
+	"httpserver/models"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Certificate authority generated for one test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(raw)
+	return &testCA{cert, key}
+}
+
+// Issue a leaf certificate for template, filling in what every leaf needs
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	raw, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(raw)
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key, Leaf: leaf}
+}
+
+// Server certificate for 127.0.0.1 named name
+func (ca *testCA) server(t *testing.T, name string) tls.Certificate {
+	return ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: name}, IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}})
+}
+
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// Write cert and its key as PEM files, moving their modification time forward so a reload sees the change
+func writeKeyPair(t *testing.T, certFile string, keyFile string, cert tls.Certificate) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	writeStamped(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}))
+	writeStamped(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}))
+}
+
+func writeStamped(t *testing.T, path string, content []byte) {
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	stamp := time.Now().Add(time.Duration(writes.Add(1)) * time.Second)
+	os.Chtimes(path, stamp, stamp)
+}
+
+// Files written so far, every write is stamped a second later than the one before
+var writes atomic.Int64
+
+// Options for a server certificate from ca in a temporary directory
+func setupTLSFiles(t *testing.T, ca *testCA) certs.Options {
+	dir := t.TempDir()
+	options := certs.Options{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		MinVersion:   "1.2",
+		CipherPolicy: "modern",
+	}
+	writeKeyPair(t, options.CertFile, options.KeyFile, ca.server(t, "server-1"))
+	return options
+}
+
+// Trust client CAs from clientCA, asking for certificates as mode says
+func withClientCA(t *testing.T, options certs.Options, clientCA *testCA, mode string) certs.Options {
+	options.ClientCAFile = filepath.Join(t.TempDir(), "clients.pem")
+	options.ClientAuth = mode
+	writeStamped(t, options.ClientCAFile, clientCA.pem())
+	return options
+}
+
+// Serve h over TLS from reloader, returning the address
+func serveTLS(t *testing.T, h http.Handler, reloader *certs.Reloader) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: h, TLSConfig: reloader.TLSConfig()}
+	go server.ServeTLS(ln, "", "")
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().String()
+}
+
+// Client trusting ca, with cert as its client certificate when given
+func tlsClient(ca *testCA, cert *tls.Certificate) *http.Client {
+	config := &tls.Config{RootCAs: x509.NewCertPool()}
+	config.RootCAs.AddCert(ca.cert)
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}, Timeout: 5 * time.Second}
+}
+
+// Handshake with addr and return the common name of the certificate it served
+func servedName(t *testing.T, addr string, config *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+/* Testcases for the TLS listener */
+
+// Success: The listener serves its certificate with the chosen minimum version and cipher policy
+func TestTLS_VersionsAndCiphers(t *testing.T) {
+	ca := newCA(t, "server-ca")
+	_, h := setupMemoryServer(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for name, tc := range map[string]struct {
+		minVersion string
+		policy     string
+		client     *tls.Config
+		ok         bool
+	}{
+		"tls 1.3":                     {"1.2", "modern", &tls.Config{MinVersion: tls.VersionTLS13}, true},
+		"tls 1.2 with aead":           {"1.2", "modern", &tls.Config{MaxVersion: tls.VersionTLS12}, true},
+		"tls 1.2 below the minimum":   {"1.3", "modern", &tls.Config{MaxVersion: tls.VersionTLS12}, false},
+		"cbc refused by modern":       {"1.2", "modern", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}}, false},
+		"cbc accepted by compatible":  {"1.2", "compatible", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}}, true},
+		"aead accepted by compatible": {"1.2", "compatible", &tls.Config{MaxVersion: tls.VersionTLS12}, true},
+	} {
+		options := setupTLSFiles(t, ca)
+		options.MinVersion, options.CipherPolicy = tc.minVersion, tc.policy
+		reloader, err := certs.NewReloader(options)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		addr := serveTLS(t, h, reloader)
+
+		tc.client.RootCAs = roots
+		got, err := servedName(t, addr, tc.client)
+		if tc.ok && (err != nil || got != "server-1") {
+			t.Errorf("%s: expected the handshake to succeed, got %q %v", name, got, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: expected the handshake to fail", name)
+		}
+	}
+
+	options := setupTLSFiles(t, ca)
+	reloader, _ := certs.NewReloader(options)
+	resp, err := tlsClient(ca, nil).Get("https://" + serveTLS(t, h, reloader) + "/openapi.json")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the API over HTTPS, got %v %v", resp, err)
+	}
+	resp.Body.Close()
+}
+
+// Success: A renewed certificate is served to new connections, a broken one keeps the previous
+func TestTLS_ReloadsCertificate(t *testing.T) {
+	ca := newCA(t, "server-ca")
+	options := setupTLSFiles(t, ca)
+	reloader, err := certs.NewReloader(options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, h := setupMemoryServer(t)
+	addr := serveTLS(t, h, reloader)
+	client := &tls.Config{RootCAs: x509.NewCertPool()}
+	client.RootCAs.AddCert(ca.cert)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx, 10*time.Millisecond)
+
+	writeKeyPair(t, options.CertFile, options.KeyFile, ca.server(t, "server-2"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		name, err := servedName(t, addr, client)
+		if err == nil && name == "server-2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the renewed certificate, got %q %v", name, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A key that does not match, as when the certificate is written before its key
+	other := ca.server(t, "server-3")
+	key, _ := x509.MarshalPKCS8PrivateKey(other.PrivateKey)
+	writeStamped(t, options.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}))
+	if err := reloader.Reload(); err == nil {
+		t.Errorf("expected a mismatched key to fail")
+	}
+	writeStamped(t, options.CertFile, []byte("not a certificate"))
+	time.Sleep(50 * time.Millisecond)
+	if name, err := servedName(t, addr, client); err != nil || name != "server-2" {
+		t.Errorf("expected the previous certificate, got %q %v", name, err)
+	}
+}
+
+// Failure: Bad settings and unreadable files are refused up front
+func TestTLS_NewReloaderErrors(t *testing.T) {
+	ca := newCA(t, "server-ca")
+	options := setupTLSFiles(t, ca)
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("no pem here"), 0o600)
+
+	for name, change := range map[string]func(o *certs.Options){
+		"version":     func(o *certs.Options) { o.MinVersion = "1.1" },
+		"policy":      func(o *certs.Options) { o.CipherPolicy = "legacy" },
+		"client auth": func(o *certs.Options) { o.ClientCAFile, o.ClientAuth = options.CertFile, "request" },
+		"missing key": func(o *certs.Options) { o.KeyFile = filepath.Join(t.TempDir(), "missing.pem") },
+		"empty CAs":   func(o *certs.Options) { o.ClientCAFile, o.ClientAuth = empty, "optional" },
+	} {
+		bad := options
+		change(&bad)
+		if _, err := certs.NewReloader(bad); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+/* Testcases for client certificates */
+
+// Success: Required client certificates are verified in the handshake, mapped ones act as their service
+func TestTLS_ClientCertificateRequired(t *testing.T) {
+	serverCA, clientCA, strangerCA := newCA(t, "server-ca"), newCA(t, "client-ca"), newCA(t, "stranger-ca")
+	reloader, err := certs.NewReloader(withClientCA(t, setupTLSFiles(t, serverCA), clientCA, "require"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv, h := setupMemoryServer(t)
+	srv.ClientCerts = certs.ClientMap{"uri:spiffe://internal/recon": {Principal: "recon", Role: models.RoleAuditor}}
+	base := "https://" + serveTLS(t, h, reloader)
+
+	recon := clientCA.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "recon"}, URIs: []*url.URL{{Scheme: "spiffe", Host: "internal", Path: "/recon"}}})
+	unmapped := clientCA.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "payroll"}})
+	forged := strangerCA.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "recon"}, URIs: recon.Leaf.URIs})
+
+	for name, tc := range map[string]struct {
+		cert   *tls.Certificate
+		method string
+		path   string
+		want   int
+	}{
+		"mapped":          {&recon, http.MethodGet, "/v1/reconciliation", http.StatusOK},
+		"mapped not let":  {&recon, http.MethodPost, "/v1/accounts", http.StatusForbidden},
+		"unmapped":        {&unmapped, http.MethodGet, "/v1/reconciliation", http.StatusUnauthorized},
+		"unmapped public": {&unmapped, http.MethodGet, "/openapi.json", http.StatusOK},
+		"other CA":        {&forged, http.MethodGet, "/v1/reconciliation", 0},
+		"no certificate":  {nil, http.MethodGet, "/v1/reconciliation", 0},
+	} {
+		req, _ := http.NewRequest(tc.method, base+tc.path, strings.NewReader(`{"account_id": 1, "initial_balance": "0", "currency": "SGD"}`))
+		resp, err := tlsClient(serverCA, tc.cert).Do(req)
+		if tc.want == 0 {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: expected the handshake to fail, got %d", name, resp.StatusCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: expected %d, got %d", name, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+// Success: With optional client certificates, callers without one authenticate the other ways
+func TestTLS_ClientCertificateOptional(t *testing.T) {
+	serverCA, clientCA := newCA(t, "server-ca"), newCA(t, "client-ca")
+	reloader, err := certs.NewReloader(withClientCA(t, setupTLSFiles(t, serverCA), clientCA, "optional"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv, h := setupAuthServer(t)
+	srv.ClientCerts = certs.ClientMap{"subject:CN=ops,O=Internal": {Principal: "ops", Role: models.RoleOperator}}
+	token, _ := createAPIKey(t, srv, false, models.RoleAdmin)
+	base := "https://" + serveTLS(t, h, reloader)
+	ops := clientCA.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "ops", Organization: []string{"Internal"}}})
+
+	get := func(cert *tls.Certificate, bearer string) int {
+		req, _ := http.NewRequest(http.MethodGet, base+"/v1/reconciliation", nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		resp, err := tlsClient(serverCA, cert).Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := get(nil, token); got != http.StatusOK {
+		t.Errorf("expected an API key without a certificate to be accepted, got %d", got)
+	}
+	if got := get(nil, ""); got != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", got)
+	}
+	// Operators do not reconcile, so the certificate is what the request was authorized as
+	if got := get(&ops, token); got != http.StatusForbidden {
+		t.Errorf("expected the certificate's operator role, got %d", got)
+	}
+}
+
+// Success: The first mapped identity of a verified certificate is the principal, unverified ones are ignored
+func TestAuth_ClientCertificatePrincipal(t *testing.T) {
+	ca := newCA(t, "client-ca")
+	srv, _ := setupMemoryServer(t)
+	srv.ClientCerts = certs.ClientMap{
+		"subject:CN=batch":             {Principal: "batch-subject", Role: models.RoleAdmin},
+		"dns:batch.internal":           {Principal: "batch", Role: models.RoleOperator},
+		"email:batch@internal.example": {Principal: "batch-email", Role: models.RoleAdmin},
+	}
+	cert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "batch"}, DNSNames: []string{"batch.internal"}, EmailAddresses: []string{"batch@internal.example"}})
+
+	var principal *models.Principal
+	authenticate := srv.Authenticate(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = handlers.PrincipalFrom(r.Context())
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.Leaf, ca.cert}}}
+	authenticate(httptest.NewRecorder(), req)
+	if principal == nil || principal.ID != "batch" || principal.Method != handlers.AuthMethodClientCert || principal.Role != models.RoleOperator {
+		t.Errorf("expected the DNS identity, got %+v", principal)
+	}
+
+	principal = nil
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+	w := httptest.NewRecorder()
+	authenticate(w, req)
+	if principal != nil || w.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unverified certificate to be ignored, got %d %+v", w.Code, principal)
+	}
+}
+
+// Success: Client maps default the principal to the identity, bad prefixes and roles are refused
+func TestLoadClientMap(t *testing.T) {
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "clients.json")
+		os.WriteFile(path, []byte(content), 0o600)
+		return path
+	}
+
+	m, err := certs.LoadClientMap(write(`{"uri:spiffe://internal/recon": {"role": "auditor"}, "dns:ops.internal": {"principal": "ops", "role": "operator"}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m["uri:spiffe://internal/recon"].Principal != "spiffe://internal/recon" || m["dns:ops.internal"].Principal != "ops" {
+		t.Errorf("unexpected principals %+v", m)
+	}
+
+	for name, content := range map[string]string{
+		"prefix":  `{"cn:recon": {"role": "auditor"}}`,
+		"empty":   `{"uri:": {"role": "auditor"}}`,
+		"role":    `{"dns:ops.internal": {"role": "root"}}`,
+		"no role": `{"dns:ops.internal": {"principal": "ops"}}`,
+		"json":    `["dns:ops.internal"]`,
+	} {
+		if _, err := certs.LoadClientMap(write(content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := certs.LoadClientMap(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("expected a missing file to fail")
+	}
+}
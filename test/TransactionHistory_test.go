@@ -0,0 +1,224 @@
+package test
+
+import (
+	"encoding/json"
+	"httpserver/handlers"
+	"httpserver/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var transactionRowColumns = []string{
+	"id", "source_account_id", "destination_account_id", "currency", "amount",
+	"destination_currency", "destination_amount", "fx_rate", "fx_remainder",
+	"quote_id", "source_balance", "destination_balance", "status", "created_at",
+}
+
+// Rows for transactions with the given IDs, all from account 1 to account 2
+func transactionRows(ids ...int64) *sqlmock.Rows {
+	rows := sqlmock.NewRows(transactionRowColumns)
+	for _, id := range ids {
+		rows.AddRow(id, 1, 2, "SGD", "10.00", "SGD", "10.00", nil, nil, "", "90.00", "60.00", "completed", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	}
+	return rows
+}
+
+/* Testcases for GetTransactionHandler */
+
+// Success: Valid request
+func TestGetTransactionHandler_Success(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
+		if w := call(t, h, http.MethodPost, "/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "10.00"}`, nil); w.Code != http.StatusOK {
+			t.Fatalf("failed to transfer: %d %s", w.Code, w.Body.String())
+		}
+
+		var data map[string]interface{}
+		if w := call(t, h, http.MethodGet, "/transactions/1", "", &data); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if data["transaction_id"] != 1.0 || data["amount"] != "10" || data["status"] != "completed" {
+			t.Errorf("unexpected transaction: %v", data)
+		}
+	})
+}
+
+// Success: A transfer is read by its ID
+func TestGetTransactionHandler_Query(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	mock.ExpectQuery("SELECT (.+) FROM transactions WHERE id =").
+		WithArgs(int64(5)).
+		WillReturnRows(transactionRows(5))
+
+	var data map[string]interface{}
+	if w := call(t, srv.Routes(), http.MethodGet, "/transactions/5", "", &data); w.Code != http.StatusOK || data["transaction_id"] != 5.0 {
+		t.Errorf("expected transaction 5, got %d %v", w.Code, data)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: Transaction not found
+func TestGetTransactionHandler_NotFound(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		if w := call(t, h, http.MethodGet, "/transactions/5", "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+}
+
+// Fail: Invalid transaction ID
+func TestGetTransactionHandler_InvalidID(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		if w := call(t, h, http.MethodGet, "/transactions/abc", "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+}
+
+/* Testcases for GetAccountTransactionsHandler */
+
+// Success: First page with a cursor to the next
+func TestGetAccountTransactionsHandler_Paginates(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
+		for i := 0; i < 3; i++ {
+			if w := call(t, h, http.MethodPost, "/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "10.00"}`, nil); w.Code != http.StatusOK {
+				t.Fatalf("failed to transfer: %d %s", w.Code, w.Body.String())
+			}
+		}
+
+		// Newest first
+		var page models.TransactionPage
+		if w := call(t, h, http.MethodGet, "/accounts/1/transactions?limit=2", "", &page); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if len(page.Transactions) != 2 || page.Transactions[0].TransactionID != 3 || page.Transactions[1].TransactionID != 2 {
+			t.Fatalf("unexpected page: %+v", page.Transactions)
+		}
+		if page.NextCursor == "" {
+			t.Fatalf("expected a next cursor")
+		}
+
+		// Following the cursor continues after the last ID seen
+		var last models.TransactionPage
+		call(t, h, http.MethodGet, "/accounts/1/transactions?limit=2&cursor="+page.NextCursor, "", &last)
+		if len(last.Transactions) != 1 || last.Transactions[0].TransactionID != 1 || last.NextCursor != "" {
+			t.Errorf("unexpected last page: %+v", last)
+		}
+	})
+}
+
+// Success: A page fetches one row more than the limit, the cursor filters on the last ID seen
+func TestGetAccountTransactionsHandler_PageQueries(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	mock.ExpectQuery("SELECT balance, currency, owner, tier FROM accounts WHERE account_id =").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"balance", "currency", "owner", "tier"}).AddRow("90.00", "SGD", "", "standard"))
+
+	// Limit of 2 fetches 3 rows to detect a next page
+	mock.ExpectQuery(`FROM transactions WHERE \(source_account_id = \$1 OR destination_account_id = \$1\) ORDER BY id DESC LIMIT \$2`).
+		WithArgs(1, 3).
+		WillReturnRows(transactionRows(9, 8, 7))
+
+	req := httptest.NewRequest(http.MethodGet, "/accounts/1/transactions?limit=2", nil)
+	w := httptest.NewRecorder()
+
+	srv.Routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var page models.TransactionPage
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("failed to decode JSON: %v", err)
+	}
+	if len(page.Transactions) != 2 || page.Transactions[1].TransactionID != 8 {
+		t.Fatalf("unexpected page: %+v", page.Transactions)
+	}
+	if page.NextCursor == "" {
+		t.Fatalf("expected a next cursor")
+	}
+
+	// Following the cursor filters on the last ID seen
+	mock.ExpectQuery("SELECT balance, currency, owner, tier FROM accounts WHERE account_id =").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"balance", "currency", "owner", "tier"}).AddRow("90.00", "SGD", "", "standard"))
+	mock.ExpectQuery(`AND id < \$2 ORDER BY id DESC LIMIT \$3`).
+		WithArgs(1, int64(8), 3).
+		WillReturnRows(transactionRows(7))
+
+	req = httptest.NewRequest(http.MethodGet, "/accounts/1/transactions?limit=2&cursor="+page.NextCursor, nil)
+	w = httptest.NewRecorder()
+
+	srv.Routes().ServeHTTP(w, req)
+
+	page = models.TransactionPage{}
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("failed to decode JSON: %v", err)
+	}
+	if len(page.Transactions) != 1 || page.NextCursor != "" {
+		t.Errorf("unexpected last page: %+v", page)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Success: Time range filters are passed to the query
+func TestGetAccountTransactionsHandler_TimeRange(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("SELECT balance, currency, owner, tier FROM accounts WHERE account_id =").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"balance", "currency", "owner", "tier"}).AddRow("90.00", "SGD", "", "standard"))
+	mock.ExpectQuery(`AND created_at >= \$2 AND created_at < \$3 ORDER BY id DESC LIMIT \$4`).
+		WithArgs(1, from, to, 51).
+		WillReturnRows(transactionRows())
+
+	req := httptest.NewRequest(http.MethodGet, "/accounts/1/transactions?from=2025-01-01T00:00:00Z&to=2025-02-01T00:00:00Z", nil)
+	w := httptest.NewRecorder()
+
+	srv.Routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Fail: Account not found
+func TestGetAccountTransactionsHandler_AccountNotFound(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		if w := call(t, h, http.MethodGet, "/accounts/999/transactions", "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+}
+
+// Fail: Invalid filters
+func TestGetAccountTransactionsHandler_InvalidFilters(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "1", "currency": "SGD"}`)
+		for _, query := range []string{"from=yesterday", "to=2025-13-01", "limit=0", "limit=1000", "cursor=!!!"} {
+			if w := call(t, h, http.MethodGet, "/accounts/1/transactions?"+query, "", nil); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d", query, w.Code)
+			}
+		}
+	})
+}
@@ -1,40 +1,115 @@
 package test
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"httpserver/handlers"
 	"httpserver/models"
 	"net/http"
-	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
 )
 
+const (
+	lockQuery   = `SELECT balance, currency, owner, tier FROM accounts WHERE account_id = \$1 FOR UPDATE`
+	debitQuery  = `UPDATE accounts SET balance = balance - \$1 WHERE account_id = \$2 AND balance >= \$1 RETURNING balance`
+	creditQuery = `UPDATE accounts SET balance = balance \+ \$1 WHERE account_id = \$2 RETURNING balance`
+	ledgerQuery = `INSERT INTO transactions`
+)
+
+// Expect the row lock on an SGD account, returning its balance
+func expectLock(mock sqlmock.Sqlmock, accountID int, balance string) {
+	expectLockCurrency(mock, accountID, balance, "SGD")
+}
+
+// Expect the row lock on an account, returning its balance and currency
+func expectLockCurrency(mock sqlmock.Sqlmock, accountID int, balance string, currency string) {
+	mock.ExpectQuery(lockQuery).
+		WithArgs(accountID).
+		WillReturnRows(sqlmock.NewRows([]string{"balance", "currency", "owner", "tier"}).AddRow(balance, currency, "", "standard"))
+}
+
+// Expect a successful transfer of 20 from account 1 (100) to account 2 (50)
+func expectTransfer(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	expectLock(mock, 1, "100.00")
+	expectLock(mock, 2, "50.00")
+	mock.ExpectQuery(debitQuery).
+		WithArgs(decimal.RequireFromString("20"), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("80.00"))
+	mock.ExpectQuery(creditQuery).
+		WithArgs(decimal.RequireFromString("20"), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("70.00"))
+	mock.ExpectQuery(ledgerQuery).
+		WithArgs(1, 2, "SGD", decimal.RequireFromString("20"), "SGD", decimal.RequireFromString("20"), nil, nil, nil,
+			decimal.RequireFromString("80.00"), decimal.RequireFromString("70.00"), "completed").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+	expectJournalEntry(mock, models.JournalTransfer, 1, 2, "SGD", "20")
+}
+
+/* Testcases for TransferCurrency */
+
 // Success: Valid request
 func TestTransferCurrency_Success(t *testing.T) {
-	mock := setupMockDB(t)
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
+
+		record, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("20")})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if record.TransactionID != 1 || record.Status != "completed" {
+			t.Errorf("unexpected ledger entry: %+v", record)
+		}
+		if !record.SourceBalance.Equal(decimal.RequireFromString("80")) || !record.DestinationBalance.Equal(decimal.RequireFromString("70")) {
+			t.Errorf("unexpected balances: %+v", record)
+		}
+	})
+}
 
-	source := models.Account{AccountID: 1, CurrentBalance: 100.0}
-	dest := models.Account{AccountID: 2, CurrentBalance: 50.0}
-	amount := 20.0
+// Success: Both rows are locked, the debit is guarded and the transfer is recorded with its journal entry
+func TestTransferCurrency_Statements(t *testing.T) {
+	srv, mock := setupMockDB(t)
 
-	mock.ExpectBegin()
-	mock.ExpectExec("UPDATE accounts SET balance =").
-		WithArgs(80.0, 1).
-		WillReturnResult(sqlmock.NewResult(0, 1)) // 1 row affected
+	expectTransfer(mock)
+	mock.ExpectCommit()
 
-	mock.ExpectExec("UPDATE accounts SET balance =").
-		WithArgs(70.0, 2).
-		WillReturnResult(sqlmock.NewResult(0, 1)) // 1 row affected
+	if _, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("20")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
 
+// Success: Rows are locked in account ID order regardless of direction
+func TestTransferCurrency_LockOrder(t *testing.T) {
+	srv, mock := setupMockDB(t)
+
+	// Transfer from 2 to 1 must still lock 1 first
+	mock.ExpectBegin()
+	expectLock(mock, 1, "50.00")
+	expectLock(mock, 2, "100.00")
+	mock.ExpectQuery(debitQuery).
+		WithArgs(decimal.RequireFromString("20"), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("80.00"))
+	mock.ExpectQuery(creditQuery).
+		WithArgs(decimal.RequireFromString("20"), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("70.00"))
+	mock.ExpectQuery(ledgerQuery).
+		WithArgs(2, 1, "SGD", decimal.RequireFromString("20"), "SGD", decimal.RequireFromString("20"), nil, nil, nil,
+			decimal.RequireFromString("80.00"), decimal.RequireFromString("70.00"), "completed").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(8, time.Now()))
+	expectJournalEntry(mock, models.JournalTransfer, 2, 1, "SGD", "20")
 	mock.ExpectCommit()
 
-	err := handlers.TransferCurrency(source, dest, amount)
-	if err != nil {
+	if _, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 2, DestinationAccountID: 1, Amount: decimal.RequireFromString("20")}); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -44,226 +119,312 @@ func TestTransferCurrency_Success(t *testing.T) {
 
 // Fail: Source account not found
 func TestTransferCurrency_SourceAccountNotFound(t *testing.T) {
-	mock := setupMockDB(t)
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
+
+		_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("20")})
+		if !errors.Is(err, handlers.ErrSourceNotFound) {
+			t.Errorf("expected source account not found error, got %v", err)
+		}
+	})
+}
+
+// Fail: Destination account not found
+func TestTransferCurrency_DestinationAccountNotFound(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+
+		_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("20")})
+		if !errors.Is(err, handlers.ErrDestinationNotFound) {
+			t.Errorf("expected destination account not found error, got %v", err)
+		}
+		if got := accountBalance(t, h, 1); !got.Equal(decimal.RequireFromString("100")) {
+			t.Errorf("expected the source balance unchanged, got %s", got)
+		}
+	})
+}
+
+// Fail: Source balance insufficient, nothing is written
+func TestTransferCurrency_InsufficientBalance(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "10.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
+
+		_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("20")})
+		if !errors.Is(err, handlers.ErrInsufficientFunds) {
+			t.Errorf("expected insufficient balance error, got %v", err)
+		}
+		if got := accountBalance(t, h, 1); !got.Equal(decimal.RequireFromString("10")) {
+			t.Errorf("expected the source balance unchanged, got %s", got)
+		}
+	})
+}
 
-	source := models.Account{AccountID: 1, CurrentBalance: 100.0}
-	dest := models.Account{AccountID: 2, CurrentBalance: 50.0}
-	amount := 20.0
+// Fail: Guarded debit affects no rows
+func TestTransferCurrency_GuardedDebitFails(t *testing.T) {
+	srv, mock := setupMockDB(t)
 
 	mock.ExpectBegin()
-	mock.ExpectExec("UPDATE accounts SET balance =").
-		WithArgs(80.0, 1).
-		WillReturnResult(sqlmock.NewResult(0, 0)) // 0 rows affected
+	expectLock(mock, 1, "100.00")
+	expectLock(mock, 2, "50.00")
+	mock.ExpectQuery(debitQuery).
+		WithArgs(decimal.RequireFromString("20"), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}))
 	mock.ExpectRollback()
 
-	err := handlers.TransferCurrency(source, dest, amount)
-	if err == nil || err.Error() != "source account not found" {
-		t.Errorf("expected source account not found error, got %v", err)
+	_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("20")})
+	if !errors.Is(err, handlers.ErrInsufficientFunds) {
+		t.Errorf("expected insufficient balance error, got %v", err)
 	}
 }
 
-// Fail: Destination account not found
-func TestTransferCurrency_DestinationAccountNotFound(t *testing.T) {
-	mock := setupMockDB(t)
+// Fail: Source and destination are the same account
+func TestTransferCurrency_SameAccount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
 
-	source := models.Account{AccountID: 1, CurrentBalance: 100.0}
-	dest := models.Account{AccountID: 2, CurrentBalance: 50.0}
-	amount := 20.0
+		_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 1, Amount: decimal.RequireFromString("20")})
+		if !errors.Is(err, handlers.ErrSameAccount) {
+			t.Errorf("expected same account error, got %v", err)
+		}
+	})
+}
 
-	mock.ExpectBegin()
-	mock.ExpectExec("UPDATE accounts SET balance =").
-		WithArgs(80.0, 1).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+// Fail: Accounts in different currencies
+func TestTransferCurrency_CurrencyMismatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "USD"}`)
+
+		_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("20")})
+		if !errors.Is(err, handlers.ErrCurrencyMismatch) {
+			t.Errorf("expected currency mismatch error, got %v", err)
+		}
+		if got := accountBalance(t, h, 1); !got.Equal(decimal.RequireFromString("100")) {
+			t.Errorf("expected the source balance unchanged, got %s", got)
+		}
+	})
+}
 
-	mock.ExpectExec("UPDATE accounts SET balance =").
-		WithArgs(70.0, 2).
-		WillReturnResult(sqlmock.NewResult(0, 0)) // 0 rows affected
-	mock.ExpectRollback()
+// Fail: Amount finer than the account currency allows
+func TestTransferCurrency_CurrencyScale(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		// JPY has no decimal places
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "1000", "currency": "JPY"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "500", "currency": "JPY"}`)
+
+		_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("0.5")})
+		if !errors.Is(err, models.ErrTooPrecise) {
+			t.Errorf("expected too precise error, got %v", err)
+		}
+		if got := accountBalance(t, h, 1); !got.Equal(decimal.RequireFromString("1000")) {
+			t.Errorf("expected the source balance unchanged, got %s", got)
+		}
+	})
+}
 
-	err := handlers.TransferCurrency(source, dest, amount)
-	if err == nil || err.Error() != "destination account not found" {
-		t.Errorf("expected destination account not found error, got %v", err)
-	}
+// Success: Crypto-style currencies keep 8 decimal places
+func TestTransferCurrency_HighScaleCurrency(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "1", "currency": "BTC"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "0", "currency": "BTC"}`)
+
+		record, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("0.00000001")})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if record.Currency != "BTC" || record.SourceBalance.String() != "0.99999999" {
+			t.Errorf("unexpected ledger entry: %+v", record)
+		}
+		if got := accountBalance(t, h, 2); got.String() != "0.00000001" {
+			t.Errorf("unexpected destination balance %s", got)
+		}
+	})
 }
 
 // Fail: DB Error (Beginning)
 func TestTransferCurrency_DBErrorOnBegin(t *testing.T) {
-	mock := setupMockDB(t)
+	srv, mock := setupMockDB(t)
 
 	mock.ExpectBegin().WillReturnError(errors.New("db begin error"))
 
-	source := models.Account{AccountID: 1, CurrentBalance: 100.0}
-	dest := models.Account{AccountID: 2, CurrentBalance: 50.0}
-
-	err := handlers.TransferCurrency(source, dest, 20.0)
+	_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("20")})
 	if err == nil || err.Error() != "db begin error" {
 		t.Errorf("expected db begin error, got %v", err)
 	}
 }
 
-// Fail: DB Error (Commit)
-func TestTransferCurrency_CommitError(t *testing.T) {
-	mock := setupMockDB(t)
-
-	source := models.Account{AccountID: 1, CurrentBalance: 100.0}
-	dest := models.Account{AccountID: 2, CurrentBalance: 50.0}
-	amount := 20.0
+// Fail: Ledger insert fails, balance updates are rolled back
+func TestTransferCurrency_LedgerError(t *testing.T) {
+	srv, mock := setupMockDB(t)
 
 	mock.ExpectBegin()
-	mock.ExpectExec("UPDATE accounts SET balance =").
-		WithArgs(80.0, 1).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLock(mock, 1, "100.00")
+	expectLock(mock, 2, "50.00")
+	mock.ExpectQuery(debitQuery).
+		WithArgs(decimal.RequireFromString("20"), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("80.00"))
+	mock.ExpectQuery(creditQuery).
+		WithArgs(decimal.RequireFromString("20"), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("70.00"))
+	mock.ExpectQuery(ledgerQuery).WillReturnError(errors.New("ledger error"))
+	mock.ExpectRollback()
+
+	_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("20")})
+	if err == nil || err.Error() != "ledger error" {
+		t.Errorf("expected ledger error, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
 
-	mock.ExpectExec("UPDATE accounts SET balance =").
-		WithArgs(70.0, 2).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+// Fail: DB Error (Commit)
+func TestTransferCurrency_CommitError(t *testing.T) {
+	srv, mock := setupMockDB(t)
 
+	expectTransfer(mock)
 	mock.ExpectCommit().WillReturnError(errors.New("commit error"))
 
-	err := handlers.TransferCurrency(source, dest, amount)
+	_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString("20")})
 	if err == nil || err.Error() != "commit error" {
 		t.Errorf("expected commit error, got %v", err)
 	}
 }
 
-func TestTransactionHandler_Success(t *testing.T) {
-	mock := setupMockDB(t)
+/* Testcases for TransactionHandler */
 
-	// Expect existance of source account
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
-		WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(100.0))
-
-	// Expect existance of destination account
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
-		WithArgs(2).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(50.0))
-
-	mock.ExpectBegin()
-
-	// Expect updating of source account
-	mock.ExpectExec("UPDATE accounts SET balance =").
-		WithArgs(80.0, 1).
-		WillReturnResult(sqlmock.NewResult(0, 1))
-
-	// Expect updating of destination account
-	mock.ExpectExec("UPDATE accounts SET balance =").
-		WithArgs(70.0, 2).
-		WillReturnResult(sqlmock.NewResult(0, 1))
-
-	mock.ExpectCommit()
-
-	// Expect updated source account
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
-		WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(80.0))
-
-	// Expect updated destination account
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
-		WithArgs(2).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(70.0))
-
-	// Valid request
-	body := []byte(`{"source_account_id": 1, "destination_account_id": 2, "amount": "20.00"}`)
-	req := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader(body))
-	w := httptest.NewRecorder()
-
-	handlers.TransactionHandler(w, req)
-
-	resp := w.Result()
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("expected 200, got %d", resp.StatusCode)
-	}
-
-	// Decode JSON response
-	var data map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		t.Fatalf("failed to decode JSON: %v", err)
-	}
-
-	if data["source_balance"] != 80.0 {
-		t.Errorf("expected source_balance=80.0, got %v", data["source_balance"])
-	}
-	if data["dest_balance"] != 70.0 {
-		t.Errorf("expected dest_balance=70.0, got %v", data["dest_balance"])
-	}
-
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("unmet expectations: %v", err)
-	}
+// Success: Valid request
+func TestTransactionHandler_Success(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
+
+		// Valid request
+		var data map[string]interface{}
+		w := call(t, h, http.MethodPost, "/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "20.00"}`, &data)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+
+		if data["source_balance"] != "80" {
+			t.Errorf("expected source_balance=\"80\", got %v", data["source_balance"])
+		}
+		if data["dest_balance"] != "70" {
+			t.Errorf("expected dest_balance=\"70\", got %v", data["dest_balance"])
+		}
+		if data["transaction_id"] != 1.0 {
+			t.Errorf("expected transaction_id=1, got %v", data["transaction_id"])
+		}
+	})
 }
 
-// Fail: Destination account not found
+// Fail: Source account not found
 func TestTransactionHandler_SourceNotFound(t *testing.T) {
-	mock := setupMockDB(t)
-
-	// Expect existance of source account
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
-		WithArgs(1).
-		WillReturnError(sql.ErrNoRows)
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
 
-	body := `{"source_account_id":1,"destination_account_id":2,"amount":"10.00"}`
-	req := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewBufferString(body))
-	w := httptest.NewRecorder()
-
-	handlers.TransactionHandler(w, req)
-
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", w.Code)
-	}
+		if w := call(t, h, http.MethodPost, "/transactions", `{"source_account_id":1,"destination_account_id":2,"amount":"10.00"}`, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
 }
 
 // Fail: Destination account not found
 func TestTransactionHandler_DestinationNotFound(t *testing.T) {
-	mock := setupMockDB(t)
-
-	// Expect existance of source account
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
-		WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(100.0))
-
-	body := `{"source_account_id":1,"destination_account_id":2,"amount":"10.00"}`
-	req := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewBufferString(body))
-	w := httptest.NewRecorder()
-
-	handlers.TransactionHandler(w, req)
-
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", w.Code)
-	}
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+
+		if w := call(t, h, http.MethodPost, "/transactions", `{"source_account_id":1,"destination_account_id":2,"amount":"10.00"}`, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+		if got := accountBalance(t, h, 1); !got.Equal(decimal.RequireFromString("100")) {
+			t.Errorf("expected the source balance unchanged, got %s", got)
+		}
+	})
 }
 
 // Fail: Source balance insufficient
 func TestTransactionHandler_SourceBalanceInsufficient(t *testing.T) {
-	mock := setupMockDB(t)
-
-	// Expect source account SELECT with low balance
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
-		WithArgs(1).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(10.0))
-
-	// Expect destination account SELECT with some balance
-	mock.ExpectQuery("SELECT balance FROM accounts WHERE account_id =").
-		WithArgs(2).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(50.0))
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "10.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
+
+		if w := call(t, h, http.MethodPost, "/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "20.00"}`, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+		if got := accountBalance(t, h, 1); !got.Equal(decimal.RequireFromString("10")) {
+			t.Errorf("expected the source balance unchanged, got %s", got)
+		}
+	})
+}
 
-	// No transaction or update calls expected here because balance check fails before.
+// Fail: DB Error while locking
+func TestTransactionHandler_DBError(t *testing.T) {
+	srv, mock := setupMockDB(t)
 
-	body := []byte(`{"source_account_id": 1, "destination_account_id": 2, "amount": "20.00"}`)
-	req := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader(body))
-	w := httptest.NewRecorder()
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockQuery).WithArgs(1).WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
 
-	handlers.TransactionHandler(w, req)
+	// Expect server error rather than a misleading 400
+	if w := call(t, srv.Routes(), http.MethodPost, "/transactions", `{"source_account_id":1,"destination_account_id":2,"amount":"10.00"}`, nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+}
 
-	resp := w.Result()
+// Fail: Amount has more decimal places than allowed
+func TestTransactionHandler_AmountTooPrecise(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
+
+		if w := call(t, h, http.MethodPost, "/transactions", `{"source_account_id":1,"destination_account_id":2,"amount":"0.000000001"}`, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+		if got := accountBalance(t, h, 1); !got.Equal(decimal.RequireFromString("100")) {
+			t.Errorf("expected the source balance unchanged, got %s", got)
+		}
+	})
+}
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", resp.StatusCode)
-	}
+// Fail: Amounts with huge exponents are refused without building them out
+func TestTransferCurrency_ExponentAmount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
+
+		start := time.Now()
+		cases := map[string]error{"1e10000000": models.ErrTooLarge, "1e-30000000": models.ErrTooPrecise, "1e18": models.ErrTooLarge}
+		for amount, expected := range cases {
+			_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: 1, DestinationAccountID: 2, Amount: decimal.RequireFromString(amount)})
+			if !errors.Is(err, expected) {
+				t.Errorf("%s: expected %v, got %v", amount, expected, err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("expected the amounts refused quickly, took %s", elapsed)
+		}
+		if got := accountBalance(t, h, 1); !got.Equal(decimal.RequireFromString("100")) {
+			t.Errorf("expected the source balance unchanged, got %s", got)
+		}
+	})
+}
 
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("unmet expectations: %v", err)
-	}
+// Fail: The API only takes plain decimals of bounded length
+func TestTransactionHandler_ExponentAndLongAmount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "50.00", "currency": "SGD"}`)
+
+		for _, amount := range []string{"1e3", "1e-30000000", "1e10000000", strings.Repeat("9", 19), "0." + strings.Repeat("0", 100000) + "1"} {
+			body := `{"source_account_id": 1, "destination_account_id": 2, "amount": "` + amount + `"}`
+			if w := call(t, h, http.MethodPost, "/transactions", body, nil); w.Code != http.StatusBadRequest {
+				t.Errorf("%.20s: expected 400, got %d", amount, w.Code)
+			}
+		}
+		if got := accountBalance(t, h, 1); !got.Equal(decimal.RequireFromString("100")) {
+			t.Errorf("expected the source balance unchanged, got %s", got)
+		}
+	})
 }
@@ -0,0 +1,212 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"httpserver/handlers"
+	"httpserver/models"
+	"httpserver/store"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+// Transfer amount out of source into destination, returning the error
+func transferOut(srv *handlers.Server, source int, destination int, amount int64) error {
+	_, err := srv.TransferCurrency(context.Background(), models.TransferRequest{SourceAccountID: source, DestinationAccountID: destination, Amount: decimal.NewFromInt(amount)})
+	return err
+}
+
+/* Testcases for velocity limits */
+
+// Success: Transfers past the count or amount of the source's tier are refused and move no money
+func TestVelocity_Limits(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		srv.VelocityLimits = models.VelocityLimits{
+			"counted": {Window: time.Hour, MaxCount: 2},
+			"capped":  {Window: time.Hour, MaxAmount: map[string]decimal.Decimal{"SGD": decimal.NewFromInt(100)}},
+		}
+		createAccount(t, h, `{"account_id": 1, "initial_balance": "1000", "currency": "SGD", "tier": "counted"}`)
+		createAccount(t, h, `{"account_id": 2, "initial_balance": "1000", "currency": "SGD", "tier": "capped"}`)
+		createAccount(t, h, `{"account_id": 3, "initial_balance": "1000", "currency": "SGD"}`)
+
+		// Two transfers out of 1, transfers into it do not count
+		for _, err := range []error{transferOut(srv, 1, 3, 10), transferOut(srv, 3, 1, 10), transferOut(srv, 1, 3, 10)} {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		w, problem := callProblem(t, h, httptest.NewRequest(http.MethodPost, "/v1/transactions", strings.NewReader(`{"source_account_id": 1, "destination_account_id": 3, "amount": "1"}`)))
+		if w.Code != http.StatusUnprocessableEntity || problem.Code != handlers.CodeVelocityLimitExceeded || !strings.Contains(problem.Message, "at most 2 transfers") {
+			t.Errorf("expected the third transfer refused, got %d %+v", w.Code, problem)
+		}
+		if acc, _ := srv.Store.GetAccount(context.Background(), 1); !acc.CurrentBalance.Equal(decimal.NewFromInt(990)) || acc.Tier != "counted" {
+			t.Errorf("expected balance 990 in tier counted, got %s in %q", acc.CurrentBalance, acc.Tier)
+		}
+
+		// 60 then 50 goes over 100, 40 does not
+		if err := transferOut(srv, 2, 3, 60); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := transferOut(srv, 2, 3, 50); !errors.Is(err, handlers.ErrVelocityLimit) {
+			t.Errorf("expected the amount limit, got %v", err)
+		}
+		if err := transferOut(srv, 2, 3, 40); err != nil {
+			t.Errorf("expected a transfer up to the limit, got %v", err)
+		}
+
+		// Standard has no limits unless configured
+		for i := 0; i < 5; i++ {
+			if err := transferOut(srv, 3, 2, 100); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if report, err := srv.Store.Reconcile(context.Background()); err != nil || !report.Balanced {
+			t.Errorf("unexpected reconciliation %+v %v", report, err)
+		}
+	})
+}
+
+// Success: Transfers leave the window as it rolls on
+func TestVelocity_RollingWindow(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		srv.VelocityLimits = models.VelocityLimits{models.TierStandard: {Window: 300 * time.Millisecond, MaxCount: 1}}
+		srv.CreateAccount(context.Background(), 1, "SGD", decimal.NewFromInt(10), "", "")
+		srv.CreateAccount(context.Background(), 2, "SGD", decimal.Zero, "", "")
+
+		if err := transferOut(srv, 1, 2, 1); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := transferOut(srv, 1, 2, 1); !errors.Is(err, handlers.ErrVelocityLimit) {
+			t.Errorf("expected the count limit, got %v", err)
+		}
+		time.Sleep(350 * time.Millisecond)
+		if err := transferOut(srv, 1, 2, 1); err != nil {
+			t.Errorf("expected the first transfer to have left the window, got %v", err)
+		}
+	})
+}
+
+// Success: Parallel transfers out of one account never get past its limit
+func TestVelocity_Concurrent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		srv.VelocityLimits = models.VelocityLimits{"limited": {Window: time.Hour, MaxCount: 5, MaxAmount: map[string]decimal.Decimal{"SGD": decimal.NewFromInt(8)}}}
+		srv.CreateAccount(context.Background(), 1, "SGD", decimal.NewFromInt(100), "", "limited")
+		srv.CreateAccount(context.Background(), 2, "SGD", decimal.Zero, "", "")
+
+		// Amounts of 2 hit the amount limit after 4 transfers, before the count limit
+		var wg sync.WaitGroup
+		var succeeded atomic.Int64
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := transferOut(srv, 1, 2, 2)
+				if err == nil {
+					succeeded.Add(1)
+				} else if !errors.Is(err, handlers.ErrVelocityLimit) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if succeeded.Load() != 4 {
+			t.Errorf("expected exactly 4 transfers, got %d", succeeded.Load())
+		}
+		if acc, _ := srv.Store.GetAccount(context.Background(), 2); !acc.CurrentBalance.Equal(decimal.NewFromInt(8)) {
+			t.Errorf("expected 8 sent, got %s", acc.CurrentBalance)
+		}
+	})
+}
+
+// Failure: The count is read inside the transfer, a refused one is rolled back before any update
+func TestVelocity_SQL(t *testing.T) {
+	srv, mock := setupMockDB(t)
+	srv.VelocityLimits = models.VelocityLimits{models.TierStandard: {Window: time.Hour, MaxCount: 2}}
+
+	mock.ExpectBegin()
+	expectLock(mock, 1, "100.00")
+	expectLock(mock, 2, "50.00")
+	mock.ExpectQuery(`SELECT amount FROM transactions WHERE source_account_id = \$1 AND created_at >= \$2`).
+		WithArgs(1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"amount"}).AddRow("5").AddRow("7"))
+	mock.ExpectRollback()
+
+	if err := transferOut(srv, 1, 2, 20); !errors.Is(err, handlers.ErrVelocityLimit) {
+		t.Errorf("expected the count limit, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// Failure: Accounts are only created in tiers with limits, or standard
+func TestVelocity_UnknownTier(t *testing.T) {
+	srv, h := setupMemoryServer(t)
+	srv.VelocityLimits = models.VelocityLimits{"premium": {Window: time.Hour, MaxCount: 100}}
+
+	w, problem := callProblem(t, h, httptest.NewRequest(http.MethodPost, "/v1/accounts", strings.NewReader(`{"account_id": 1, "initial_balance": "0", "currency": "SGD", "tier": "gold"}`)))
+	if w.Code != http.StatusBadRequest || problem.Code != handlers.CodeValidationFailed {
+		t.Errorf("expected 400 validation_failed, got %d %+v", w.Code, problem)
+	}
+	w = call(t, h, http.MethodPost, "/v1/accounts", `{"account_id": 1, "initial_balance": "0", "currency": "SGD", "tier": "premium"}`, nil)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"tier":"premium"`) {
+		t.Errorf("expected the account in tier premium, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+// Success: Limit files are read with durations and amounts per currency, bad ones are refused
+func TestLoadVelocityLimits(t *testing.T) {
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "limits.json")
+		os.WriteFile(path, []byte(content), 0o600)
+		return path
+	}
+
+	limits, err := models.LoadVelocityLimits(write(`{"standard": {"window": "24h", "max_count": 20, "max_amount": {"SGD": "10000.50"}}, "premium": {"window": "1h", "max_count": 0}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	standard := limits[models.TierStandard]
+	if standard.Window != 24*time.Hour || standard.MaxCount != 20 || !standard.MaxAmount["SGD"].Equal(decimal.RequireFromString("10000.50")) || limits["premium"].Window != time.Hour {
+		t.Errorf("unexpected limits %+v", limits)
+	}
+
+	for name, content := range map[string]string{
+		"window":   `{"standard": {"window": "0s", "max_count": 1}}`,
+		"no unit":  `{"standard": {"window": "24", "max_count": 1}}`,
+		"count":    `{"standard": {"window": "1h", "max_count": -1}}`,
+		"currency": `{"standard": {"window": "1h", "max_amount": {"XXX": "1"}}}`,
+		"amount":   `{"standard": {"window": "1h", "max_amount": {"SGD": "0"}}}`,
+		"tier":     `{"` + strings.Repeat("t", 33) + `": {"window": "1h"}}`,
+		"json":     `["standard"]`,
+	} {
+		if _, err := models.LoadVelocityLimits(write(content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// Success: Accounts in a snapshot saved before tiers are standard
+func TestMemoryStore_SnapshotAccountsBeforeTiers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	os.WriteFile(path, []byte(`{"accounts": [{"account_id": 1, "balance": "5", "currency": "SGD"}]}`), 0o600)
+
+	restored, err := store.LoadMemorySnapshot(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if acc, err := restored.GetAccount(context.Background(), 1); err != nil || acc.Tier != models.TierStandard {
+		t.Errorf("expected tier standard, got %+v %v", acc, err)
+	}
+}
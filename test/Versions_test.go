@@ -0,0 +1,103 @@
+package test
+
+import (
+	"bytes"
+	"httpserver/handlers"
+	"httpserver/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+/* Testcases for /v1 */
+
+// Success: /v1 creates resources with 201 and a Location that reads them back
+func TestV1_CreateAndFollowLocation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		var account models.Account
+		w := call(t, h, http.MethodPost, "/v1/accounts", `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`, &account)
+		if w.Code != http.StatusCreated || w.Header().Get("Location") != "/v1/accounts/1" || !account.CurrentBalance.Equal(decimal.NewFromInt(100)) {
+			t.Fatalf("expected 201 with the account, got %d %s", w.Code, w.Body.String())
+		}
+		if w.Header().Get("Deprecation") != "" {
+			t.Errorf("expected /v1 not to be deprecated")
+		}
+		call(t, h, http.MethodPost, "/v1/accounts", `{"account_id": 2, "initial_balance": "0", "currency": "SGD"}`, nil)
+
+		var created models.Transaction
+		w = call(t, h, http.MethodPost, "/v1/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "30"}`, &created)
+		if w.Code != http.StatusCreated || created.Status != models.TransactionCompleted || !created.DestinationBalance.Equal(decimal.NewFromInt(30)) {
+			t.Fatalf("expected 201 with the transaction, got %d %s", w.Code, w.Body.String())
+		}
+
+		// The Location serves the same transaction
+		location := w.Header().Get("Location")
+		if location != "/v1/transactions/"+strconv.FormatInt(created.TransactionID, 10) {
+			t.Fatalf("unexpected Location %q", location)
+		}
+		var fetched models.Transaction
+		w = call(t, h, http.MethodGet, location, "", &fetched)
+		if w.Code != http.StatusOK || fetched.TransactionID != created.TransactionID || !fetched.Amount.Equal(created.Amount) {
+			t.Errorf("expected the created transaction, got %d %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// Success: Unversioned routes keep their responses and point at their successor
+func TestLegacy_Deprecated(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *handlers.Server, h http.Handler) {
+		srv.LegacySunset = time.Now().Add(24 * time.Hour)
+
+		w := call(t, h, http.MethodPost, "/accounts", `{"account_id": 1, "initial_balance": "100.00", "currency": "SGD"}`, nil)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", w.Code)
+		}
+		call(t, h, http.MethodPost, "/accounts", `{"account_id": 2, "initial_balance": "0", "currency": "SGD"}`, nil)
+
+		var response map[string]any
+		w = call(t, h, http.MethodPost, "/transactions", `{"source_account_id": 1, "destination_account_id": 2, "amount": "30"}`, &response)
+		if w.Code != http.StatusOK || response["dest_balance"] != "30" {
+			t.Errorf("expected the original response shape, got %d %s", w.Code, w.Body.String())
+		}
+
+		w = call(t, h, http.MethodGet, "/accounts/1", "", nil)
+		if deprecation := w.Header().Get("Deprecation"); deprecation != "@"+strconv.FormatInt(handlers.LegacyDeprecatedAt.Unix(), 10) {
+			t.Errorf("unexpected Deprecation %q", deprecation)
+		}
+		if sunset, err := http.ParseTime(w.Header().Get("Sunset")); err != nil || !sunset.Equal(srv.LegacySunset.Truncate(time.Second)) {
+			t.Errorf("unexpected Sunset %q", w.Header().Get("Sunset"))
+		}
+		if link := w.Header().Get("Link"); link != `</v1/accounts/1>; rel="successor-version"` {
+			t.Errorf("unexpected Link %q", link)
+		}
+
+		// Both versions share the same data
+		var account models.Account
+		w = call(t, h, http.MethodGet, "/v1/accounts/1", "", &account)
+		if w.Code != http.StatusOK || !account.CurrentBalance.Equal(decimal.NewFromInt(70)) {
+			t.Errorf("expected balance 70 through /v1, got %d %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// Fail: Past the sunset unversioned routes are gone, /v1 carries on
+func TestLegacy_Sunset(t *testing.T) {
+	srv, h := setupMemoryServer(t)
+	srv.LegacySunset = time.Now().Add(-time.Hour)
+
+	w, problem := callProblem(t, h, httptest.NewRequest(http.MethodPost, "/accounts", bytes.NewBufferString(`{"account_id": 1, "initial_balance": "1", "currency": "SGD"}`)))
+	if w.Code != http.StatusGone || problem.Code != handlers.CodeVersionRetired || w.Header().Get("Link") == "" {
+		t.Errorf("expected 410 pointing at /v1, got %d %+v", w.Code, problem)
+	}
+	if _, err := srv.GetAccountByID(t.Context(), 1); err == nil {
+		t.Errorf("expected the retired route not to create the account")
+	}
+
+	if w := call(t, h, http.MethodPost, "/v1/accounts", `{"account_id": 1, "initial_balance": "1", "currency": "SGD"}`, nil); w.Code != http.StatusCreated {
+		t.Errorf("expected /v1 to keep working, got %d", w.Code)
+	}
+}
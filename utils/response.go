@@ -3,13 +3,47 @@ package utils
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 )
 
+// Header carrying the ID of a request, repeated in error responses
+const RequestIDHeader = "X-Request-ID"
+
+// Error response following RFC 7807 problem details. Code is stable for clients to branch on, message is for humans
+type Problem struct {
+	Type      string         `json:"type"`
+	Title     string         `json:"title"`
+	Status    int            `json:"status"`
+	Code      string         `json:"code"`
+	Message   string         `json:"message"`
+	Details   map[string]any `json:"details,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+}
+
 // Write error in response
-func WriteError(w http.ResponseWriter, status int, message string) {
-	w.Header().Set("Content-Type", "application/json")
+func WriteError(w http.ResponseWriter, status int, code string, message string) {
+	WriteErrorDetails(w, status, code, message, nil)
+}
+
+// Write error with details in response, the request ID is taken from the response header
+func WriteErrorDetails(w http.ResponseWriter, status int, code string, message string, details map[string]any) {
+	title := http.StatusText(status)
+	if title == "" {
+		title = strings.ReplaceAll(code, "_", " ")
+	}
+	problem := Problem{
+		Type:      "about:blank",
+		Title:     title,
+		Status:    status,
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: w.Header().Get(RequestIDHeader),
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
 	w.WriteHeader(status)
-	_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+	_ = json.NewEncoder(w).Encode(problem)
 }
 
 // Write JSON in response